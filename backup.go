@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/pflag"
+	"libdb.so/dol-server/extension"
+	"libdb.so/dol-server/internal/backup"
+)
+
+// backupCommand implements the backup command. It makes, lists and restores
+// backups of the data of all extensions, without going through the server.
+func backupCommand(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: backup create|list|restore [flags]")
+	}
+
+	switch args[0] {
+	case "create":
+		return createBackup(ctx, args[1:])
+	case "list":
+		return listBackups(ctx, args[1:])
+	case "restore":
+		return restoreBackup(ctx, args[1:])
+	default:
+		return fmt.Errorf("unknown backup command %q", args[0])
+	}
+}
+
+// backupSources returns the data directories of the extensions as backup
+// sources.
+func backupSources(extensions *extension.ExtensionsManager) []backup.Source {
+	dirs := extensions.DataDirs()
+	sources := make([]backup.Source, 0, len(dirs))
+	for id, ext := range dirs {
+		src := backup.Source{
+			Name: id,
+			Dir:  ext.DataDir(),
+			Lock: ext.LockData,
+		}
+		if files, ok := ext.(extension.ExtensionDataFiles); ok {
+			src.Files = files.DataFiles()
+		}
+		sources = append(sources, src)
+	}
+	return sources
+}
+
+// readBackupConfig reads the backup config from the config file.
+func readBackupConfig() (Config, error) {
+	cfg, err := readConfig(config)
+	if err != nil {
+		return Config{}, err
+	}
+	if cfg.Backup == nil {
+		return Config{}, fmt.Errorf("no backup in config file")
+	}
+	return cfg, nil
+}
+
+// openExtensions creates the extensions of the config without starting them,
+// so that their data can be backed up or restored. They must be stopped after
+// use.
+func openExtensions(cfg Config) (*extension.ExtensionsManager, error) {
+	extensions, err := extension.NewExtensionsManager(cfg.Extensions)
+	if err != nil {
+		return nil, fmt.Errorf("creating extensions manager: %w", err)
+	}
+	return extensions, nil
+}
+
+func createBackup(ctx context.Context, args []string) error {
+	flags := pflag.NewFlagSet("backup create", pflag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: backup create")
+	}
+
+	cfg, err := readBackupConfig()
+	if err != nil {
+		return err
+	}
+
+	extensions, err := openExtensions(cfg)
+	if err != nil {
+		return err
+	}
+	defer extensions.Stop()
+
+	sources := backupSources(extensions)
+	if err := cfg.Backup.ValidateSources(sources); err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+
+	b, err := backup.Create(ctx, cfg.Backup.Path, sources)
+	if err != nil {
+		return fmt.Errorf("creating backup: %w", err)
+	}
+	fmt.Fprintln(os.Stderr, "created backup", b.Path)
+
+	pruned, err := backup.Prune(*cfg.Backup)
+	if err != nil {
+		return fmt.Errorf("pruning backups: %w", err)
+	}
+	for _, b := range pruned {
+		fmt.Fprintln(os.Stderr, "pruned backup", b.Path)
+	}
+
+	return nil
+}
+
+func listBackups(ctx context.Context, args []string) error {
+	flags := pflag.NewFlagSet("backup list", pflag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: backup list")
+	}
+
+	cfg, err := readBackupConfig()
+	if err != nil {
+		return err
+	}
+
+	backups, err := backup.List(cfg.Backup.Path)
+	if err != nil {
+		return fmt.Errorf("listing backups: %w", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, b := range backups {
+		fmt.Fprintf(w, "%s\t%s\t%d KiB\n", b.Name, b.Time.Format(time.DateTime), (b.Size+1023)/1024)
+	}
+	return w.Flush()
+}
+
+func restoreBackup(ctx context.Context, args []string) error {
+	flags := pflag.NewFlagSet("backup restore", pflag.ContinueOnError)
+	noBackup := flags.Bool("no-backup", false, "do not back up the current data before restoring")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: backup restore [flags] <backup>")
+	}
+
+	cfg, err := readBackupConfig()
+	if err != nil {
+		return err
+	}
+
+	// Backups can be given by name, as printed by backup list, or by path.
+	backupPath := flags.Arg(0)
+	if _, err := os.Stat(backupPath); err != nil && !strings.ContainsRune(backupPath, filepath.Separator) {
+		backupPath = filepath.Join(cfg.Backup.Path, backupPath)
+	}
+
+	if _, err := os.Stat(backupPath); err != nil {
+		return fmt.Errorf("reading backup: %w", err)
+	}
+
+	extensions, err := openExtensions(cfg)
+	if err != nil {
+		return err
+	}
+	defer extensions.Stop()
+
+	sources := backupSources(extensions)
+	if err := cfg.Backup.ValidateSources(sources); err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+
+	if !*noBackup {
+		b, err := backup.Create(ctx, cfg.Backup.Path, sources)
+		if err != nil {
+			return fmt.Errorf("backing up the current data: %w", err)
+		}
+		fmt.Fprintln(os.Stderr, "backed up the current data to", b.Path)
+	}
+
+	restored, err := backup.Restore(ctx, backupPath, sources)
+	if err != nil {
+		return fmt.Errorf("restoring backup: %w", err)
+	}
+
+	fmt.Fprintln(os.Stderr, "restored the data of", strings.Join(restored, ", "))
+	return nil
+}
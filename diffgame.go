@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"libdb.so/dol-server/internal/udiff"
+	"libdb.so/dol-server/storydata"
+)
+
+// diffGame implements the diff-game command. It prints the passages and assets
+// that changed between two game releases, which can be directories or zip
+// archives.
+func diffGame(ctx context.Context, args []string) error {
+	flags := pflag.NewFlagSet("diff-game", pflag.ContinueOnError)
+	unified := flags.BoolP("unified", "u", false, "print a unified diff of modified passages")
+	contextLines := flags.IntP("context", "U", 3, "number of context lines in unified diffs")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return fmt.Errorf("usage: diff-game [flags] <old> <new>")
+	}
+	if *contextLines < 0 {
+		return fmt.Errorf("usage: diff-game [flags] <old> <new>: --context must not be negative")
+	}
+
+	oldGame, err := openDiffGame(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("old game: %w", err)
+	}
+	defer oldGame.files.Close()
+
+	newGame, err := openDiffGame(flags.Arg(1))
+	if err != nil {
+		return fmt.Errorf("new game: %w", err)
+	}
+	defer newGame.files.Close()
+
+	out := os.Stdout
+	fmt.Fprintf(out, "version: %s -> %s\n", oldGame.version, newGame.version)
+
+	added, removed, modified := diffPassages(oldGame.story, newGame.story)
+	fmt.Fprintf(out, "\npassages: %d added, %d removed, %d modified\n",
+		len(added), len(removed), len(modified))
+	for _, name := range added {
+		fmt.Fprintf(out, "+ %s\n", name)
+	}
+	for _, name := range removed {
+		fmt.Fprintf(out, "- %s\n", name)
+	}
+	for _, name := range modified {
+		fmt.Fprintf(out, "~ %s\n", name)
+	}
+
+	assets, err := diffAssets(ctx, oldGame.files, newGame.files)
+	if err != nil {
+		return fmt.Errorf("comparing assets: %w", err)
+	}
+
+	fmt.Fprintf(out, "\nassets: %d added, %d removed, %d modified\n",
+		len(assets.added), len(assets.removed), len(assets.modified))
+	for _, name := range assets.added {
+		fmt.Fprintf(out, "+ %s\n", name)
+	}
+	for _, name := range assets.removed {
+		fmt.Fprintf(out, "- %s\n", name)
+	}
+	for _, name := range assets.modified {
+		fmt.Fprintf(out, "~ %s\n", name)
+	}
+
+	if *unified {
+		for _, name := range modified {
+			oldPassage := oldGame.story.Passage(name)
+			newPassage := newGame.story.Passage(name)
+
+			fmt.Fprintln(out)
+			if tags := strings.Join(oldPassage.Tags, " "); tags != strings.Join(newPassage.Tags, " ") {
+				fmt.Fprintf(out, "tags of %s: [%s] -> [%s]\n",
+					name, tags, strings.Join(newPassage.Tags, " "))
+			}
+			fmt.Fprint(out, udiff.Unified(
+				"a/"+name, "b/"+name,
+				oldPassage.Text, newPassage.Text,
+				*contextLines))
+		}
+	}
+
+	return nil
+}
+
+type diffGameRelease struct {
+	files   *gameFS
+	story   *storydata.Story
+	version string
+}
+
+// openDiffGame opens a game release the same way the server does.
+func openDiffGame(path string) (*diffGameRelease, error) {
+	files, err := openGameFS(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dolHTMLFile, err := findDoLHTML(files)
+	if err != nil {
+		files.Close()
+		return nil, err
+	}
+
+	dolHTML, err := fs.ReadFile(files, dolHTMLFile)
+	if err != nil {
+		files.Close()
+		return nil, fmt.Errorf("failed to read DoL HTML file: %w", err)
+	}
+
+	story, err := storydata.Parse(dolHTML)
+	if err != nil {
+		files.Close()
+		return nil, fmt.Errorf("failed to parse story data: %w", err)
+	}
+
+	return &diffGameRelease{
+		files:   files,
+		story:   story,
+		version: detectDoLVersion(dolHTML),
+	}, nil
+}
+
+// diffPassages returns the names of the passages that were added, removed or
+// modified between the two stories, sorted by name.
+func diffPassages(oldStory, newStory *storydata.Story) (added, removed, modified []string) {
+	for _, p := range newStory.Passages() {
+		old := oldStory.Passage(p.Name)
+		switch {
+		case old == nil:
+			added = append(added, p.Name)
+		case old.Text != p.Text || strings.Join(old.Tags, " ") != strings.Join(p.Tags, " "):
+			modified = append(modified, p.Name)
+		}
+	}
+	for _, p := range oldStory.Passages() {
+		if newStory.Passage(p.Name) == nil {
+			removed = append(removed, p.Name)
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(modified)
+	return
+}
+
+// assetsDir is the directory of the game's assets.
+const assetsDir = "img"
+
+type assetsDiff struct {
+	added, removed, modified []string
+}
+
+// diffAssets compares the assets of two games. Files are only hashed if their
+// sizes are equal.
+func diffAssets(ctx context.Context, oldFiles, newFiles fs.FS) (*assetsDiff, error) {
+	oldSizes, err := assetSizes(oldFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	newSizes, err := assetSizes(newFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	var diff assetsDiff
+	for name, newSize := range newSizes {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		oldSize, ok := oldSizes[name]
+		if !ok {
+			diff.added = append(diff.added, name)
+			continue
+		}
+
+		if oldSize != newSize {
+			diff.modified = append(diff.modified, name)
+			continue
+		}
+
+		same, err := sameFile(oldFiles, newFiles, name)
+		if err != nil {
+			return nil, err
+		}
+		if !same {
+			diff.modified = append(diff.modified, name)
+		}
+	}
+	for name := range oldSizes {
+		if _, ok := newSizes[name]; !ok {
+			diff.removed = append(diff.removed, name)
+		}
+	}
+
+	sort.Strings(diff.added)
+	sort.Strings(diff.removed)
+	sort.Strings(diff.modified)
+	return &diff, nil
+}
+
+func assetSizes(files fs.FS) (map[string]int64, error) {
+	sizes := make(map[string]int64)
+	err := fs.WalkDir(files, assetsDir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		sizes[name] = info.Size()
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return sizes, nil
+}
+
+func sameFile(a, b fs.FS, name string) (bool, error) {
+	aHash, err := hashFile(a, name)
+	if err != nil {
+		return false, err
+	}
+	bHash, err := hashFile(b, name)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(aHash, bHash), nil
+}
+
+func hashFile(files fs.FS, name string) ([]byte, error) {
+	f, err := files.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", name, err)
+	}
+	return h.Sum(nil), nil
+}
@@ -1,12 +1,23 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
+	"context"
 	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
 	"log/slog"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	_ "embed"
@@ -15,30 +26,11 @@ import (
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/httplog/v2"
 	"libdb.so/dol-server/extension"
+	"libdb.so/dol-server/internal/htmlinject"
 	"libdb.so/dol-server/internal/httputil"
 )
 
-func newDoLServer(gamePath string, extensions *extension.ExtensionsManager) (http.Handler, error) {
-	// Attempt to find the HTML file.
-	dolHTMLFiles, err := filepath.Glob(filepath.Join(gamePath, "*.html"))
-	if err != nil {
-		return nil, fmt.Errorf("failed to find HTML files in DoL path: %w", err)
-	}
-	if len(dolHTMLFiles) != 1 {
-		return nil, fmt.Errorf("found %d HTML files in DoL path, expected 1", len(dolHTMLFiles))
-	}
-
-	slog.Debug(
-		"found Degrees of Lewdity HTML file",
-		"file", dolHTMLFiles[0],
-		"path", gamePath)
-
-	// Patch the DoL HTML file to include the scripts.
-	dolHTML, err := patchDoLHTML(dolHTMLFiles[0], extensions.JSPaths())
-	if err != nil {
-		return nil, fmt.Errorf("failed to patch DoL HTML file: %w", err)
-	}
-
+func newDoLServer(ctx context.Context, games GamePaths, extensions *extension.ExtensionsManager) (http.Handler, error) {
 	r := chi.NewMux()
 	r.Use(middleware.Compress(5))
 
@@ -60,31 +52,407 @@ func newDoLServer(gamePath string, extensions *extension.ExtensionsManager) (htt
 		}))
 	}
 
+	if games.IsSingle() {
+		game, err := newDoLGameServer(ctx, "", games[""], extensions)
+		if err != nil {
+			return nil, err
+		}
+		r.Mount("/", game)
+		return r, nil
+	}
+
+	names := make([]string, 0, len(games))
+	for name := range games {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		game, err := newDoLGameServer(ctx, name, games[name], extensions)
+		if err != nil {
+			return nil, fmt.Errorf("game %q: %w", name, err)
+		}
+
+		prefix := "/" + name
+		r.Mount(prefix, http.StripPrefix(prefix, game))
+		// Relative paths only work if the game is served under a directory.
+		r.Get(prefix, http.RedirectHandler(prefix+"/", http.StatusMovedPermanently).ServeHTTP)
+	}
+
+	var picker bytes.Buffer
+	if err := gamePickerTemplate.Execute(&picker, names); err != nil {
+		return nil, fmt.Errorf("failed to render game picker: %w", err)
+	}
+
+	r.Get("/", httputil.BytesServer("text/html", picker.Bytes()))
+
+	return r, nil
+}
+
+// newDoLGameServer creates a handler that serves a single game. The handler
+// expects request paths to be relative to the game's root. All requests are
+// tagged with the game name so that extensions can tell games apart.
+//
+// The game is watched until ctx is done, and it is reloaded whenever its HTML
+// file or archive changes.
+func newDoLGameServer(ctx context.Context, name, gamePath string, extensions *extension.ExtensionsManager) (http.Handler, error) {
+	prefix := "/"
+	if name != "" {
+		prefix = "/" + name
+	}
+
+	snippets, err := extensions.HTMLSnippets(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect HTML injections: %w", err)
+	}
+
+	game := &dolGame{
+		name:       name,
+		path:       gamePath,
+		extensions: extensions,
+		snippets:   snippets,
+	}
+
+	if err := game.load(ctx); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		if err := game.watch(ctx); err != nil {
+			slog.Error(
+				"failed to watch Degrees of Lewdity directory, game will not be reloaded",
+				"game", name,
+				"path", gamePath,
+				"error", err)
+		}
+	}()
+
+	r := chi.NewMux()
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := extension.WithGame(r.Context(), name)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	})
+
 	extensions.BindRouter(r)
 
-	r.Get("/", httputil.BytesServer("text/html", dolHTML))
-	r.Mount("/", http.FileServer(http.Dir(gamePath)))
+	r.Get("/", game.html.ServeHTTP)
+	r.Mount("/", game)
 
 	return r, nil
 }
 
-func patchDoLHTML(htmlFile string, scripts []string) ([]byte, error) {
-	var extras bytes.Buffer
-	for _, script := range scripts {
-		slog.Debug(
-			"patching Degrees of Lewdity HTML file with JS script",
-			"script", script)
-		fmt.Fprintf(&extras, `<script src="%s" type="module"></script>`, script)
+// dolGame is a single game whose patched HTML file is served along with the
+// rest of the game files. The game is either a directory or a zip archive.
+type dolGame struct {
+	name       string
+	path       string
+	extensions *extension.ExtensionsManager
+	snippets   htmlinject.Snippets
+	html       *httputil.BytesFile
+	files      atomic.Pointer[gameFS]
+}
+
+// load finds and patches the game's HTML file, then atomically replaces the
+// served HTML and game files with it. If the game is invalid, the previously
+// loaded game is kept.
+func (g *dolGame) load(ctx context.Context) error {
+	files, err := openGameFS(g.path)
+	if err != nil {
+		return err
+	}
+
+	dolHTMLFile, err := findDoLHTML(files)
+	if err != nil {
+		files.Close()
+		return err
+	}
+
+	slog.Debug(
+		"found Degrees of Lewdity HTML file",
+		"game", g.name,
+		"file", dolHTMLFile,
+		"path", g.path)
+
+	dolHTML, err := fs.ReadFile(files, dolHTMLFile)
+	if err != nil {
+		files.Close()
+		return fmt.Errorf("failed to read DoL HTML file: %w", err)
+	}
+
+	ctx = extension.WithGame(ctx, g.name)
+
+	// Let extensions patch the passages and rewrite the DoL HTML file before
+	// injecting anything.
+	dolHTML, err = g.extensions.PatchStory(ctx, dolHTML)
+	if err != nil {
+		files.Close()
+		return fmt.Errorf("failed to patch DoL story data: %w", err)
+	}
+
+	dolHTML, err = g.extensions.PatchHTML(ctx, dolHTML)
+	if err != nil {
+		files.Close()
+		return fmt.Errorf("failed to patch DoL HTML file: %w", err)
 	}
 
-	html, err := os.ReadFile(htmlFile)
+	// Patch the DoL HTML file to include the extension injections.
+	dolHTML, err = htmlinject.Inject(dolHTML, g.snippets)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read DoL HTML file: %w", err)
+		files.Close()
+		return fmt.Errorf("failed to patch DoL HTML file: %w", err)
 	}
 
-	html = bytes.Replace(html,
-		[]byte("</head>"),
-		append(extras.Bytes(), []byte("</head>")...), 1)
+	if g.html == nil {
+		g.html = httputil.NewBytesFile("text/html", dolHTML)
+	} else {
+		g.html.Store(dolHTML)
+	}
 
-	return html, nil
+	if old := g.files.Swap(files); old != nil {
+		// Requests might still be reading from the old archive, so it is
+		// only closed once they are done.
+		old.Close()
+	}
+
+	slog.Info(
+		"loaded Degrees of Lewdity",
+		"game", g.name,
+		"version", detectDoLVersion(dolHTML),
+		"file", dolHTMLFile,
+		"path", g.path)
+
+	return nil
 }
+
+// ServeHTTP serves the game files.
+func (g *dolGame) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for {
+		files := g.files.Load()
+		// The game might have been reloaded after the files were loaded, in
+		// which case the new files are loaded again.
+		if !files.acquire() {
+			continue
+		}
+		defer files.release()
+
+		http.FileServer(http.FS(files)).ServeHTTP(w, r)
+		return
+	}
+}
+
+// gameFS is the file system of a game. It is either a directory or a zip
+// archive.
+type gameFS struct {
+	fs.FS
+	closer io.Closer
+
+	mu      sync.Mutex
+	readers int
+	closed  bool
+}
+
+// isGameArchive returns true if the game path points to a zip archive instead
+// of a directory.
+func isGameArchive(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".zip")
+}
+
+// openGameFS opens the game at the given path. If the path is a zip file, the
+// game is served from the archive.
+func openGameFS(path string) (*gameFS, error) {
+	if !isGameArchive(path) {
+		return &gameFS{FS: os.DirFS(path)}, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open DoL zip archive: %w", err)
+	}
+
+	z, err := newZipFS(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to open DoL zip archive: %w", err)
+	}
+
+	return &gameFS{FS: z, closer: f}, nil
+}
+
+// acquire marks the files as being read by a request. It returns false if the
+// files are already closed. Each successful acquire must be followed by a
+// release.
+func (f *gameFS) acquire() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return false
+	}
+	f.readers++
+	return true
+}
+
+// release marks a request acquired with acquire as done. If the files were
+// closed in the meantime and this was the last request, the archive is closed.
+func (f *gameFS) release() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.readers--
+	if f.closed && f.readers == 0 {
+		f.closeArchive()
+	}
+}
+
+// Close closes the game archive, if any. If requests are still reading from
+// it, it is closed once the last one is done.
+func (f *gameFS) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+
+	if f.readers > 0 {
+		return nil
+	}
+	return f.closeArchive()
+}
+
+func (f *gameFS) closeArchive() error {
+	if f.closer == nil {
+		return nil
+	}
+	if err := f.closer.Close(); err != nil {
+		slog.Warn(
+			"failed to close game archive",
+			"error", err)
+		return err
+	}
+	return nil
+}
+
+// zipFS is a zip archive whose files can be seeked, so that they can be served
+// with range requests and have their content type sniffed. Stored files are
+// read straight from the archive, and compressed files are decompressed into
+// memory when they are opened.
+type zipFS struct {
+	*zip.Reader
+	ra    io.ReaderAt
+	files map[string]*zip.File
+}
+
+func newZipFS(f *os.File) (*zipFS, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := zip.NewReader(f, stat.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]*zip.File, len(r.File))
+	for _, file := range r.File {
+		files[path.Clean(file.Name)] = file
+	}
+
+	return &zipFS{Reader: r, ra: f, files: files}, nil
+}
+
+// Open implements fs.FS.
+func (z *zipFS) Open(name string) (fs.File, error) {
+	f, err := z.Reader.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	zf, ok := z.files[name]
+	if !ok || zf.Mode().IsDir() {
+		// Directories are not read, so they can be served as they are.
+		return f, nil
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if zf.Method == zip.Store {
+		offset, err := zf.DataOffset()
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		r := io.NewSectionReader(z.ra, offset, int64(zf.UncompressedSize64))
+		return zipFile{stat, r}, nil
+	}
+
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+
+	return zipFile{stat, bytes.NewReader(b)}, nil
+}
+
+// zipFile is a seekable file in a zipFS.
+type zipFile struct {
+	stat fs.FileInfo
+	io.ReadSeeker
+}
+
+func (f zipFile) Stat() (fs.FileInfo, error) { return f.stat, nil }
+func (f zipFile) Close() error               { return nil }
+
+// findDoLHTML returns the name of the game's HTML file. There must be exactly
+// one HTML file at the root of the game.
+func findDoLHTML(files fs.FS) (string, error) {
+	dolHTMLFiles, err := fs.Glob(files, "*.html")
+	if err != nil {
+		return "", fmt.Errorf("failed to find HTML files in DoL path: %w", err)
+	}
+	if len(dolHTMLFiles) != 1 {
+		return "", fmt.Errorf("found %d HTML files in DoL path, expected 1", len(dolHTMLFiles))
+	}
+	return dolHTMLFiles[0], nil
+}
+
+var dolVersionRegex = regexp.MustCompile(`StartConfig\s*=\s*\{[^}]*?\bversion\s*:\s*["']([^"']+)["']`)
+
+// detectDoLVersion returns the game version declared in the DoL HTML file, or
+// "unknown" if none is found.
+func detectDoLVersion(html []byte) string {
+	m := dolVersionRegex.FindSubmatch(html)
+	if m == nil {
+		return "unknown"
+	}
+	return string(m[1])
+}
+
+var gamePickerTemplate = template.Must(template.New("picker").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<title>Degrees of Lewdity</title>
+	<style>
+		body { font-family: sans-serif; max-width: 30em; margin: 2em auto; padding: 0 1em; }
+		li { margin: 0.5em 0; }
+	</style>
+</head>
+<body>
+	<h1>Pick a game</h1>
+	<ul>
+		{{- range . }}
+		<li><a href="/{{ . }}/">{{ . }}</a></li>
+		{{- end }}
+	</ul>
+</body>
+</html>
+`))
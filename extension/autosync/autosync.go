@@ -5,16 +5,17 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"time"
 
 	_ "embed"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/gofrs/flock"
 	"libdb.so/dol-server/extension"
 	"libdb.so/dol-server/internal/httputil"
 )
@@ -36,68 +37,214 @@ type Config struct {
 	// SavePath is the path to save the autosync data to.
 	// If unset, os.UserConfigDir() is used.
 	SavePath string `json:"save_path"`
+	// History configures how many old saves are kept. Every save written by
+	// the server is added to the history.
+	History HistoryConfig `json:"history"`
+	// Store configures where saves are stored. By default, they are stored
+	// as files in SavePath.
+	Store StoreConfig `json:"store"`
+	// Profiles configures per-user saves.
+	Profiles ProfilesConfig `json:"profiles"`
+	// Encryption configures the encryption of saves at rest. Saves are not
+	// encrypted if it is unset.
+	Encryption EncryptionConfig `json:"encryption"`
+	// Replication configures replication with another server.
+	Replication ReplicationConfig `json:"replication"`
+	// Leases configures play session leases, which stop two devices from
+	// playing the same game at once.
+	Leases LeaseConfig `json:"leases"`
 }
 
 type autosyncExtension struct {
 	*chi.Mux
-	cfg      Config
-	saveFile string
-	saveLock *flock.Flock
+	cfg       Config
+	resolver  IdentityResolver
+	store     *saveStore
+	summaries summaryCache
+	events    *saveEvents
+	// leases are the play session leases of all games, or nil if leases are
+	// disabled.
+	leases *leaseTable
+
+	// peer is the server that saves are replicated with, or nil.
+	peer            *peerClient
+	stopReplication context.CancelFunc
+	replicationDone chan struct{}
 }
 
 var (
 	_ extension.Extension            = (*autosyncExtension)(nil)
 	_ extension.ExtensionHTTPHandler = (*autosyncExtension)(nil)
 	_ extension.ExtensionJSHookable  = (*autosyncExtension)(nil)
+	_ extension.ExtensionDataDir     = (*autosyncExtension)(nil)
+	_ extension.ExtensionDataFiles   = (*autosyncExtension)(nil)
 )
 
 // New returns a new autosync extension.
 func New(cfgJSON json.RawMessage) (extension.Extension, error) {
+	cfg, err := parseConfig(cfgJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	resolver, err := newIdentityResolver(cfg.Profiles)
+	if err != nil {
+		return nil, fmt.Errorf("profiles: %w", err)
+	}
+
+	store, err := newSaveStore(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("store: %w", err)
+	}
+
+	e := &autosyncExtension{
+		Mux:      chi.NewRouter(),
+		cfg:      cfg,
+		resolver: resolver,
+		store:    store,
+		events:   newSaveEvents(),
+	}
+
+	if cfg.Replication.Peer != "" {
+		e.peer, err = newPeerClient(cfg.Replication)
+		if err != nil {
+			store.Close()
+			return nil, fmt.Errorf("replication: %w", err)
+		}
+	}
+
+	if cfg.Leases.Enabled {
+		e.leases, err = newLeaseTable(cfg.Leases)
+		if err != nil {
+			store.Close()
+			return nil, fmt.Errorf("leases: %w", err)
+		}
+	}
+
+	e.Get("/autosync.js", httputil.BytesServer("application/javascript", autosyncScript))
+	e.Get("/profile", e.getProfile)
+	e.Post("/profile", e.setProfile)
+
+	e.Group(func(r chi.Router) {
+		r.Use(e.requireProfile)
+		r.Get("/slots", e.listSlots)
+		r.Get("/events", e.streamEvents)
+
+		// The routes without a slot act on the autosave slot, which is the
+		// only slot that older clients know about.
+		r.Get("/save", e.getSave)
+		r.Get("/save/summary", e.getSaveSummary)
+		r.Get("/save/{slot}", e.getSave)
+		r.Get("/save/{slot}/summary", e.getSaveSummary)
+		r.Post("/merge", e.handleMerge)
+		r.Post("/merge/{slot}", e.handleMerge)
+		r.Get("/history", e.listHistory)
+		r.Get("/history/{id}", e.getHistoryEntry)
+		r.Post("/history/{id}/restore", e.restoreHistoryEntry)
+		r.Get("/slots/{slot}/history", e.listHistory)
+		r.Get("/slots/{slot}/history/{id}", e.getHistoryEntry)
+		r.Post("/slots/{slot}/history/{id}/restore", e.restoreHistoryEntry)
+		r.Get("/export", e.exportSaveFile)
+		r.Get("/export/{slot}", e.exportSaveFile)
+		r.Post("/import", e.importSaveFile)
+		r.Post("/import/{slot}", e.importSaveFile)
+		r.Get("/devices", e.listDevices)
+		r.Post("/devices", e.registerDevice)
+		r.Put("/devices/{id}", e.renameDevice)
+		r.Delete("/devices/{id}", e.forgetDevice)
+
+		if e.leases != nil {
+			r.Get("/lease", e.getLease)
+			r.Post("/lease", e.acquireLease)
+			r.Delete("/lease", e.releaseLease)
+			r.Post("/lease/takeover", e.takeOverLease)
+		}
+	})
+
+	if cfg.Replication.Token != "" {
+		e.Group(func(r chi.Router) {
+			r.Use(e.requireReplicationToken)
+			r.Get("/replication/heads", e.listReplicaHeads)
+			r.Get("/replication/save", e.getReplicaSave)
+		})
+	}
+
+	return e, nil
+}
+
+// parseConfig parses the config and fills in the defaults.
+func parseConfig(cfgJSON json.RawMessage) (Config, error) {
 	var cfg Config
-	if err := json.Unmarshal(cfgJSON, &cfg); err != nil {
-		return nil, fmt.Errorf("unmarshaling config: %w", err)
+	if len(cfgJSON) > 0 {
+		if err := json.Unmarshal(cfgJSON, &cfg); err != nil {
+			return Config{}, fmt.Errorf("unmarshaling config: %w", err)
+		}
 	}
 
 	if cfg.SavePath == "" {
 		base, err := os.UserConfigDir()
 		if err != nil {
-			return nil, fmt.Errorf("getting user config dir: %w", err)
+			return Config{}, fmt.Errorf("getting user config dir: %w", err)
 		}
 		cfg.SavePath = filepath.Join(base, "dol-server", "autosync")
 	}
 
-	if err := os.MkdirAll(cfg.SavePath, 0755); err != nil {
-		return nil, fmt.Errorf("creating save path: %w", err)
+	if cfg.History == (HistoryConfig{}) {
+		cfg.History = defaultHistoryConfig
 	}
 
-	e := &autosyncExtension{
-		Mux:      chi.NewRouter(),
-		cfg:      cfg,
-		saveFile: filepath.Join(cfg.SavePath, "autosync.dat"),
-		saveLock: flock.New(filepath.Join(cfg.SavePath, "autosync.lock")),
+	return cfg, nil
+}
+
+// gameSaveKey returns the key prefix of the saves of the profile and game that
+// the given context belongs to. Saves of the shared profile and the unnamed
+// game have no prefix. Every other profile and game gets its own prefix, so
+// that saves of different users and builds never get mixed.
+func (e *autosyncExtension) gameSaveKey(ctx context.Context) string {
+	key := profileKey(ctx)
+	if game := extension.GameFromContext(ctx); game != "" {
+		key = path.Join(key, "games", game)
 	}
+	return key
+}
 
-	e.Get("/autosync.js", httputil.BytesServer("application/javascript", autosyncScript))
-	e.Get("/save", e.getSave)
-	e.Post("/merge", e.handleMerge)
+// saveKeyFor returns the store key of the given slot for the profile and game
+// that the given context belongs to. The autosave slot is stored directly
+// under the game's key, which is where it was stored before there were slots.
+func (e *autosyncExtension) saveKeyFor(ctx context.Context, slot string) (string, error) {
+	if !validSlotName(slot) {
+		return "", fmt.Errorf("%w %q", errInvalidSlot, slot)
+	}
 
-	return e, nil
+	key := e.gameSaveKey(ctx)
+	if slot != AutosaveSlot {
+		key = path.Join(key, "slots", slot)
+	}
+	return key, nil
 }
 
 func (e *autosyncExtension) getSave(w http.ResponseWriter, r *http.Request) {
-	release, err := e.acquireSaveData(r.Context())
+	key, err := e.saveKeyFor(r.Context(), slotFromRequest(r))
 	if err != nil {
-		writeMergeError(w, 500, fmt.Errorf("acquiring server save data: %w", err))
+		writeMergeError(w, 400, err)
 		return
 	}
-	defer release()
 
-	serverSave, err := e.readSaveData()
+	serverSave, err := e.store.Get(r.Context(), key)
 	if err != nil {
 		writeMergeError(w, 500, fmt.Errorf("reading server save data: %w", err))
 		return
 	}
 
+	serverSaveHash := hashData(serverSave)
+	setSaveETag(w, serverSaveHash)
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && etagMatches(ifNoneMatch, serverSaveHash, true) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
 	type GetSyncResponse struct {
 		Save       *SaveData `json:"save"`
 		ServerHash string    `json:"server_hash,omitempty"`
@@ -105,7 +252,7 @@ func (e *autosyncExtension) getSave(w http.ResponseWriter, r *http.Request) {
 
 	writeJSON(w, 200, GetSyncResponse{
 		Save:       serverSave,
-		ServerHash: hashData(serverSave),
+		ServerHash: serverSaveHash,
 	})
 }
 
@@ -119,30 +266,57 @@ func (e *autosyncExtension) handleMerge(w http.ResponseWriter, r *http.Request)
 	clientSaveHash := hashData(&clientSave.SaveData)
 	clientLastHash := clientSave.LastHash
 
-	release, err := e.acquireSaveData(r.Context())
+	slot := slotFromRequest(r)
+	key, err := e.saveKeyFor(r.Context(), slot)
 	if err != nil {
-		writeMergeError(w, 500, fmt.Errorf("acquiring server save data: %w", err))
+		writeMergeError(w, 400, err)
 		return
 	}
-	defer release()
 
-	serverSave, err := e.readSaveData()
+	if !e.checkLease(w, r) {
+		return
+	}
+
+	if err := e.touchDevice(r); err != nil {
+		log := extension.LoggerFromContext(r.Context())
+		log.Warn(
+			"cannot update the last seen date of the device",
+			"err", err)
+	}
+
+	serverSave, err := e.store.Get(r.Context(), key)
 	if err != nil {
 		writeMergeError(w, 500, fmt.Errorf("reading server save data: %w", err))
 		return
 	}
 
+	serverSaveHash := hashData(serverSave)
+
+	if hasPreconditions(r) {
+		// Clients that use entity tags do not merge: the save is only
+		// written if it is based on the save that the client expects.
+		if !checkPreconditions(r, serverSaveHash) {
+			writeMergeResult(w, 412, e.conflictData(r.Context(), key, serverSave, nil))
+			return
+		}
+		clientLastHash = serverSaveHash
+	}
+
 	if r.FormValue("override") != "" || serverSave == nil {
 		log := extension.LoggerFromContext(r.Context())
 		log.Debug("overriding autosync data")
 
 		// Client commands to override the server save data.
 		// This is usually done with user confirmation.
-		if err := e.writeSaveData(&clientSave.SaveData); err != nil {
-			writeMergeError(w, 500, fmt.Errorf("writing save data: %w", err))
+		_, err := e.putSave(r.Context(), slot, key, serverSaveHash, &clientSave.SaveData, SourceOverride)
+		if err != nil {
+			e.writePutError(w, r, key, err)
 			return
 		}
 
+		// Overriding also settles any conflict with the peer's save.
+		e.resolvePeerConflict(r.Context(), key, nil)
+
 		writeMergeResult(w, 200, MergeOKData{
 			Consistent: false,
 			Hash:       clientSaveHash,
@@ -150,7 +324,6 @@ func (e *autosyncExtension) handleMerge(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	serverSaveHash := hashData(serverSave)
 	conflicting := serverSaveHash != clientLastHash
 
 	log := extension.LoggerFromContext(r.Context())
@@ -163,18 +336,41 @@ func (e *autosyncExtension) handleMerge(w http.ResponseWriter, r *http.Request)
 		"conflicting", conflicting)
 
 	if conflicting {
-		// Remote is outdated.
-		// The client should update the client save data.
-		writeMergeResult(w, 409, MergeConflictData{
-			Save:       serverSave,
-			ServerHash: serverSaveHash,
+		// Remote is outdated. Try to merge the changes of both sides first.
+		merged, conflicts := e.mergeWithServer(r.Context(), key, clientLastHash, serverSave, &clientSave.SaveData)
+		if merged == nil {
+			// The client should update the client save data.
+			conflict := e.conflictData(r.Context(), key, serverSave, clientSave)
+			conflict.ConflictingKeys = conflicts
+			writeMergeResult(w, 409, conflict)
+			return
+		}
+
+		merged.Device = clientSave.Device
+
+		_, err = e.putSave(r.Context(), slot, key, serverSaveHash, merged, SourceMerge)
+		if err != nil {
+			e.writePutError(w, r, key, err)
+			return
+		}
+
+		writeMergeResult(w, 200, MergeOKData{
+			Consistent: false,
+			Hash:       hashData(merged),
+			Save:       merged,
 		})
 		return
 	}
 
+	// Things look consistent, but the save may have diverged on the peer.
+	if e.mergePeerConflict(w, r, slot, key, serverSave, clientSave) {
+		return
+	}
+
 	// Things look consistent, so merge the data.
-	if err := e.writeSaveData(&clientSave.SaveData); err != nil {
-		writeMergeError(w, 500, fmt.Errorf("writing save data: %w", err))
+	_, err = e.putSave(r.Context(), slot, key, serverSaveHash, &clientSave.SaveData, SourceMerge)
+	if err != nil {
+		e.writePutError(w, r, key, err)
 		return
 	}
 
@@ -184,6 +380,70 @@ func (e *autosyncExtension) handleMerge(w http.ResponseWriter, r *http.Request)
 	})
 }
 
+// writePutError writes the error returned by SaveStore.Put. If the save was
+// changed by another request in the meantime, the client gets a conflict with
+// the new save, just as if it had been there all along. Conditional requests
+// fail their precondition instead.
+func (e *autosyncExtension) writePutError(w http.ResponseWriter, r *http.Request, key string, err error) {
+	if !errors.Is(err, ErrSaveChanged) {
+		writeMergeError(w, 500, fmt.Errorf("writing save data: %w", err))
+		return
+	}
+
+	serverSave, err := e.store.Get(r.Context(), key)
+	if err != nil {
+		writeMergeError(w, 500, fmt.Errorf("reading server save data: %w", err))
+		return
+	}
+
+	code := 409
+	if hasPreconditions(r) {
+		code = 412
+	}
+
+	writeMergeResult(w, code, e.conflictData(r.Context(), key, serverSave, nil))
+}
+
+// conflictData describes the conflict between the server save and the client
+// save. The client save may be nil if it is not known.
+func (e *autosyncExtension) conflictData(ctx context.Context, key string, serverSave *SaveData, clientSave *saveDataRequest) MergeConflictData {
+	serverSaveHash := hashData(serverSave)
+	conflict := MergeConflictData{
+		Save:       serverSave,
+		ServerHash: serverSaveHash,
+		Summary:    e.summaries.get(serverSaveHash, serverSave),
+	}
+
+	if serverSave == nil {
+		return conflict
+	}
+
+	log := extension.LoggerFromContext(ctx)
+
+	writer, err := e.device(ctx, serverSave.Device)
+	if err != nil {
+		log.Warn(
+			"cannot look up the device that wrote the autosync data",
+			"err", err)
+	}
+	conflict.Writer = writer
+
+	if clientSave == nil {
+		return conflict
+	}
+
+	if ahead, err := e.savesSince(ctx, key, clientSave.LastHash); err == nil {
+		conflict.SavesAhead = &ahead
+	}
+
+	clientSummary := e.summaries.get(hashData(&clientSave.SaveData), &clientSave.SaveData)
+	if minutes, ok := conflict.Summary.minutesSince(clientSummary); ok {
+		conflict.MinutesAhead = &minutes
+	}
+
+	return conflict
+}
+
 // MergeResult is the result of a merge operation.
 type MergeResult string
 
@@ -197,6 +457,10 @@ const (
 	// the server save data is outdated. The client should update the server
 	// save data.
 	MergeConflict MergeResult = "conflict"
+	// MergeLocked is returned when another device holds the play session
+	// lease of the game. The client must not write saves until it holds the
+	// lease.
+	MergeLocked MergeResult = "locked"
 )
 
 // MergeOKData is the data returned when the merge operation succeeded.
@@ -207,6 +471,15 @@ type MergeOKData struct {
 	Consistent bool `json:"consistent"`
 	// Hash is the hash of the client save data.
 	Hash string `json:"hash"`
+	// Save is the merged save if the client save was merged with a newer
+	// server save. The client should load it.
+	Save *SaveData `json:"save,omitempty"`
+}
+
+// MergeLockedData is the data returned when another device holds the play
+// session lease of the game.
+type MergeLockedData struct {
+	Lease
 }
 
 type MergeErrorData struct {
@@ -216,6 +489,27 @@ type MergeErrorData struct {
 type MergeConflictData struct {
 	Save       *SaveData `json:"save"`
 	ServerHash string    `json:"server_hash,omitempty"`
+	// Summary describes the server save, so that the user can tell it apart
+	// from their local save.
+	Summary *SaveSummary `json:"summary,omitempty"`
+	// ConflictingKeys are the names of the variables that were changed
+	// differently in both saves. It is empty if the saves could not be
+	// compared at all.
+	ConflictingKeys []string `json:"conflicting_keys,omitempty"`
+	// Writer is the device that wrote the server save. It is omitted if the
+	// save was written without a device ID.
+	Writer *Device `json:"writer,omitempty"`
+	// SavesAhead is the number of saves that were written to the server since
+	// the client last synced. It is omitted if the save that the client last
+	// synced is not in the history.
+	SavesAhead *int `json:"saves_ahead,omitempty"`
+	// MinutesAhead is how much further the server save is than the client
+	// save in in-game minutes. It is negative if the server save is behind.
+	// It is omitted if either save has no in-game time.
+	MinutesAhead *int `json:"minutes_ahead,omitempty"`
+	// Peer is true if Save is the save of the peer server, which diverged
+	// from the save on this server.
+	Peer bool `json:"peer,omitempty"`
 }
 
 type mergeResultData interface{ mergeResult() MergeResult }
@@ -223,6 +517,7 @@ type mergeResultData interface{ mergeResult() MergeResult }
 func (MergeOKData) mergeResult() MergeResult       { return MergeOK }
 func (MergeErrorData) mergeResult() MergeResult    { return MergeError }
 func (MergeConflictData) mergeResult() MergeResult { return MergeConflict }
+func (MergeLockedData) mergeResult() MergeResult   { return MergeLocked }
 
 func writeJSON(w http.ResponseWriter, code int, obj any) {
 	w.Header().Set("Content-Type", "application/json")
@@ -230,7 +525,17 @@ func writeJSON(w http.ResponseWriter, code int, obj any) {
 	json.NewEncoder(w).Encode(obj)
 }
 
+// writeMergeResult writes the result of a merge. The response carries the
+// entity tag of the save that is now on the server, so that clients can make
+// their next merge conditional on it.
 func writeMergeResult(w http.ResponseWriter, code int, data mergeResultData) {
+	switch data := data.(type) {
+	case MergeOKData:
+		setSaveETag(w, data.Hash)
+	case MergeConflictData:
+		setSaveETag(w, data.ServerHash)
+	}
+
 	writeJSON(w, code, struct {
 		Result MergeResult     `json:"result"`
 		Data   mergeResultData `json:"data,omitempty"`
@@ -260,8 +565,9 @@ func readSaveDataFromRequest(r *http.Request) (*saveDataRequest, error) {
 
 	req := &saveDataRequest{
 		SaveData: SaveData{
-			Data: data.Data,
-			Date: time.Now().UnixMilli(),
+			Data:   data.Data,
+			Date:   time.Now().UnixMilli(),
+			Device: deviceIDFromRequest(r),
 		},
 	}
 	if data.LastHash != nil {
@@ -275,68 +581,78 @@ func readSaveDataFromRequest(r *http.Request) (*saveDataRequest, error) {
 type SaveData struct {
 	Data string `json:"data"`
 	Date int64  `json:"date"`
+	// Device is the ID of the device that wrote the save, if known.
+	Device string `json:"device,omitempty"`
 }
 
-func (e *autosyncExtension) acquireSaveData(ctx context.Context) (release func(), err error) {
-	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
-	defer cancel()
-
-	_, err = e.saveLock.TryLockContext(ctx, 250*time.Millisecond)
-	if err != nil {
-		return nil, fmt.Errorf("acquiring save data lock: %w", err)
+// Start implements extension.Extension. It checks all existing saves in the
+// background, so that corrupt saves are recovered before anyone asks for them.
+// Event streams are closed once ctx is done, so that they do not hold up the
+// server's shutdown. If a peer is configured, saves are pulled from it until
+// the extension is stopped.
+func (e *autosyncExtension) Start(ctx context.Context) error {
+	go e.store.check(ctx)
+	context.AfterFunc(ctx, e.events.close)
+
+	if e.peer != nil {
+		ctx, cancel := context.WithCancel(ctx)
+		e.stopReplication = cancel
+		e.replicationDone = make(chan struct{})
+		go func() {
+			defer close(e.replicationDone)
+			e.replicate(ctx)
+		}()
 	}
 
-	return func() {
-		if err := e.saveLock.Unlock(); err != nil {
-			panic(fmt.Errorf("releasing save data lock: %w", err))
-		}
-	}, nil
+	return nil
 }
 
-func (e *autosyncExtension) readSaveData() (*SaveData, error) {
-	f, err := os.Open(e.saveFile)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, nil
-		}
-		return nil, fmt.Errorf("opening save file: %w", err)
-	}
-	defer f.Close()
-
-	var data SaveData
-	if err := json.NewDecoder(f).Decode(&data); err != nil {
-		return nil, fmt.Errorf("decoding save file: %w", err)
+// Stop implements extension.Extension.
+func (e *autosyncExtension) Stop() error {
+	if e.stopReplication != nil {
+		e.stopReplication()
+		<-e.replicationDone
 	}
-
-	return &data, nil
+	e.events.close()
+	return e.store.Close()
 }
 
-func (e *autosyncExtension) writeSaveData(data *SaveData) error {
-	f, err := os.Create(e.saveFile)
-	if err != nil {
-		return fmt.Errorf("creating temp file: %w", err)
-	}
-	defer f.Close()
+// JSPath implements extension.ExtensionJSHookable.
+func (e *autosyncExtension) JSPaths() []string { return []string{"/autosync.js"} }
 
-	if err := json.NewEncoder(f).Encode(data); err != nil {
-		return fmt.Errorf("writing save data: %w", err)
+// DataDir implements extension.ExtensionDataDir. Saves that are stored in S3
+// are not on the local disk, so they are not included.
+func (e *autosyncExtension) DataDir() string {
+	switch e.cfg.Store.Type {
+	case "", "fs":
+		return e.cfg.SavePath
+	case "sqlite":
+		if e.cfg.Store.Path != "" {
+			return filepath.Dir(e.cfg.Store.Path)
+		}
+		return e.cfg.SavePath
+	default:
+		return ""
 	}
+}
 
-	if err := f.Close(); err != nil {
-		return fmt.Errorf("closing save file: %w", err)
+// DataFiles implements extension.ExtensionDataFiles. An SQLite database at a
+// custom path can be in any directory, so only the database and its journal
+// files are backed up.
+func (e *autosyncExtension) DataFiles() []string {
+	if e.cfg.Store.Type != "sqlite" || e.cfg.Store.Path == "" {
+		return nil
 	}
 
-	return nil
+	name := filepath.Base(e.cfg.Store.Path)
+	return []string{name, name + "-wal", name + "-shm", name + "-journal"}
 }
 
-// Start implements extension.Extension.
-func (e *autosyncExtension) Start(context.Context) error { return nil }
-
-// Stop implements extension.Extension.
-func (e *autosyncExtension) Stop() error { return nil }
-
-// JSPath implements extension.ExtensionJSHookable.
-func (e *autosyncExtension) JSPaths() []string { return []string{"/autosync.js"} }
+// LockData implements extension.ExtensionDataDir. It takes the same locks as
+// merges do, so that a backup never sees or replaces half of a merge.
+func (e *autosyncExtension) LockData(ctx context.Context) (func(), error) {
+	return e.store.lockStore(ctx)
+}
 
 func hashData(data *SaveData) string {
 	if data == nil {
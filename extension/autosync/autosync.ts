@@ -5,13 +5,14 @@ import { html } from "https://deno.land/x/html@v1.2.0/mod.ts";
 
 const SugarCube = await waitForSugarCube();
 
-type MergeResult = MergeOK | MergeError | MergeConflict;
+type MergeResult = MergeOK | MergeError | MergeConflict | MergeLocked;
 
 type MergeOK = {
   result: "ok";
   data: {
     consistent: boolean;
     hash: string;
+    save?: SaveData;
   };
 };
 
@@ -24,21 +25,110 @@ type MergeError = {
 
 type MergeConflict = {
   result: "conflict";
-  data: {
-    save: SaveData | null;
-    server_hash?: string;
-  };
+  data: ConflictData;
+};
+
+type MergeLocked = {
+  result: "locked";
+  data: Lease;
+};
+
+type Lease = {
+  holder: Device;
+  expires: number;
+  ttl: number;
+};
+
+type ConflictData = {
+  save: SaveData | null;
+  server_hash?: string;
+  summary?: SaveSummary;
+  conflicting_keys?: string[];
+  writer?: Device;
+  saves_ahead?: number;
+  minutes_ahead?: number;
+  peer?: boolean;
 };
 
 type SaveData = {
   data: string | null;
   date: number;
+  device?: string;
+};
+
+type Device = {
+  id: string;
+  name?: string;
+};
+
+type SaveEvent = {
+  slot: string;
+  hash: string;
+  date: number;
+  source: string;
+  writer?: Device;
+};
+
+type SlotInfo = {
+  slot: string;
+  hash: string;
+  date: number;
+};
+
+type SaveSummary = {
+  passage?: string;
+  day?: number;
+  time?: string;
+  money?: number;
+  name?: string;
+  size: number;
+};
+
+// deviceID identifies this browser to the server, so that the server can tell
+// which device wrote which save. It is made up once and kept in localStorage.
+const deviceID = getDeviceID();
+
+function getDeviceID(): string {
+  const key = "autosync-device-id";
+  let id = localStorage.getItem(key);
+  if (!id) {
+    // crypto.randomUUID is only available over HTTPS, which most servers on
+    // the local network do not have.
+    const bytes = crypto.getRandomValues(new Uint8Array(16));
+    id = Array.from(bytes, (b) => b.toString(16).padStart(2, "0")).join("");
+    localStorage.setItem(key, id);
+  }
+  return id;
+}
+
+// autosyncFetch is fetch, but it tells the server which device is asking.
+function autosyncFetch(
+  url: string,
+  init: RequestInit = {},
+): Promise<Response> {
+  const headers = new Headers(init.headers);
+  headers.set("Autosync-Device-ID", deviceID);
+  return fetch(url, { ...init, headers });
+}
+
+// LZString is bundled with SugarCube, which uses it to serialize saves.
+declare const LZString: {
+  compressToBase64(input: string): string;
+  decompressFromBase64(input: string): string | null;
 };
 
 // lastDataHash is initialized by checkSync and is used to determine if the
 // current save is outdated. It is maintained by sync.
 let lastHash: string | null = null;
 
+// passages counts the passages that were shown, and syncedPassages is what
+// it was at the last sync. If they differ, the player has moved on since the
+// last sync, and newer saves from other devices must not be loaded over the
+// player's progress.
+let passages = 0;
+let syncedPassages = 0;
+document.addEventListener(":passageend", () => passages++);
+
 function overrideLocal(data: string, hash: string) {
   lastHash = hash;
   const metadata = SugarCube.Save.deserialize(data);
@@ -48,21 +138,27 @@ function overrideLocal(data: string, hash: string) {
       SugarCube.State.metadata.set(key, value);
     }
   }
+  // Loading the save shows its passage, which is not progress of its own.
+  syncedPassages = passages;
 }
 
-async function sync() {
+// sync syncs the save with the server. It returns false if the save was not
+// synced because another device is playing.
+async function sync(): Promise<boolean> {
   console.debug("autosync: syncing");
 
+  const syncingPassages = passages;
+
   const data = SugarCube.Save.serialize({
     // As far as I can tell, none of DoL uses SugarCube.State.metadata, so
     // we'll just go ahead and use it however we want.
     stateMetadata: Array.from(SugarCube.State.metadata.entries()),
   });
   if (data == null) {
-    return;
+    return true;
   }
 
-  const resp = await fetch("/x/autosync/merge", {
+  const resp = await autosyncFetch("x/autosync/merge", {
     method: "POST",
     body: JSON.stringify({
       data,
@@ -73,30 +169,45 @@ async function sync() {
   const body = await resp.json() as MergeResult;
   switch (body.result) {
     case "ok": {
-      lastHash = body.data.hash;
+      if (body.data.save) {
+        // The server merged our save with a newer one, so load the merged
+        // save to pick up the changes from the other side.
+        overrideLocal(body.data.save.data, body.data.hash);
+      } else {
+        lastHash = body.data.hash;
+      }
       break;
     }
     case "error": {
       throw new Error(body.data.error);
     }
     case "conflict": {
-      await handleOverride(data, body.data.save, body.data.server_hash);
+      await handleOverride(data, body.data);
       break;
     }
+    case "locked": {
+      if (await handleLocked(body.data)) {
+        return await sync();
+      }
+      return false;
+    }
   }
+
+  syncedPassages = Math.max(syncedPassages, syncingPassages);
+  return true;
 }
 
 // checkSync checks if the current save is outdated and prompts the user to
-// override their save with a newer save from the server if it is.
-async function checkSync() {
+// override their save with a newer save from the server if it is. It returns
+// false if the save was not synced because another device is playing.
+async function checkSync(): Promise<boolean> {
   const autosave = SugarCube.Save.autosave.get();
   if (autosave && SugarCube.Config.saves.isAllowed()) {
     // Local also has a save. Try to do an actual sync.
-    await sync();
-    return;
+    return await sync();
   }
 
-  const resp = await fetch("/x/autosync/save");
+  const resp = await autosyncFetch("x/autosync/save");
   const body = await resp.json() as {
     save: SaveData | null;
     server_hash?: string;
@@ -104,13 +215,474 @@ async function checkSync() {
   if (body.save == null) {
     // Opportunistically sync if the server has no save.
     if (SugarCube.Config.saves.isAllowed()) {
-      await sync();
+      return await sync();
     }
-    return;
+    return true;
   }
 
   // Server has a save, but local does not. Override local with server.
   overrideLocal(body.save.data, body.server_hash!);
+  return true;
+}
+
+// SyncedSlot is a numbered save slot as it was when it was last synced.
+type SyncedSlot = {
+  hash: string;
+  date: number;
+};
+
+// syncedSlots keeps the numbered save slots as they were last synced, keyed by
+// the slot name on the server. It is kept in localStorage, so that slots that
+// did not change locally since can be told apart from slots that did.
+const syncedSlotsKey = `autosync-synced-slots:${location.pathname}`;
+const syncedSlots: Record<string, SyncedSlot> = JSON.parse(
+  localStorage.getItem(syncedSlotsKey) ?? "{}",
+);
+
+function markSlotSynced(slot: string, hash: string, date: number) {
+  syncedSlots[slot] = { hash, date };
+  localStorage.setItem(syncedSlotsKey, JSON.stringify(syncedSlots));
+}
+
+// slotName returns the name of the server slot of the given local slot. Slots
+// are numbered from 1, like they are in the save dialog.
+function slotName(index: number): string {
+  return `slot${index + 1}`;
+}
+
+// slotIndex returns the local slot of the given server slot, or null if it is
+// not a numbered slot that exists locally.
+function slotIndex(slot: string): number | null {
+  const match = /^slot([1-9][0-9]*)$/.exec(slot);
+  if (!match) {
+    return null;
+  }
+  const index = Number(match[1]) - 1;
+  return index < SugarCube.Save.slots.length ? index : null;
+}
+
+// storeSlot writes the given save into a local slot. SugarCube cannot put a
+// save into a slot without loading it first, so its storage is written to
+// directly.
+function storeSlot(index: number, data: string, hash: string) {
+  const save = JSON.parse(LZString.decompressFromBase64(data));
+  const saves = SugarCube.storage.get("saves");
+  saves.slots[index] = save;
+  SugarCube.storage.set("saves", saves);
+  markSlotSynced(slotName(index), hash, save.date);
+}
+
+// syncSlot uploads the given local slot if it changed since it was last
+// synced. If the server merged it with a newer save, the merged save is
+// written back into the slot.
+async function syncSlot(index: number) {
+  const save = SugarCube.Save.slots.get(index);
+  const slot = slotName(index);
+  const synced = syncedSlots[slot];
+  if (save == null || (synced && synced.date == save.date)) {
+    return;
+  }
+
+  // Slot saves have the same shape as the saves of SugarCube.Save.serialize,
+  // so they are encoded the same way.
+  const data = LZString.compressToBase64(JSON.stringify(save));
+
+  const resp = await autosyncFetch(`x/autosync/merge/${slot}`, {
+    method: "POST",
+    body: JSON.stringify({
+      data,
+      last_hash: synced?.hash ?? null,
+    }),
+  });
+
+  const body = await resp.json() as MergeResult;
+  switch (body.result) {
+    case "ok": {
+      if (body.data.save) {
+        storeSlot(index, body.data.save.data, body.data.hash);
+      } else {
+        markSlotSynced(slot, body.data.hash, save.date);
+      }
+      break;
+    }
+    case "error": {
+      throw new Error(body.data.error);
+    }
+    case "conflict": {
+      // Unlike the autosave, slots are saved on purpose, so the newer of the
+      // two saves is kept instead of asking the user.
+      const serverSave = body.data.save;
+      if (serverSave && serverSave.date > save.date) {
+        storeSlot(index, serverSave.data, body.data.server_hash!);
+        break;
+      }
+
+      const resp = await autosyncFetch(`x/autosync/merge/${slot}?override=1`, {
+        method: "POST",
+        body: JSON.stringify({ data }),
+      });
+      const overrideBody = await resp.json() as MergeResult;
+      if (overrideBody.result != "ok") {
+        throw new Error(`failed to override save in ${slot}`);
+      }
+      markSlotSynced(slot, overrideBody.data.hash, save.date);
+      break;
+    }
+    case "locked": {
+      // The autosave sync already asks about the lease, so the slot is
+      // synced once this tab holds it again.
+      break;
+    }
+  }
+}
+
+// pullSlot downloads the server save of a slot, unless the local slot changed
+// since it was last synced. In that case, syncSlot merges both saves.
+async function pullSlot(index: number, hash: string) {
+  const slot = slotName(index);
+  const synced = syncedSlots[slot];
+  if (synced?.hash == hash) {
+    return;
+  }
+
+  const save = SugarCube.Save.slots.get(index);
+  if (save != null && synced?.date != save.date) {
+    return;
+  }
+
+  const resp = await autosyncFetch(`x/autosync/save/${slot}`);
+  const body = await resp.json() as {
+    save: SaveData | null;
+    server_hash?: string;
+  };
+  if (body.save == null) {
+    return;
+  }
+
+  storeSlot(index, body.save.data, body.server_hash!);
+}
+
+// syncSlots syncs all numbered save slots with the server. Slots that only
+// changed on the server are downloaded, then slots that changed locally are
+// uploaded. Deleting a slot is not synced.
+async function syncSlots() {
+  const resp = await autosyncFetch("x/autosync/slots");
+  const body = await resp.json() as { slots: SlotInfo[] };
+  for (const info of body.slots) {
+    const index = slotIndex(info.slot);
+    if (index != null) {
+      await pullSlot(index, info.hash);
+    }
+  }
+
+  for (let i = 0; i < SugarCube.Save.slots.length; i++) {
+    await syncSlot(i);
+  }
+}
+
+// holdingLease is true while this tab holds the play session lease of its
+// game. Other devices cannot sync while it is held.
+let holdingLease = false;
+
+// lockedBy is the lease of the device that holds the lease instead of this
+// tab, if any.
+let lockedBy: Lease | null = null;
+
+// declinedTakeover is true once the user chose not to take the game over from
+// the device that holds the lease, so that they are not asked again.
+let declinedTakeover = false;
+
+// holdLease takes or renews the play session lease. With takeover, the lease
+// is taken from the device that holds it. It returns false if another device
+// holds the lease, and true if the server does not hand out leases at all.
+async function holdLease(takeover = false): Promise<boolean> {
+  const resp = await autosyncFetch(
+    takeover ? "x/autosync/lease/takeover" : "x/autosync/lease",
+    { method: "POST" },
+  );
+  if (resp.status == 404) {
+    // Leases are disabled on the server.
+    return true;
+  }
+
+  if (resp.status == 423) {
+    const body = await resp.json() as MergeLocked;
+    lockedBy = body.data;
+    if (holdingLease) {
+      holdingLease = false;
+      declinedTakeover = true;
+      autosaveToast.notifyLocked(
+        `The game was taken over by ${describeHolder(body.data)}. ` +
+          "Reload to take it back.",
+      );
+    }
+    scheduleHeartbeat(body.data.ttl);
+    return false;
+  }
+
+  if (!resp.ok) {
+    const body = await resp.json() as MergeError;
+    throw new Error(body.data.error);
+  }
+
+  const body = await resp.json() as { lease: Lease };
+  if (!holdingLease && declinedTakeover) {
+    autosaveToast.notifySaved("The other device is done, syncing again!");
+  }
+  holdingLease = true;
+  lockedBy = null;
+  declinedTakeover = false;
+  scheduleHeartbeat(body.lease.ttl);
+  return true;
+}
+
+let heartbeat: number | null = null;
+
+// scheduleHeartbeat renews the lease three times per TTL, so that it does not
+// expire while the tab is open. While another device holds the lease, this
+// tab takes it as soon as the other device lets go of it.
+function scheduleHeartbeat(ttl: number) {
+  if (heartbeat != null) {
+    clearTimeout(heartbeat);
+  }
+  heartbeat = setTimeout(async () => {
+    heartbeat = null;
+    try {
+      await holdLease();
+    } catch (err) {
+      console.warn("autosync: cannot renew lease:", err);
+      scheduleHeartbeat(ttl);
+    }
+  }, ttl / 3);
+}
+
+// handleLocked is called when another device holds the lease. The user is
+// asked once whether to take the game over. If they do not, saves are not
+// synced until the other device lets go of the lease. It returns true if this
+// tab now holds the lease.
+async function handleLocked(lease: Lease): Promise<boolean> {
+  holdingLease = false;
+  if (!declinedTakeover) {
+    if (await promptTakeover(lease)) {
+      return await holdLease(true);
+    }
+    declinedTakeover = true;
+  }
+
+  autosaveToast.notifyLocked(
+    `Not syncing, the game is being played on ${describeHolder(lease)}.`,
+  );
+  return false;
+}
+
+// releaseLease lets go of the lease when the tab is closed, so that other
+// devices can sync right away instead of waiting for it to expire.
+function releaseLease() {
+  if (!holdingLease) {
+    return;
+  }
+  holdingLease = false;
+  autosyncFetch("x/autosync/lease", { method: "DELETE", keepalive: true });
+}
+
+function describeHolder(lease: Lease): string {
+  return lease.holder.name || "another device";
+}
+
+type ProfileInfo = {
+  resolver: string;
+  profile: string | null;
+  profiles?: string[];
+};
+
+// ensureProfile makes sure that the server knows which profile to sync saves
+// to. If the server lets users pick their profile and the user has not picked
+// one yet, they are prompted to pick one.
+async function ensureProfile() {
+  const resp = await fetch("x/autosync/profile");
+  const info = await resp.json() as ProfileInfo;
+  if (info.profile != null || info.resolver != "cookie") {
+    return;
+  }
+
+  const profile = await promptProfile(info.profiles ?? []);
+  const pickResp = await fetch("x/autosync/profile", {
+    method: "POST",
+    body: JSON.stringify({ profile }),
+  });
+  if (!pickResp.ok) {
+    const body = await pickResp.json() as MergeError;
+    throw new Error(body.data.error);
+  }
+}
+
+// listenForSaves listens for saves written by other devices. If the player has
+// not moved on since the last sync, the newer save is loaded right away, so
+// that the player continues from it instead of running into a conflict later.
+function listenForSaves() {
+  const events = new EventSource("x/autosync/events");
+  events.addEventListener("save", async (ev) => {
+    const event = JSON.parse((ev as MessageEvent).data) as SaveEvent;
+    if (event.writer?.id == deviceID) {
+      return;
+    }
+
+    try {
+      if (event.slot == "autosave") {
+        if (event.hash != lastHash) {
+          await pullSave(event);
+        }
+      } else {
+        const index = slotIndex(event.slot);
+        if (index != null) {
+          await pullSlot(index, event.hash);
+        }
+      }
+    } catch (err) {
+      autosaveToast.notifyError(err);
+    }
+  });
+}
+
+// pullSave loads the newer save from the server, unless the player has moved
+// on since the last sync. In that case, the next sync merges both saves.
+async function pullSave(event: SaveEvent) {
+  if (saving || passages != syncedPassages) {
+    return;
+  }
+
+  const resp = await autosyncFetch("x/autosync/save");
+  const body = await resp.json() as {
+    save: SaveData | null;
+    server_hash?: string;
+  };
+  if (body.save == null || body.server_hash == lastHash) {
+    return;
+  }
+  if (saving || passages != syncedPassages) {
+    return;
+  }
+
+  console.debug("autosync: loading newer save from", event.writer);
+  overrideLocal(body.save.data, body.server_hash!);
+
+  const writer = event.writer?.name ?? "another device";
+  autosaveToast.notifySaved(`Save has been updated from ${writer}!`);
+}
+
+// registerDevice registers this browser with the server. The server keeps the
+// name of devices that are already registered, so that renaming them sticks.
+async function registerDevice() {
+  const resp = await autosyncFetch("x/autosync/devices", {
+    method: "POST",
+    body: JSON.stringify({ id: deviceID, name: defaultDeviceName() }),
+  });
+  if (!resp.ok) {
+    const body = await resp.json() as MergeError;
+    throw new Error(body.data.error);
+  }
+}
+
+// defaultDeviceName guesses a friendly name for this browser, such as
+// "Firefox on Android".
+function defaultDeviceName(): string {
+  const ua = navigator.userAgent;
+  const find = (names: [string, string][]) =>
+    names.find(([token]) => ua.includes(token))?.[1];
+
+  const browser = find([
+    ["Edg/", "Edge"],
+    ["Firefox/", "Firefox"],
+    ["Chrome/", "Chrome"],
+    ["Safari/", "Safari"],
+  ]) ?? "Browser";
+
+  // Android comes before Linux, since Android user agents mention both.
+  const os = find([
+    ["Android", "Android"],
+    ["iPhone", "iPhone"],
+    ["iPad", "iPad"],
+    ["Windows", "Windows"],
+    ["Mac OS", "macOS"],
+    ["Linux", "Linux"],
+  ]);
+
+  return os ? `${browser} on ${os}` : browser;
+}
+
+// promptProfile prompts the user to pick an existing profile or to make up a
+// new one. It blocks until the user has entered a profile.
+function promptProfile(profiles: string[]): Promise<string> {
+  const list = document.createElement("datalist");
+  list.id = "autosync-profiles";
+  for (const profile of profiles) {
+    const option = document.createElement("option");
+    option.value = profile;
+    list.append(option);
+  }
+
+  const input = document.createElement("input");
+  input.type = "text";
+  input.name = "profile";
+  input.setAttribute("list", list.id);
+
+  const form = document.createElement("form");
+  form.append(input, list);
+
+  return new Promise<string>((resolve) => {
+    SugarCube.Dialog.setup("Autosave", "autosync-prompt-profile");
+    SugarCube.Dialog.append(removeIndentation(`
+      Pick the profile to sync your saves to.
+      Use the same profile on all of your devices.
+    `));
+    SugarCube.Dialog.append(document.createElement("br"));
+    SugarCube.Dialog.append(form);
+    SugarCube.Dialog.open(null, () => {
+      const profile = input.value.trim();
+      if (profile) {
+        resolve(profile);
+      } else {
+        // The dialog was dismissed without a profile. Ask again once it is
+        // fully closed.
+        setTimeout(() => promptProfile(profiles).then(resolve));
+      }
+    });
+  });
+}
+
+// promptTakeover asks the user whether to take the game over from the device
+// that holds the lease. It blocks until the user closes the prompt.
+function promptTakeover(lease: Lease): Promise<boolean> {
+  const form = document.createElement("form");
+  form.innerHTML = html`
+    <label>
+      <input type="radio" name="takeover" value="yes" checked>
+      Play here and stop syncing on the other device
+    </label>
+    <br />
+    <label>
+      <input type="radio" name="takeover" value="no">
+      Do not sync on this device
+    </label>
+  `;
+
+  return new Promise<boolean>((resolve) => {
+    SugarCube.Dialog.setup("Autosave", "autosync-prompt-takeover");
+    // The device name is made up by the user, so it is set as text rather
+    // than as HTML.
+    const info = document.createElement("div");
+    info.textContent = removeIndentation(`
+      This game is being played on ${describeHolder(lease)}.
+      Would you like to take it over?
+    `);
+    SugarCube.Dialog.append(info);
+    SugarCube.Dialog.append(document.createElement("br"));
+    SugarCube.Dialog.append(form);
+    SugarCube.Dialog.open(null, () => {
+      const formData = new FormData(form);
+      resolve(formData.get("takeover") == "yes");
+    });
+  });
 }
 
 // promptAlert prompts the user with an alert dialog. It blocks until the user
@@ -123,19 +695,16 @@ function promptAlert(msg: string): Promise<void> {
 
 // handleOverride takes care of calling promptOverride and handling the user's
 // choice.
-async function handleOverride(
-  clientData: string,
-  serverSave: SaveData,
-  serverHash: string,
-) {
-  const override = await promptOverride(serverSave.date);
+async function handleOverride(clientData: string, conflict: ConflictData) {
+  const serverSave = conflict.save!;
+  const override = await promptOverride(conflict);
   switch (override) {
     case OverrideChoice.Local: {
-      overrideLocal(serverSave.data, serverHash);
+      overrideLocal(serverSave.data, conflict.server_hash!);
       break;
     }
     case OverrideChoice.Server: {
-      const resp = await fetch("/x/autosync/merge?override=1", {
+      const resp = await autosyncFetch("x/autosync/merge?override=1", {
         method: "POST",
         body: JSON.stringify({
           data: clientData,
@@ -161,12 +730,11 @@ enum OverrideChoice {
 // promptOverride prompts the user to override their save with a newer save
 // from the server. It blocks until the user closes the prompt and returns
 // whether the user chose to override their save.
-function promptOverride(
-  serverDate: number | null = null,
-): Promise<OverrideChoice> {
+function promptOverride(conflict: ConflictData): Promise<OverrideChoice> {
   const div = document.createElement("div");
   div.classList.add("autosync-prompt-override");
 
+  const serverDate = conflict.save?.date;
   if (serverDate != null) {
     const serverDateString = new Date(serverDate).toLocaleString();
     const info = document.createElement("div");
@@ -177,6 +745,50 @@ function promptOverride(
     div.append(info);
   }
 
+  if (conflict.peer) {
+    // Devices of the other server are not known to this one.
+    const info = document.createElement("div");
+    info.classList.add("autosync-prompt-override-writer");
+    info.textContent = "Saved on the other server";
+    div.append(info);
+  } else if (conflict.writer) {
+    const writer = conflict.writer.id == deviceID
+      ? "this device"
+      : conflict.writer.name || "a forgotten device";
+    const info = document.createElement("div");
+    info.classList.add("autosync-prompt-override-writer");
+    info.textContent = `Saved by ${writer}`;
+    div.append(info);
+  }
+
+  const ahead = describeAhead(conflict);
+  if (ahead) {
+    const info = document.createElement("div");
+    info.classList.add("autosync-prompt-override-ahead");
+    info.textContent = ahead;
+    div.append(info);
+  }
+
+  const summary = conflict.summary && describeSummary(conflict.summary);
+  if (summary) {
+    // The summary contains passage names, so it is set as text rather than
+    // as HTML.
+    const info = document.createElement("div");
+    info.classList.add("autosync-prompt-override-summary");
+    info.textContent = `Server save: ${summary}`;
+    div.append(info);
+  }
+
+  const conflictingKeys = conflict.conflicting_keys ?? [];
+  if (conflictingKeys.length > 0) {
+    const info = document.createElement("div");
+    info.classList.add("autosync-prompt-override-conflicts");
+    info.textContent = `Changed in both saves: ${
+      describeKeys(conflictingKeys)
+    }`;
+    div.append(info);
+  }
+
   const form = document.createElement("form");
   form.innerHTML = html`
     <label>
@@ -198,7 +810,7 @@ function promptOverride(
       Would you like to override it with the server save?
     `));
     SugarCube.Dialog.append(document.createElement("br"));
-    SugarCube.Dialog.append(form);
+    SugarCube.Dialog.append(div);
     SugarCube.Dialog.open(null, () => {
       const formData = new FormData(form);
       const override = formData.get("override") as string;
@@ -214,6 +826,74 @@ function promptOverride(
   });
 }
 
+// describeSummary describes a save summary in a single line, such as
+// "Day 3, 14:20 · Orphanage · £12.50". It returns an empty string if the
+// summary has nothing to describe.
+function describeSummary(summary: SaveSummary): string {
+  const parts: string[] = [];
+  if (summary.name) {
+    parts.push(summary.name);
+  }
+  if (summary.day != null && summary.time) {
+    parts.push(`Day ${summary.day}, ${summary.time}`);
+  }
+  if (summary.passage) {
+    parts.push(summary.passage);
+  }
+  if (summary.money != null) {
+    parts.push(`\u00a3${(summary.money / 100).toFixed(2)}`);
+  }
+  return parts.join(" \u00b7 ");
+}
+
+// describeAhead describes how far the server save is ahead of or behind the
+// local save, such as "3 saves and 2 hours of in-game time ahead of yours".
+function describeAhead(conflict: ConflictData): string {
+  const parts: string[] = [];
+  if (conflict.saves_ahead != null && conflict.saves_ahead > 0) {
+    const s = conflict.saves_ahead == 1 ? "" : "s";
+    parts.push(`${conflict.saves_ahead} save${s}`);
+  }
+  if (conflict.minutes_ahead != null && conflict.minutes_ahead != 0) {
+    const duration = describeMinutes(Math.abs(conflict.minutes_ahead));
+    parts.push(`${duration} of in-game time`);
+  }
+  if (parts.length == 0) {
+    return "";
+  }
+
+  const behind = conflict.minutes_ahead != null && conflict.minutes_ahead < 0;
+  return `${parts.join(" and ")} ${behind ? "behind" : "ahead of"} yours`;
+}
+
+// describeMinutes describes a duration in minutes, such as "2 days 3 hours".
+function describeMinutes(minutes: number): string {
+  const units: [number, string][] = [
+    [24 * 60, "day"],
+    [60, "hour"],
+    [1, "minute"],
+  ];
+
+  const parts: string[] = [];
+  for (const [size, unit] of units) {
+    const n = Math.floor(minutes / size);
+    minutes -= n * size;
+    if (n > 0 && parts.length < 2) {
+      parts.push(`${n} ${unit}${n == 1 ? "" : "s"}`);
+    }
+  }
+  return parts.join(" ");
+}
+
+// describeKeys lists the first few of the given variable names.
+function describeKeys(keys: string[], max = 8): string {
+  const listed = keys.slice(0, max).map((key) => `$${key}`).join(", ");
+  if (keys.length > max) {
+    return `${listed} and ${keys.length - max} more`;
+  }
+  return listed;
+}
+
 function removeIndentation(str: string) {
   str = str.replace(/^\s+/g, "");
   str = str.replace(/\s+$/g, "");
@@ -234,8 +914,14 @@ async function saveHook() {
   saving = true;
 
   try {
-    await sync();
-    autosaveToast.notifySaved();
+    if (await sync()) {
+      // Saving to a slot also calls the save hook, so slots are synced
+      // along with the autosave.
+      for (let i = 0; i < SugarCube.Save.slots.length; i++) {
+        await syncSlot(i);
+      }
+      autosaveToast.notifySaved();
+    }
   } catch (err) {
     autosaveToast.notifyError(err);
   } finally {
@@ -247,12 +933,29 @@ async function saveHook() {
 // Wait until the overriden save is loaded before registering the autosave
 // hook and checking for outdated saves.
 try {
-  await checkSync();
-  autosaveToast.notifySaved("Save has been restored!");
+  await ensureProfile();
+  await registerDevice();
+  const holding = await holdLease();
+  if (holding || await handleLocked(lockedBy!)) {
+    if (await checkSync()) {
+      await syncSlots();
+      autosaveToast.notifySaved("Save has been restored!");
+    }
+  }
+  listenForSaves();
 } catch (err) {
   autosaveToast.notifyError(err);
 }
 
+// Let go of the lease when the tab is closed, and take it again if the tab is
+// restored from the back-forward cache.
+window.addEventListener("pagehide", releaseLease);
+window.addEventListener("pageshow", (ev) => {
+  if (ev.persisted) {
+    holdLease().catch((err) => autosaveToast.notifyError(err));
+  }
+});
+
 // Register the save hook, but don't return the Promise so that the save hook
 // can finish before the Promise resolves.
 SugarCube.Save.onSave.add(() => {
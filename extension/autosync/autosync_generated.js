@@ -122,12 +122,37 @@ function show(html) {
 function notifySaved(message = "Save has been synchronized!") {
     showFor(5000, html`<span class="green">${message}</span>`);
 }
+function notifyLocked(message) {
+    show(html`<span class="red">${message}</span>`);
+}
 function notifyError(error) {
     show(html`<mouse class="tooltip red">Error occured while synchronizing!<span>${error}</span></mouse>`);
 }
 clear();
 const SugarCube = await waitForSugarCube();
+const deviceID = getDeviceID();
+function getDeviceID() {
+    const key = "autosync-device-id";
+    let id = localStorage.getItem(key);
+    if (!id) {
+        const bytes = crypto.getRandomValues(new Uint8Array(16));
+        id = Array.from(bytes, (b)=>b.toString(16).padStart(2, "0")).join("");
+        localStorage.setItem(key, id);
+    }
+    return id;
+}
+function autosyncFetch(url, init = {}) {
+    const headers = new Headers(init.headers);
+    headers.set("Autosync-Device-ID", deviceID);
+    return fetch(url, {
+        ...init,
+        headers
+    });
+}
 let lastHash = null;
+let passages = 0;
+let syncedPassages = 0;
+document.addEventListener(":passageend", ()=>passages++);
 function overrideLocal(data, hash) {
     lastHash = hash;
     const metadata = SugarCube.Save.deserialize(data);
@@ -137,16 +162,18 @@ function overrideLocal(data, hash) {
             SugarCube.State.metadata.set(key, value);
         }
     }
+    syncedPassages = passages;
 }
 async function sync() {
     console.debug("autosync: syncing");
+    const syncingPassages = passages;
     const data = SugarCube.Save.serialize({
         stateMetadata: Array.from(SugarCube.State.metadata.entries())
     });
     if (data == null) {
-        return;
+        return true;
     }
-    const resp = await fetch("/x/autosync/merge", {
+    const resp = await autosyncFetch("x/autosync/merge", {
         method: "POST",
         body: JSON.stringify({
             data,
@@ -157,7 +184,11 @@ async function sync() {
     switch(body.result){
         case "ok":
             {
-                lastHash = body.data.hash;
+                if (body.data.save) {
+                    overrideLocal(body.data.save.data, body.data.hash);
+                } else {
+                    lastHash = body.data.hash;
+                }
                 break;
             }
         case "error":
@@ -166,38 +197,416 @@ async function sync() {
             }
         case "conflict":
             {
-                await handleOverride(data, body.data.save, body.data.server_hash);
+                await handleOverride(data, body.data);
                 break;
             }
+        case "locked":
+            {
+                if (await handleLocked(body.data)) {
+                    return await sync();
+                }
+                return false;
+            }
     }
+    syncedPassages = Math.max(syncedPassages, syncingPassages);
+    return true;
 }
 async function checkSync() {
     const autosave = SugarCube.Save.autosave.get();
     if (autosave && SugarCube.Config.saves.isAllowed()) {
-        await sync();
-        return;
+        return await sync();
     }
-    const resp = await fetch("/x/autosync/save");
+    const resp = await autosyncFetch("x/autosync/save");
     const body = await resp.json();
     if (body.save == null) {
         if (SugarCube.Config.saves.isAllowed()) {
-            await sync();
+            return await sync();
         }
+        return true;
+    }
+    overrideLocal(body.save.data, body.server_hash);
+    return true;
+}
+const syncedSlotsKey = `autosync-synced-slots:${location.pathname}`;
+const syncedSlots = JSON.parse(localStorage.getItem(syncedSlotsKey) ?? "{}");
+function markSlotSynced(slot, hash, date) {
+    syncedSlots[slot] = {
+        hash,
+        date
+    };
+    localStorage.setItem(syncedSlotsKey, JSON.stringify(syncedSlots));
+}
+function slotName(index) {
+    return `slot${index + 1}`;
+}
+function slotIndex(slot) {
+    const match = /^slot([1-9][0-9]*)$/.exec(slot);
+    if (!match) {
+        return null;
+    }
+    const index = Number(match[1]) - 1;
+    return index < SugarCube.Save.slots.length ? index : null;
+}
+function storeSlot(index, data, hash) {
+    const save = JSON.parse(LZString.decompressFromBase64(data));
+    const saves = SugarCube.storage.get("saves");
+    saves.slots[index] = save;
+    SugarCube.storage.set("saves", saves);
+    markSlotSynced(slotName(index), hash, save.date);
+}
+async function syncSlot(index) {
+    const save = SugarCube.Save.slots.get(index);
+    const slot = slotName(index);
+    const synced = syncedSlots[slot];
+    if (save == null || synced && synced.date == save.date) {
         return;
     }
+    const data = LZString.compressToBase64(JSON.stringify(save));
+    const resp = await autosyncFetch(`x/autosync/merge/${slot}`, {
+        method: "POST",
+        body: JSON.stringify({
+            data,
+            last_hash: synced?.hash ?? null
+        })
+    });
+    const body = await resp.json();
+    switch(body.result){
+        case "ok":
+            {
+                if (body.data.save) {
+                    storeSlot(index, body.data.save.data, body.data.hash);
+                } else {
+                    markSlotSynced(slot, body.data.hash, save.date);
+                }
+                break;
+            }
+        case "error":
+            {
+                throw new Error(body.data.error);
+            }
+        case "conflict":
+            {
+                const serverSave = body.data.save;
+                if (serverSave && serverSave.date > save.date) {
+                    storeSlot(index, serverSave.data, body.data.server_hash);
+                    break;
+                }
+                const resp = await autosyncFetch(`x/autosync/merge/${slot}?override=1`, {
+                    method: "POST",
+                    body: JSON.stringify({
+                        data
+                    })
+                });
+                const overrideBody = await resp.json();
+                if (overrideBody.result != "ok") {
+                    throw new Error(`failed to override save in ${slot}`);
+                }
+                markSlotSynced(slot, overrideBody.data.hash, save.date);
+                break;
+            }
+        case "locked":
+            {
+                break;
+            }
+    }
+}
+async function pullSlot(index, hash) {
+    const slot = slotName(index);
+    const synced = syncedSlots[slot];
+    if (synced?.hash == hash) {
+        return;
+    }
+    const save = SugarCube.Save.slots.get(index);
+    if (save != null && synced?.date != save.date) {
+        return;
+    }
+    const resp = await autosyncFetch(`x/autosync/save/${slot}`);
+    const body = await resp.json();
+    if (body.save == null) {
+        return;
+    }
+    storeSlot(index, body.save.data, body.server_hash);
+}
+async function syncSlots() {
+    const resp = await autosyncFetch("x/autosync/slots");
+    const body = await resp.json();
+    for (const info of body.slots){
+        const index = slotIndex(info.slot);
+        if (index != null) {
+            await pullSlot(index, info.hash);
+        }
+    }
+    for(let i = 0; i < SugarCube.Save.slots.length; i++){
+        await syncSlot(i);
+    }
+}
+let holdingLease = false;
+let lockedBy = null;
+let declinedTakeover = false;
+async function holdLease(takeover = false) {
+    const resp = await autosyncFetch(takeover ? "x/autosync/lease/takeover" : "x/autosync/lease", {
+        method: "POST"
+    });
+    if (resp.status == 404) {
+        return true;
+    }
+    if (resp.status == 423) {
+        const body = await resp.json();
+        lockedBy = body.data;
+        if (holdingLease) {
+            holdingLease = false;
+            declinedTakeover = true;
+            notifyLocked(`The game was taken over by ${describeHolder(body.data)}. ` + "Reload to take it back.");
+        }
+        scheduleHeartbeat(body.data.ttl);
+        return false;
+    }
+    if (!resp.ok) {
+        const body = await resp.json();
+        throw new Error(body.data.error);
+    }
+    const body = await resp.json();
+    if (!holdingLease && declinedTakeover) {
+        notifySaved("The other device is done, syncing again!");
+    }
+    holdingLease = true;
+    lockedBy = null;
+    declinedTakeover = false;
+    scheduleHeartbeat(body.lease.ttl);
+    return true;
+}
+let heartbeat = null;
+function scheduleHeartbeat(ttl) {
+    if (heartbeat != null) {
+        clearTimeout(heartbeat);
+    }
+    heartbeat = setTimeout(async ()=>{
+        heartbeat = null;
+        try {
+            await holdLease();
+        } catch (err) {
+            console.warn("autosync: cannot renew lease:", err);
+            scheduleHeartbeat(ttl);
+        }
+    }, ttl / 3);
+}
+async function handleLocked(lease) {
+    holdingLease = false;
+    if (!declinedTakeover) {
+        if (await promptTakeover(lease)) {
+            return await holdLease(true);
+        }
+        declinedTakeover = true;
+    }
+    notifyLocked(`Not syncing, the game is being played on ${describeHolder(lease)}.`);
+    return false;
+}
+function releaseLease() {
+    if (!holdingLease) {
+        return;
+    }
+    holdingLease = false;
+    autosyncFetch("x/autosync/lease", {
+        method: "DELETE",
+        keepalive: true
+    });
+}
+function describeHolder(lease) {
+    return lease.holder.name || "another device";
+}
+async function ensureProfile() {
+    const resp = await fetch("x/autosync/profile");
+    const info = await resp.json();
+    if (info.profile != null || info.resolver != "cookie") {
+        return;
+    }
+    const profile = await promptProfile(info.profiles ?? []);
+    const pickResp = await fetch("x/autosync/profile", {
+        method: "POST",
+        body: JSON.stringify({
+            profile
+        })
+    });
+    if (!pickResp.ok) {
+        const body = await pickResp.json();
+        throw new Error(body.data.error);
+    }
+}
+function listenForSaves() {
+    const events = new EventSource("x/autosync/events");
+    events.addEventListener("save", async (ev)=>{
+        const event = JSON.parse(ev.data);
+        if (event.writer?.id == deviceID) {
+            return;
+        }
+        try {
+            if (event.slot == "autosave") {
+                if (event.hash != lastHash) {
+                    await pullSave(event);
+                }
+            } else {
+                const index = slotIndex(event.slot);
+                if (index != null) {
+                    await pullSlot(index, event.hash);
+                }
+            }
+        } catch (err) {
+            notifyError(err);
+        }
+    });
+}
+async function pullSave(event) {
+    if (saving || passages != syncedPassages) {
+        return;
+    }
+    const resp = await autosyncFetch("x/autosync/save");
+    const body = await resp.json();
+    if (body.save == null || body.server_hash == lastHash) {
+        return;
+    }
+    if (saving || passages != syncedPassages) {
+        return;
+    }
+    console.debug("autosync: loading newer save from", event.writer);
     overrideLocal(body.save.data, body.server_hash);
+    const writer = event.writer?.name ?? "another device";
+    notifySaved(`Save has been updated from ${writer}!`);
+}
+async function registerDevice() {
+    const resp = await autosyncFetch("x/autosync/devices", {
+        method: "POST",
+        body: JSON.stringify({
+            id: deviceID,
+            name: defaultDeviceName()
+        })
+    });
+    if (!resp.ok) {
+        const body = await resp.json();
+        throw new Error(body.data.error);
+    }
+}
+function defaultDeviceName() {
+    const ua = navigator.userAgent;
+    const find = (names)=>names.find(([token])=>ua.includes(token))?.[1];
+    const browser = find([
+        [
+            "Edg/",
+            "Edge"
+        ],
+        [
+            "Firefox/",
+            "Firefox"
+        ],
+        [
+            "Chrome/",
+            "Chrome"
+        ],
+        [
+            "Safari/",
+            "Safari"
+        ]
+    ]) ?? "Browser";
+    const os = find([
+        [
+            "Android",
+            "Android"
+        ],
+        [
+            "iPhone",
+            "iPhone"
+        ],
+        [
+            "iPad",
+            "iPad"
+        ],
+        [
+            "Windows",
+            "Windows"
+        ],
+        [
+            "Mac OS",
+            "macOS"
+        ],
+        [
+            "Linux",
+            "Linux"
+        ]
+    ]);
+    return os ? `${browser} on ${os}` : browser;
+}
+function promptProfile(profiles) {
+    const list = document.createElement("datalist");
+    list.id = "autosync-profiles";
+    for (const profile of profiles){
+        const option = document.createElement("option");
+        option.value = profile;
+        list.append(option);
+    }
+    const input = document.createElement("input");
+    input.type = "text";
+    input.name = "profile";
+    input.setAttribute("list", list.id);
+    const form = document.createElement("form");
+    form.append(input, list);
+    return new Promise((resolve)=>{
+        SugarCube.Dialog.setup("Autosave", "autosync-prompt-profile");
+        SugarCube.Dialog.append(removeIndentation(`
+      Pick the profile to sync your saves to.
+      Use the same profile on all of your devices.
+    `));
+        SugarCube.Dialog.append(document.createElement("br"));
+        SugarCube.Dialog.append(form);
+        SugarCube.Dialog.open(null, ()=>{
+            const profile = input.value.trim();
+            if (profile) {
+                resolve(profile);
+            } else {
+                setTimeout(()=>promptProfile(profiles).then(resolve));
+            }
+        });
+    });
+}
+function promptTakeover(lease) {
+    const form = document.createElement("form");
+    form.innerHTML = html`
+    <label>
+      <input type="radio" name="takeover" value="yes" checked>
+      Play here and stop syncing on the other device
+    </label>
+    <br />
+    <label>
+      <input type="radio" name="takeover" value="no">
+      Do not sync on this device
+    </label>
+  `;
+    return new Promise((resolve)=>{
+        SugarCube.Dialog.setup("Autosave", "autosync-prompt-takeover");
+        const info = document.createElement("div");
+        info.textContent = removeIndentation(`
+      This game is being played on ${describeHolder(lease)}.
+      Would you like to take it over?
+    `);
+        SugarCube.Dialog.append(info);
+        SugarCube.Dialog.append(document.createElement("br"));
+        SugarCube.Dialog.append(form);
+        SugarCube.Dialog.open(null, ()=>{
+            const formData = new FormData(form);
+            resolve(formData.get("takeover") == "yes");
+        });
+    });
 }
-async function handleOverride(clientData, serverSave, serverHash) {
-    const override = await promptOverride(serverSave.date);
+async function handleOverride(clientData, conflict) {
+    const serverSave = conflict.save;
+    const override = await promptOverride(conflict);
     switch(override){
         case OverrideChoice.Local:
             {
-                overrideLocal(serverSave.data, serverHash);
+                overrideLocal(serverSave.data, conflict.server_hash);
                 break;
             }
         case OverrideChoice.Server:
             {
-                const resp = await fetch("/x/autosync/merge?override=1", {
+                const resp = await autosyncFetch("x/autosync/merge?override=1", {
                     method: "POST",
                     body: JSON.stringify({
                         data: clientData
@@ -217,9 +626,10 @@ var OverrideChoice;
     OverrideChoice[OverrideChoice["Local"] = 0] = "Local";
     OverrideChoice[OverrideChoice["Server"] = 1] = "Server";
 })(OverrideChoice || (OverrideChoice = {}));
-function promptOverride(serverDate = null) {
+function promptOverride(conflict) {
     const div = document.createElement("div");
     div.classList.add("autosync-prompt-override");
+    const serverDate = conflict.save?.date;
     if (serverDate != null) {
         const serverDateString = new Date(serverDate).toLocaleString();
         const info = document.createElement("div");
@@ -229,6 +639,39 @@ function promptOverride(serverDate = null) {
     `;
         div.append(info);
     }
+    if (conflict.peer) {
+        const info1 = document.createElement("div");
+        info1.classList.add("autosync-prompt-override-writer");
+        info1.textContent = "Saved on the other server";
+        div.append(info1);
+    } else if (conflict.writer) {
+        const writer = conflict.writer.id == deviceID ? "this device" : conflict.writer.name || "a forgotten device";
+        const info2 = document.createElement("div");
+        info2.classList.add("autosync-prompt-override-writer");
+        info2.textContent = `Saved by ${writer}`;
+        div.append(info2);
+    }
+    const ahead = describeAhead(conflict);
+    if (ahead) {
+        const info3 = document.createElement("div");
+        info3.classList.add("autosync-prompt-override-ahead");
+        info3.textContent = ahead;
+        div.append(info3);
+    }
+    const summary = conflict.summary && describeSummary(conflict.summary);
+    if (summary) {
+        const info4 = document.createElement("div");
+        info4.classList.add("autosync-prompt-override-summary");
+        info4.textContent = `Server save: ${summary}`;
+        div.append(info4);
+    }
+    const conflictingKeys = conflict.conflicting_keys ?? [];
+    if (conflictingKeys.length > 0) {
+        const info5 = document.createElement("div");
+        info5.classList.add("autosync-prompt-override-conflicts");
+        info5.textContent = `Changed in both saves: ${describeKeys(conflictingKeys)}`;
+        div.append(info5);
+    }
     const form = document.createElement("form");
     form.innerHTML = html`
     <label>
@@ -249,7 +692,7 @@ function promptOverride(serverDate = null) {
       Would you like to override it with the server save?
     `));
         SugarCube.Dialog.append(document.createElement("br"));
-        SugarCube.Dialog.append(form);
+        SugarCube.Dialog.append(div);
         SugarCube.Dialog.open(null, ()=>{
             const formData = new FormData(form);
             const override = formData.get("override");
@@ -264,6 +707,70 @@ function promptOverride(serverDate = null) {
         });
     });
 }
+function describeSummary(summary) {
+    const parts = [];
+    if (summary.name) {
+        parts.push(summary.name);
+    }
+    if (summary.day != null && summary.time) {
+        parts.push(`Day ${summary.day}, ${summary.time}`);
+    }
+    if (summary.passage) {
+        parts.push(summary.passage);
+    }
+    if (summary.money != null) {
+        parts.push(`\u00a3${(summary.money / 100).toFixed(2)}`);
+    }
+    return parts.join(" \u00b7 ");
+}
+function describeAhead(conflict) {
+    const parts = [];
+    if (conflict.saves_ahead != null && conflict.saves_ahead > 0) {
+        const s = conflict.saves_ahead == 1 ? "" : "s";
+        parts.push(`${conflict.saves_ahead} save${s}`);
+    }
+    if (conflict.minutes_ahead != null && conflict.minutes_ahead != 0) {
+        const duration = describeMinutes(Math.abs(conflict.minutes_ahead));
+        parts.push(`${duration} of in-game time`);
+    }
+    if (parts.length == 0) {
+        return "";
+    }
+    const behind = conflict.minutes_ahead != null && conflict.minutes_ahead < 0;
+    return `${parts.join(" and ")} ${behind ? "behind" : "ahead of"} yours`;
+}
+function describeMinutes(minutes) {
+    const units = [
+        [
+            24 * 60,
+            "day"
+        ],
+        [
+            60,
+            "hour"
+        ],
+        [
+            1,
+            "minute"
+        ]
+    ];
+    const parts = [];
+    for (const [size, unit] of units){
+        const n = Math.floor(minutes / size);
+        minutes -= n * size;
+        if (n > 0 && parts.length < 2) {
+            parts.push(`${n} ${unit}${n == 1 ? "" : "s"}`);
+        }
+    }
+    return parts.join(" ");
+}
+function describeKeys(keys, max = 8) {
+    const listed = keys.slice(0, max).map((key)=>`$${key}`).join(", ");
+    if (keys.length > max) {
+        return `${listed} and ${keys.length - max} more`;
+    }
+    return listed;
+}
 function removeIndentation(str) {
     str = str.replace(/^\s+/g, "");
     str = str.replace(/\s+$/g, "");
@@ -279,8 +786,12 @@ async function saveHook() {
     console.debug("autosync: saving");
     saving = true;
     try {
-        await sync();
-        notifySaved();
+        if (await sync()) {
+            for(let i = 0; i < SugarCube.Save.slots.length; i++){
+                await syncSlot(i);
+            }
+            notifySaved();
+        }
     } catch (err) {
         notifyError(err);
     } finally{
@@ -288,11 +799,25 @@ async function saveHook() {
     }
 }
 try {
-    await checkSync();
-    notifySaved("Save has been restored!");
+    await ensureProfile();
+    await registerDevice();
+    const holding = await holdLease();
+    if (holding || await handleLocked(lockedBy)) {
+        if (await checkSync()) {
+            await syncSlots();
+            notifySaved("Save has been restored!");
+        }
+    }
+    listenForSaves();
 } catch (err) {
     notifyError(err);
 }
+window.addEventListener("pagehide", releaseLease);
+window.addEventListener("pageshow", (ev)=>{
+    if (ev.persisted) {
+        holdLease().catch((err)=>notifyError(err));
+    }
+});
 SugarCube.Save.onSave.add(()=>{
     saveHook();
 });
@@ -131,6 +131,12 @@ export function notifySaved(message = "Save has been synchronized!") {
   );
 }
 
+// notifyLocked shows a notification that saves are not synchronized because
+// another device is playing. It stays until the next notification.
+export function notifyLocked(message: string) {
+  show(html`<span class="red">${message}</span>`);
+}
+
 // notifyError shows a notification that an error has occured.
 export function notifyError(error: string) {
   show(
@@ -0,0 +1,345 @@
+package autosync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// deviceHeader is the header that clients send their device ID in.
+const deviceHeader = "Autosync-Device-ID"
+
+// devicesName is the name of the blob that the devices of a profile are
+// stored in, relative to the profile's key.
+const devicesName = "devices.json"
+
+// deviceSeenInterval is how often the last seen date of a device is updated.
+// Clients sync every few seconds, so updating it on every sync would mean a
+// write for every save.
+const deviceSeenInterval = time.Minute
+
+// deviceIDRegex matches valid device IDs. Clients make them up randomly.
+var deviceIDRegex = regexp.MustCompile(`^[A-Za-z0-9_-]{8,64}$`)
+
+// maxDeviceNameLen is the maximum length of a device name in characters.
+const maxDeviceNameLen = 64
+
+var (
+	errInvalidDeviceID   = errors.New("invalid device ID")
+	errInvalidDeviceName = errors.New("invalid device name")
+	errDeviceNotFound    = errors.New("device not found")
+)
+
+// Device is a device that syncs saves. Devices belong to a profile.
+type Device struct {
+	// ID identifies the device. It is made up by the client.
+	ID string `json:"id"`
+	// Name is the friendly name of the device, such as "Firefox on Android".
+	Name string `json:"name,omitempty"`
+	// FirstSeen is when the device was registered, in Unix milliseconds.
+	FirstSeen int64 `json:"first_seen,omitempty"`
+	// LastSeen is when the device last synced, in Unix milliseconds.
+	LastSeen int64 `json:"last_seen,omitempty"`
+}
+
+// deviceIDFromRequest returns the ID of the device that sent the request, or
+// an empty string if the request does not have a valid device ID.
+func deviceIDFromRequest(r *http.Request) string {
+	id := r.Header.Get(deviceHeader)
+	if !deviceIDRegex.MatchString(id) {
+		return ""
+	}
+	return id
+}
+
+func normalizeDeviceName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || !utf8.ValidString(name) || utf8.RuneCountInString(name) > maxDeviceNameLen {
+		return "", fmt.Errorf("%w %q", errInvalidDeviceName, name)
+	}
+	return name, nil
+}
+
+// profileKey returns the key prefix of the profile that the given context
+// belongs to. The shared profile has no prefix.
+func profileKey(ctx context.Context) string {
+	if profile := profileFromContext(ctx); profile != "" {
+		return path.Join("profiles", profile)
+	}
+	return ""
+}
+
+func devicesBlobName(profileKey string) string {
+	return path.Join(profileKey, devicesName)
+}
+
+// devicesLockKey is the key that the devices of a profile are locked with.
+// It is not the profile's key itself, since that is also the key of the
+// shared profile's autosave.
+func devicesLockKey(profileKey string) string {
+	return path.Join(profileKey, "devices")
+}
+
+// Devices returns the devices of the profile with the given key.
+func (s *saveStore) Devices(ctx context.Context, profileKey string) (map[string]Device, error) {
+	unlock, err := s.lock(ctx, devicesLockKey(profileKey))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return s.readDevices(ctx, profileKey)
+}
+
+// UpdateDevices calls update with the devices of the profile with the given
+// key and stores the devices if update returns true.
+func (s *saveStore) UpdateDevices(ctx context.Context, profileKey string, update func(map[string]Device) (bool, error)) error {
+	unlock, err := s.lock(ctx, devicesLockKey(profileKey))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	devices, err := s.readDevices(ctx, profileKey)
+	if err != nil {
+		return err
+	}
+
+	changed, err := update(devices)
+	if err != nil || !changed {
+		return err
+	}
+
+	b, err := json.Marshal(devices)
+	if err != nil {
+		return fmt.Errorf("encoding devices: %w", err)
+	}
+
+	b, err = s.seal(b)
+	if err != nil {
+		return fmt.Errorf("encrypting devices: %w", err)
+	}
+
+	if err := s.blobs.put(ctx, devicesBlobName(profileKey), b); err != nil {
+		return fmt.Errorf("writing devices: %w", err)
+	}
+
+	return nil
+}
+
+func (s *saveStore) readDevices(ctx context.Context, profileKey string) (map[string]Device, error) {
+	devices := make(map[string]Device)
+
+	b, err := s.blobs.get(ctx, devicesBlobName(profileKey))
+	if err != nil {
+		if errors.Is(err, errBlobNotFound) {
+			return devices, nil
+		}
+		return nil, fmt.Errorf("reading devices: %w", err)
+	}
+
+	b, err = s.open(b)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting devices: %w", err)
+	}
+
+	if err := json.Unmarshal(b, &devices); err != nil {
+		return nil, fmt.Errorf("decoding devices: %w", err)
+	}
+
+	return devices, nil
+}
+
+// device returns the device with the given ID. Devices that are not
+// registered, such as forgotten devices, only have their ID set. It returns
+// nil if id is empty.
+func (e *autosyncExtension) device(ctx context.Context, id string) (*Device, error) {
+	if id == "" {
+		return nil, nil
+	}
+
+	devices, err := e.store.Devices(ctx, profileKey(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	device, ok := devices[id]
+	if !ok {
+		device = Device{ID: id}
+	}
+
+	return &device, nil
+}
+
+// touchDevice updates the last seen date of the device that sent the
+// request. Devices that are not registered are left alone.
+func (e *autosyncExtension) touchDevice(r *http.Request) error {
+	id := deviceIDFromRequest(r)
+	if id == "" {
+		return nil
+	}
+
+	now := time.Now()
+	return e.store.UpdateDevices(r.Context(), profileKey(r.Context()), func(devices map[string]Device) (bool, error) {
+		device, ok := devices[id]
+		if !ok || now.Sub(time.UnixMilli(device.LastSeen)) < deviceSeenInterval {
+			return false, nil
+		}
+		device.LastSeen = now.UnixMilli()
+		devices[id] = device
+		return true, nil
+	})
+}
+
+func (e *autosyncExtension) listDevices(w http.ResponseWriter, r *http.Request) {
+	devices, err := e.store.Devices(r.Context(), profileKey(r.Context()))
+	if err != nil {
+		writeMergeError(w, 500, err)
+		return
+	}
+
+	list := make([]Device, 0, len(devices))
+	for _, device := range devices {
+		list = append(list, device)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].LastSeen != list[j].LastSeen {
+			return list[i].LastSeen > list[j].LastSeen
+		}
+		return list[i].ID < list[j].ID
+	})
+
+	type ListDevicesResponse struct {
+		Devices []Device `json:"devices"`
+		// Current is the ID of the device that sent the request, if any.
+		Current string `json:"current,omitempty"`
+	}
+
+	writeJSON(w, 200, ListDevicesResponse{
+		Devices: list,
+		Current: deviceIDFromRequest(r),
+	})
+}
+
+// registerDevice registers a device. Registering a device that is already
+// registered keeps its name, so that renaming a device sticks.
+func (e *autosyncExtension) registerDevice(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeMergeError(w, 400, fmt.Errorf("decoding request body: %w", err))
+		return
+	}
+
+	if !deviceIDRegex.MatchString(req.ID) {
+		writeMergeError(w, 400, fmt.Errorf("%w %q", errInvalidDeviceID, req.ID))
+		return
+	}
+
+	name, err := normalizeDeviceName(req.Name)
+	if err != nil {
+		writeMergeError(w, 400, err)
+		return
+	}
+
+	var device Device
+	now := time.Now().UnixMilli()
+
+	err = e.store.UpdateDevices(r.Context(), profileKey(r.Context()), func(devices map[string]Device) (bool, error) {
+		var ok bool
+		device, ok = devices[req.ID]
+		if !ok {
+			device = Device{
+				ID:        req.ID,
+				Name:      name,
+				FirstSeen: now,
+			}
+		}
+		device.LastSeen = now
+		devices[req.ID] = device
+		return true, nil
+	})
+	if err != nil {
+		writeMergeError(w, 500, err)
+		return
+	}
+
+	writeJSON(w, 200, device)
+}
+
+func (e *autosyncExtension) renameDevice(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeMergeError(w, 400, fmt.Errorf("decoding request body: %w", err))
+		return
+	}
+
+	name, err := normalizeDeviceName(req.Name)
+	if err != nil {
+		writeMergeError(w, 400, err)
+		return
+	}
+
+	id := chi.URLParam(r, "id")
+
+	var device Device
+	err = e.store.UpdateDevices(r.Context(), profileKey(r.Context()), func(devices map[string]Device) (bool, error) {
+		var ok bool
+		device, ok = devices[id]
+		if !ok {
+			return false, errDeviceNotFound
+		}
+		device.Name = name
+		devices[id] = device
+		return true, nil
+	})
+	if err != nil {
+		writeDeviceError(w, err)
+		return
+	}
+
+	writeJSON(w, 200, device)
+}
+
+// forgetDevice removes a device. Saves that the device wrote keep its ID, but
+// lose its name.
+func (e *autosyncExtension) forgetDevice(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	err := e.store.UpdateDevices(r.Context(), profileKey(r.Context()), func(devices map[string]Device) (bool, error) {
+		if _, ok := devices[id]; !ok {
+			return false, errDeviceNotFound
+		}
+		delete(devices, id)
+		return true, nil
+	})
+	if err != nil {
+		writeDeviceError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeDeviceError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errDeviceNotFound) {
+		writeMergeError(w, 404, err)
+		return
+	}
+	writeMergeError(w, 500, err)
+}
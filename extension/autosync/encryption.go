@@ -0,0 +1,451 @@
+package autosync
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"libdb.so/dol-server/extension"
+)
+
+// EncryptionConfig configures the encryption of saves at rest. Exactly one of
+// Passphrase and KeyFile must be set.
+type EncryptionConfig struct {
+	// Passphrase is the passphrase that the key is derived from.
+	Passphrase string `json:"passphrase"`
+	// KeyFile is the path to a file that the key is derived from. It should
+	// hold at least 32 random bytes.
+	KeyFile string `json:"key_file"`
+}
+
+func (c EncryptionConfig) enabled() bool {
+	return c != (EncryptionConfig{})
+}
+
+const (
+	// encryptionName is the name of the blob that holds the salt that new
+	// blobs are encrypted with. It is not encrypted itself.
+	encryptionName = "encryption.json"
+	// encryptionLockKey is the key that encryptionName is locked with.
+	encryptionLockKey = "encryption"
+	// minKeyFileSize is the minimum size of a key file in bytes.
+	minKeyFileSize = 16
+)
+
+// The argon2id parameters that keys are derived from passphrases with. They
+// are the second recommended option of RFC 9106, which needs 64 MiB of memory.
+// Changing them makes existing saves unreadable.
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+)
+
+// encryptedMagic starts every encrypted blob. Plaintext blobs are JSON, so
+// they never start with a zero byte.
+const encryptedMagic = "\x00dse1"
+
+const (
+	encryptionSaltSize  = 16
+	encryptionKeyIDSize = 8
+	encryptionNonceSize = 12
+	encryptionHeaderLen = len(encryptedMagic) + encryptionSaltSize + encryptionKeyIDSize + encryptionNonceSize
+)
+
+// errWrongKey is returned when a blob is encrypted with a key that is not
+// configured. Unlike corrupt saves, such saves are never replaced.
+var errWrongKey = errors.New("save is encrypted with another key")
+
+// encryptionSecret is what encryption keys are derived from.
+type encryptionSecret struct {
+	value      []byte
+	passphrase bool
+}
+
+func loadEncryptionSecret(cfg EncryptionConfig) (encryptionSecret, error) {
+	switch {
+	case cfg.Passphrase != "" && cfg.KeyFile != "":
+		return encryptionSecret{}, fmt.Errorf("only one of passphrase and key_file can be set")
+
+	case cfg.Passphrase != "":
+		return encryptionSecret{value: []byte(cfg.Passphrase), passphrase: true}, nil
+
+	case cfg.KeyFile != "":
+		b, err := os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return encryptionSecret{}, fmt.Errorf("reading key file: %w", err)
+		}
+		if len(b) < minKeyFileSize {
+			return encryptionSecret{}, fmt.Errorf("key file must be at least %d bytes long", minKeyFileSize)
+		}
+		return encryptionSecret{value: b}, nil
+
+	default:
+		return encryptionSecret{}, fmt.Errorf("a passphrase or key_file is required")
+	}
+}
+
+// deriveKey derives the encryption key with the given salt. Passphrases are
+// stretched with argon2id, which is slow on purpose. Key files are random
+// enough already.
+func (s encryptionSecret) deriveKey(salt []byte) (*encryptionKey, error) {
+	var raw []byte
+	if s.passphrase {
+		raw = argon2.IDKey(s.value, salt, argon2Time, argon2Memory, argon2Threads, 32)
+	} else {
+		mac := hmac.New(sha256.New, salt)
+		mac.Write(s.value)
+		raw = mac.Sum(nil)
+	}
+
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// The key ID tells a blob that is encrypted with another key apart from a
+	// corrupt blob, without giving away anything about the key.
+	mac := hmac.New(sha256.New, raw)
+	mac.Write([]byte("autosync key id"))
+
+	return &encryptionKey{
+		id:   mac.Sum(nil)[:encryptionKeyIDSize],
+		aead: aead,
+	}, nil
+}
+
+type encryptionKey struct {
+	id   []byte
+	aead cipher.AEAD
+}
+
+// saveCipher encrypts and decrypts stored blobs with AES-GCM. Every encrypted
+// blob holds everything but the secret that is needed to decrypt it:
+//
+//	magic | salt | key ID | nonce | ciphertext
+//
+// Blobs that do not start with the magic are plaintext blobs from before
+// encryption was turned on. They are read as they are and encrypted on their
+// next write.
+type saveCipher struct {
+	// secrets are the secrets that blobs can be decrypted with. Blobs are
+	// encrypted with the first one.
+	secrets []encryptionSecret
+	// salt is the salt that blobs are encrypted with.
+	salt []byte
+
+	mu   sync.Mutex
+	keys map[string]*encryptionKey // secret index and salt -> key
+}
+
+func newSaveCipher(secrets []encryptionSecret, salt []byte) *saveCipher {
+	return &saveCipher{
+		secrets: secrets,
+		salt:    salt,
+		keys:    make(map[string]*encryptionKey),
+	}
+}
+
+// key returns the key of the secret with the given index and the given salt.
+// Keys are cached, since deriving them from a passphrase is slow.
+func (c *saveCipher) key(secret int, salt []byte) (*encryptionKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cacheKey := fmt.Sprintf("%d:%x", secret, salt)
+	if key, ok := c.keys[cacheKey]; ok {
+		return key, nil
+	}
+
+	key, err := c.secrets[secret].deriveKey(salt)
+	if err != nil {
+		return nil, fmt.Errorf("deriving encryption key: %w", err)
+	}
+
+	c.keys[cacheKey] = key
+	return key, nil
+}
+
+func (c *saveCipher) seal(plaintext []byte) ([]byte, error) {
+	key, err := c.key(0, c.salt)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, encryptionHeaderLen)
+	header = append(header, encryptedMagic...)
+	header = append(header, c.salt...)
+	header = append(header, key.id...)
+
+	nonce := make([]byte, encryptionNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("generating nonce: %w", err)
+	}
+	header = append(header, nonce...)
+
+	// The header is authenticated along with the save, so that it cannot be
+	// swapped out.
+	return key.aead.Seal(header, nonce, plaintext, header), nil
+}
+
+func (c *saveCipher) open(b []byte) ([]byte, error) {
+	if !isEncrypted(b) {
+		return b, nil
+	}
+
+	if len(b) < encryptionHeaderLen {
+		return nil, fmt.Errorf("%w: encrypted save is truncated", errCorruptSave)
+	}
+
+	header := b[:encryptionHeaderLen]
+	salt := header[len(encryptedMagic) : len(encryptedMagic)+encryptionSaltSize]
+	keyID := header[len(encryptedMagic)+encryptionSaltSize : len(encryptedMagic)+encryptionSaltSize+encryptionKeyIDSize]
+	nonce := header[len(header)-encryptionNonceSize:]
+
+	for i := range c.secrets {
+		key, err := c.key(i, salt)
+		if err != nil {
+			return nil, err
+		}
+		if !hmac.Equal(key.id, keyID) {
+			continue
+		}
+
+		plaintext, err := key.aead.Open(nil, nonce, b[encryptionHeaderLen:], header)
+		if err != nil {
+			return nil, fmt.Errorf("%w: decrypting: %v", errCorruptSave, err)
+		}
+		return plaintext, nil
+	}
+
+	return nil, errWrongKey
+}
+
+func isEncrypted(b []byte) bool {
+	return bytes.HasPrefix(b, []byte(encryptedMagic))
+}
+
+// isEncryptedBlob returns true if the blob with the given name is encrypted
+// when encryption is configured. Other blobs, such as lock files and the
+// copies of corrupt saves, are left as they are.
+func isEncryptedBlob(name string) bool {
+	base := path.Base(name)
+	if base == currentSaveName || base == devicesName || base == peerConflictName {
+		return true
+	}
+	return path.Base(path.Dir(name)) == historyDirName && strings.HasSuffix(base, ".json")
+}
+
+// encryptionInfo is stored in encryptionName.
+type encryptionInfo struct {
+	// Salt is the salt that new blobs are encrypted with.
+	Salt []byte `json:"salt"`
+}
+
+// loadEncryptionSalt returns the salt that new blobs are encrypted with. If
+// there is none yet, a new one is stored.
+func loadEncryptionSalt(ctx context.Context, blobs blobStore) ([]byte, error) {
+	unlock, err := blobs.lock(ctx, encryptionLockKey)
+	if err != nil {
+		return nil, fmt.Errorf("acquiring encryption lock: %w", err)
+	}
+	defer unlock()
+
+	b, err := blobs.get(ctx, encryptionName)
+	if err == nil {
+		var info encryptionInfo
+		if err := json.Unmarshal(b, &info); err != nil {
+			return nil, fmt.Errorf("decoding %s: %w", encryptionName, err)
+		}
+		if len(info.Salt) != encryptionSaltSize {
+			return nil, fmt.Errorf("%s has an invalid salt", encryptionName)
+		}
+		return info.Salt, nil
+	}
+	if !errors.Is(err, errBlobNotFound) {
+		return nil, fmt.Errorf("reading %s: %w", encryptionName, err)
+	}
+
+	return storeEncryptionSalt(ctx, blobs)
+}
+
+// storeEncryptionSalt stores a new random salt for new blobs to be encrypted
+// with. The encryption lock must be held.
+func storeEncryptionSalt(ctx context.Context, blobs blobStore) ([]byte, error) {
+	salt := make([]byte, encryptionSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("generating salt: %w", err)
+	}
+
+	b, err := json.Marshal(encryptionInfo{Salt: salt})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := blobs.put(ctx, encryptionName, b); err != nil {
+		return nil, fmt.Errorf("writing %s: %w", encryptionName, err)
+	}
+
+	return salt, nil
+}
+
+// seal encrypts the blob if encryption is configured.
+func (s *saveStore) seal(b []byte) ([]byte, error) {
+	if s.cipher == nil {
+		return b, nil
+	}
+	return s.cipher.seal(b)
+}
+
+// open decrypts the blob if it is encrypted.
+func (s *saveStore) open(b []byte) ([]byte, error) {
+	if s.cipher == nil {
+		if isEncrypted(b) {
+			return nil, fmt.Errorf("%w: encryption is not configured", errWrongKey)
+		}
+		return b, nil
+	}
+	return s.cipher.open(b)
+}
+
+// rotateKey encrypts every blob in the store with a new key derived from the
+// given secret and returns the number of blobs it encrypted. Blobs that are
+// not encrypted yet are encrypted as well. The whole store is locked while
+// rotating, so that saves are not written in the meantime. Servers should
+// still be stopped until their config has the new key, since they keep
+// encrypting new blobs with the old one.
+//
+// If rotating is interrupted, it can simply be run again: blobs that were
+// already encrypted with the new key are still read.
+func (s *saveStore) rotateKey(ctx context.Context, secret encryptionSecret) (int, error) {
+	log := extension.LoggerFromContext(ctx)
+
+	// Locking the store also locks encryptionLockKey, which cannot be locked
+	// on its own while the store is locked.
+	unlock, err := s.lockStore(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	salt, err := storeEncryptionSalt(ctx, s.blobs)
+	if err != nil {
+		return 0, err
+	}
+
+	secrets := []encryptionSecret{secret}
+	if s.cipher != nil {
+		secrets = append(secrets, s.cipher.secrets...)
+	}
+	rotating := newSaveCipher(secrets, salt)
+
+	blobs, err := s.blobs.list(ctx, "")
+	if err != nil {
+		return 0, fmt.Errorf("listing blobs: %w", err)
+	}
+
+	var n int
+	for _, blob := range blobs {
+		if !isEncryptedBlob(blob.name) {
+			continue
+		}
+
+		ok, err := s.rotateBlob(ctx, rotating, blob.name)
+		if err != nil {
+			if errors.Is(err, errCorruptSave) {
+				log.Warn(
+					"skipping corrupt blob while rotating the encryption key",
+					"blob", blob.name,
+					"err", err)
+				continue
+			}
+			return n, err
+		}
+		if ok {
+			n++
+		}
+	}
+
+	s.cipher = newSaveCipher(secrets[:1], salt)
+	return n, nil
+}
+
+// rotateBlob encrypts the blob with the given name again with rotating. It
+// returns false if the blob was deleted after it was listed. If the store is a
+// versionedBlobStore, which cannot lock the store against other servers, the
+// blob is only replaced if it did not change since it was read, and is read
+// again otherwise.
+func (s *saveStore) rotateBlob(ctx context.Context, rotating *saveCipher, name string) (bool, error) {
+	versioned, _ := s.blobs.(versionedBlobStore)
+
+	for {
+		var b []byte
+		var version string
+		var err error
+		if versioned != nil {
+			b, version, err = versioned.getVersion(ctx, name)
+		} else {
+			b, err = s.blobs.get(ctx, name)
+		}
+		if err != nil {
+			if errors.Is(err, errBlobNotFound) {
+				return false, nil
+			}
+			return false, fmt.Errorf("reading %s: %w", name, err)
+		}
+
+		plaintext, err := rotating.open(b)
+		if err != nil {
+			return false, fmt.Errorf("decrypting %s: %w", name, err)
+		}
+
+		b, err = rotating.seal(plaintext)
+		if err != nil {
+			return false, fmt.Errorf("encrypting %s: %w", name, err)
+		}
+
+		if versioned != nil {
+			err = versioned.putVersion(ctx, name, b, version)
+			if errors.Is(err, errBlobChanged) {
+				continue
+			}
+		} else {
+			err = s.blobs.put(ctx, name, b)
+		}
+		if err != nil {
+			return false, fmt.Errorf("writing %s: %w", name, err)
+		}
+
+		return true, nil
+	}
+}
+
+// RotateKey encrypts all saves with a new key derived from the given config
+// and returns the number of blobs that it encrypted. Saves that are not
+// encrypted yet are encrypted as well. The config of the server must be
+// changed to the new key afterwards, and the server should not be running in
+// the meantime.
+func (s *Saves) RotateKey(ctx context.Context, cfg EncryptionConfig) (int, error) {
+	secret, err := loadEncryptionSecret(cfg)
+	if err != nil {
+		return 0, err
+	}
+	return s.e.store.rotateKey(ctx, secret)
+}
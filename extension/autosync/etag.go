@@ -0,0 +1,63 @@
+package autosync
+
+import (
+	"net/http"
+	"strings"
+)
+
+// saveETag returns the entity tag of the save with the given hash. Saves are
+// identified by their hash, so the tag is strong.
+func saveETag(hash string) string {
+	return `"` + hash + `"`
+}
+
+// setSaveETag sets the ETag header to the tag of the save with the given hash.
+// Nothing is set if there is no save.
+func setSaveETag(w http.ResponseWriter, hash string) {
+	if hash != "" {
+		w.Header().Set("ETag", saveETag(hash))
+	}
+}
+
+// etagMatches returns true if the list of entity tags in an If-Match or
+// If-None-Match header matches the save with the given hash. "*" matches any
+// save, but not the lack of one. Weak tags only match if weak is true, which
+// is the comparison that If-None-Match uses.
+func etagMatches(header, hash string, weak bool) bool {
+	if hash == "" {
+		return false
+	}
+
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == saveETag(hash) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasPreconditions returns true if the request makes a merge conditional on
+// the current save with If-Match or If-None-Match.
+func hasPreconditions(r *http.Request) bool {
+	return r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") != ""
+}
+
+// checkPreconditions returns true if the request's If-Match and If-None-Match
+// headers allow replacing the save with the given hash.
+func checkPreconditions(r *http.Request, hash string) bool {
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && !etagMatches(ifMatch, hash, false) {
+		return false
+	}
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && etagMatches(ifNoneMatch, hash, true) {
+		return false
+	}
+	return true
+}
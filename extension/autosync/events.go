@@ -0,0 +1,199 @@
+package autosync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"libdb.so/dol-server/extension"
+)
+
+// eventsHeartbeatInterval is how often a comment is sent on idle event
+// streams, so that proxies do not close them.
+const eventsHeartbeatInterval = 15 * time.Second
+
+// eventsBufferSize is the number of events that are buffered for each event
+// stream. If a client falls further behind, newer events are dropped. It
+// still finds out about the newer saves on its next sync.
+const eventsBufferSize = 16
+
+// SaveEvent is sent on the event stream whenever a save is written.
+type SaveEvent struct {
+	// Slot is the slot that the save was written to.
+	Slot string `json:"slot"`
+	// Hash is the hash of the new save.
+	Hash string `json:"hash"`
+	// Date is the date of the new save in Unix milliseconds.
+	Date int64 `json:"date"`
+	// Source is how the save was written.
+	Source SaveSource `json:"source"`
+	// Writer is the device that wrote the save, if known.
+	Writer *Device `json:"writer,omitempty"`
+}
+
+// saveEvent is a SaveEvent along with the key of the game it belongs to.
+type saveEvent struct {
+	SaveEvent
+	gameKey string
+}
+
+// saveEvents publishes save events to the event streams that are open.
+type saveEvents struct {
+	mu     sync.Mutex
+	subs   map[chan saveEvent]string // channel -> game key
+	closed bool
+}
+
+func newSaveEvents() *saveEvents {
+	return &saveEvents{subs: make(map[chan saveEvent]string)}
+}
+
+// subscribe returns a channel that receives the events of the given game. The
+// channel is closed when the events are closed. It returns nil if the events
+// are already closed.
+func (s *saveEvents) subscribe(gameKey string) chan saveEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	ch := make(chan saveEvent, eventsBufferSize)
+	s.subs[ch] = gameKey
+	return ch
+}
+
+// unsubscribe stops sending events to the given channel.
+func (s *saveEvents) unsubscribe(ch chan saveEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.subs[ch]; ok {
+		delete(s.subs, ch)
+		close(ch)
+	}
+}
+
+// publish sends the event to every stream of the event's game. It never
+// blocks.
+func (s *saveEvents) publish(event saveEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for ch, gameKey := range s.subs {
+		if gameKey != event.gameKey {
+			continue
+		}
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// close closes all event streams. Nothing can subscribe afterwards.
+func (s *saveEvents) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for ch := range s.subs {
+		close(ch)
+	}
+	s.subs = nil
+	s.closed = true
+}
+
+// putSave writes the save to the given slot and tells the event streams
+// about it.
+func (e *autosyncExtension) putSave(ctx context.Context, slot, key, prevHash string, data *SaveData, source SaveSource) (*HistoryEntry, error) {
+	entry, err := e.store.Put(ctx, key, prevHash, data, source)
+	if err != nil {
+		return nil, err
+	}
+
+	writer, err := e.device(ctx, data.Device)
+	if err != nil {
+		log := extension.LoggerFromContext(ctx)
+		log.Warn(
+			"cannot look up the device that wrote the autosync data",
+			"err", err)
+	}
+
+	e.publishSave(e.gameSaveKey(ctx), slot, entry, source, writer)
+	return entry, nil
+}
+
+// publishSave tells the event streams of the game with the given key about a
+// new save.
+func (e *autosyncExtension) publishSave(gameKey, slot string, entry *HistoryEntry, source SaveSource, writer *Device) {
+	e.events.publish(saveEvent{
+		SaveEvent: SaveEvent{
+			Slot:   slot,
+			Hash:   entry.Hash,
+			Date:   entry.Date,
+			Source: source,
+			Writer: writer,
+		},
+		gameKey: gameKey,
+	})
+}
+
+// streamEvents streams save events of the profile and game to the client as
+// Server-Sent Events. The stream ends when the client goes away or when the
+// server shuts down.
+func (e *autosyncExtension) streamEvents(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+
+	events := e.events.subscribe(e.gameSaveKey(r.Context()))
+	if events == nil {
+		writeMergeError(w, 503, fmt.Errorf("server is shutting down"))
+		return
+	}
+	defer e.events.unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keep nginx from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(200)
+
+	// Tell the client how long to wait before reconnecting, and get the
+	// headers through any proxies right away.
+	fmt.Fprintf(w, "retry: %d\n\n", (5 * time.Second).Milliseconds())
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(eventsHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+
+		case event, ok := <-events:
+			if !ok {
+				// The server is shutting down.
+				return
+			}
+
+			b, err := json.Marshal(event.SaveEvent)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "event: save\ndata: %s\n\n", b)
+		}
+
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package autosync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"time"
+
+	"libdb.so/dol-server/extension"
+	"libdb.so/dol-server/internal/sugarcube"
+)
+
+// maxSaveFileSize is the maximum size of an imported save file. Saves are
+// compressed, so even long games stay well below it.
+const maxSaveFileSize = 32 << 20 // 32 MiB
+
+var (
+	// ErrNoSave is returned when exporting a save that does not exist.
+	ErrNoSave = errors.New("no save")
+	// ErrInvalidSaveFile is returned when importing a file that is not a
+	// SugarCube save.
+	ErrInvalidSaveFile = errors.New("invalid save file")
+)
+
+// exportSave returns the save to export from the given key. If historyID is
+// not empty, the save with that ID is returned from the history instead of
+// the current save.
+func (e *autosyncExtension) exportSave(ctx context.Context, key, historyID string) (*SaveData, error) {
+	if historyID != "" {
+		_, save, err := e.store.HistoryEntry(ctx, key, historyID)
+		return save, err
+	}
+
+	save, err := e.store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if save == nil {
+		return nil, ErrNoSave
+	}
+	return save, nil
+}
+
+// saveFileNameRegex matches the characters that are kept in save file names.
+var saveFileNameRegex = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// saveFileName returns the name that the game would give the save file of the
+// given save when exporting it, such as "degrees-of-lewdity-20240102-150405.save".
+func saveFileName(data *SaveData) string {
+	name := "autosync"
+	if save, err := sugarcube.Decode(data.Data); err == nil {
+		if id := saveFileNameRegex.ReplaceAllString(save.ID, "-"); id != "" {
+			name = id
+		}
+	}
+
+	date := time.UnixMilli(data.Date).Format("20060102-150405")
+	return name + "-" + date + ".save"
+}
+
+// readSaveFile reads the save from a save file that was exported by the game
+// or by the server. The file holds the save as returned by
+// SugarCube.Save.serialize.
+func readSaveFile(b []byte) (string, *sugarcube.Save, error) {
+	data := string(bytes.TrimSpace(b))
+	if data == "" {
+		return "", nil, fmt.Errorf("%w: file is empty", ErrInvalidSaveFile)
+	}
+
+	save, err := sugarcube.Decode(data)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %w", ErrInvalidSaveFile, err)
+	}
+
+	if _, err := save.Current(); err != nil && !errors.Is(err, sugarcube.ErrDeltaEncoded) {
+		return "", nil, fmt.Errorf("%w: %w", ErrInvalidSaveFile, err)
+	}
+
+	return data, save, nil
+}
+
+// importSave validates the save file and writes it to the given key, making it
+// the current save. A save of another story than the current save is
+// rejected.
+func (e *autosyncExtension) importSave(ctx context.Context, slot, key string, file []byte, device string) (*HistoryEntry, error) {
+	data, save, err := readSaveFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := e.store.Get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("reading current save: %w", err)
+	}
+
+	if current != nil {
+		currentSave, err := sugarcube.Decode(current.Data)
+		if err == nil && currentSave.ID != save.ID {
+			return nil, fmt.Errorf("%w: save is for story %q, not %q",
+				ErrInvalidSaveFile, save.ID, currentSave.ID)
+		}
+	}
+
+	// Like restored saves, the imported save becomes the newest save, so that
+	// clients that are still on the replaced save notice the change.
+	imported := &SaveData{
+		Data:   data,
+		Date:   time.Now().UnixMilli(),
+		Device: device,
+	}
+
+	return e.putSave(ctx, slot, key, hashData(current), imported, SourceImport)
+}
+
+func (e *autosyncExtension) exportSaveFile(w http.ResponseWriter, r *http.Request) {
+	key, err := e.saveKeyFor(r.Context(), slotFromRequest(r))
+	if err != nil {
+		writeMergeError(w, 400, err)
+		return
+	}
+
+	save, err := e.exportSave(r.Context(), key, r.FormValue("history"))
+	if err != nil {
+		writeExportError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": saveFileName(save),
+	}))
+	w.WriteHeader(200)
+	io.WriteString(w, save.Data)
+}
+
+// importSaveFile imports a save file. The file is either the request body or
+// the "file" field of a multipart form.
+func (e *autosyncExtension) importSaveFile(w http.ResponseWriter, r *http.Request) {
+	slot := slotFromRequest(r)
+	key, err := e.saveKeyFor(r.Context(), slot)
+	if err != nil {
+		writeMergeError(w, 400, err)
+		return
+	}
+
+	if !e.checkLease(w, r) {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxSaveFileSize)
+
+	var body io.Reader = r.Body
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			writeMergeError(w, 400, fmt.Errorf("reading save file: %w", err))
+			return
+		}
+		defer f.Close()
+		body = f
+	}
+
+	file, err := io.ReadAll(body)
+	if err != nil {
+		writeMergeError(w, 400, fmt.Errorf("reading save file: %w", err))
+		return
+	}
+
+	entry, err := e.importSave(r.Context(), slot, key, file, deviceIDFromRequest(r))
+	if err != nil {
+		if errors.Is(err, ErrInvalidSaveFile) {
+			writeMergeError(w, 400, err)
+			return
+		}
+		e.writePutError(w, r, key, err)
+		return
+	}
+
+	log := extension.LoggerFromContext(r.Context())
+	log.Info(
+		"imported autosync data from save file",
+		"slot", slot,
+		"entry", entry.ID)
+
+	type ImportResponse struct {
+		Entry *HistoryEntry `json:"entry"`
+	}
+
+	writeJSON(w, 200, ImportResponse{Entry: entry})
+}
+
+func writeExportError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrNoSave) {
+		writeMergeError(w, 404, err)
+		return
+	}
+	writeHistoryError(w, err)
+}
+
+// Saves gives access to the saves of the autosync extension without running
+// the server, such as from the command line. It works on the same store as the
+// server, so it can be used while the server is running.
+type Saves struct {
+	e *autosyncExtension
+}
+
+// SaveRef identifies a save.
+type SaveRef struct {
+	// Profile is the profile of the save. It is empty for the shared
+	// profile.
+	Profile string
+	// Game is the name of the game of the save. It is empty if the server
+	// only serves a single game.
+	Game string
+	// Slot is the slot of the save. It defaults to AutosaveSlot.
+	Slot string
+}
+
+// OpenSaves opens the saves of the autosync extension with the given config.
+// The saves must be closed after use.
+func OpenSaves(cfgJSON json.RawMessage) (*Saves, error) {
+	cfg, err := parseConfig(cfgJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := newSaveStore(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("store: %w", err)
+	}
+
+	return &Saves{e: &autosyncExtension{
+		cfg:    cfg,
+		store:  store,
+		events: newSaveEvents(),
+	}}, nil
+}
+
+// Close closes the saves.
+func (s *Saves) Close() error {
+	return s.e.store.Close()
+}
+
+// resolve returns the context of the save's profile and game, along with the
+// save's slot and key.
+func (s *Saves) resolve(ctx context.Context, ref SaveRef) (context.Context, string, string, error) {
+	if ref.Profile != "" && !validProfileName(ref.Profile) {
+		return nil, "", "", fmt.Errorf("invalid profile name %q", ref.Profile)
+	}
+
+	slot := ref.Slot
+	if slot == "" {
+		slot = AutosaveSlot
+	}
+
+	ctx = withProfile(extension.WithGame(ctx, ref.Game), ref.Profile)
+	key, err := s.e.saveKeyFor(ctx, slot)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	return ctx, slot, key, nil
+}
+
+// Export returns the save file of the given save along with the name that the
+// game would give it. If historyID is not empty, the save with that ID is
+// exported from the history instead of the current save.
+func (s *Saves) Export(ctx context.Context, ref SaveRef, historyID string) (name string, file []byte, err error) {
+	ctx, _, key, err := s.resolve(ctx, ref)
+	if err != nil {
+		return "", nil, err
+	}
+
+	save, err := s.e.exportSave(ctx, key, historyID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return saveFileName(save), []byte(save.Data), nil
+}
+
+// Import imports the given save file as the current save and returns its
+// history entry. Clients pick it up on their next sync.
+func (s *Saves) Import(ctx context.Context, ref SaveRef, file []byte) (*HistoryEntry, error) {
+	ctx, slot, key, err := s.resolve(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.e.importSave(ctx, slot, key, file, "")
+}
@@ -0,0 +1,247 @@
+package autosync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"libdb.so/dol-server/extension"
+	"libdb.so/dol-server/internal/retention"
+)
+
+// HistoryConfig describes which history entries are kept. An entry is kept if
+// any of the rules keeps it. If no rule is set, the defaults are used.
+type HistoryConfig struct {
+	// KeepLast is the number of most recent entries to keep.
+	KeepLast int `json:"keep_last"`
+	// KeepDaily is the number of most recent days to keep the last entry of.
+	KeepDaily int `json:"keep_daily"`
+	// KeepWeekly is the number of most recent weeks to keep the last entry
+	// of.
+	KeepWeekly int `json:"keep_weekly"`
+}
+
+var defaultHistoryConfig = HistoryConfig{
+	KeepLast:   20,
+	KeepDaily:  7,
+	KeepWeekly: 4,
+}
+
+// SaveSource describes how a save ended up on the server.
+type SaveSource string
+
+const (
+	// SourceMerge is a save that was merged consistently by a client.
+	SourceMerge SaveSource = "merge"
+	// SourceOverride is a save that a client forced over the server save.
+	SourceOverride SaveSource = "override"
+	// SourceRestore is a save that was restored from the history.
+	SourceRestore SaveSource = "restore"
+	// SourceImport is a save that was imported from a save file.
+	SourceImport SaveSource = "import"
+	// SourceReplicate is a save that was pulled from the peer server.
+	SourceReplicate SaveSource = "replicate"
+)
+
+// HistoryEntry describes a save in the history.
+type HistoryEntry struct {
+	// ID identifies the entry.
+	ID string `json:"id"`
+	// Hash is the hash of the save, the same as the hash returned by merges.
+	Hash string `json:"hash"`
+	// Date is the date of the save in Unix milliseconds.
+	Date int64 `json:"date"`
+	// Source is how the save ended up on the server.
+	Source SaveSource `json:"source"`
+	// Size is the size of the stored entry in bytes.
+	Size int64 `json:"size"`
+	// Summary describes the save. It is only set when a single entry is
+	// returned, or when the history is listed with summaries.
+	Summary *SaveSummary `json:"summary,omitempty"`
+	// Device is the ID of the device that wrote the save, if known. It is set
+	// along with Summary.
+	Device string `json:"device,omitempty"`
+}
+
+// historyIDRegex matches history entry IDs, which are "<date>.<source>.<hash>".
+// Everything about an entry is in its ID, so listing the history does not
+// need to read any save data, except to summarize it.
+var historyIDRegex = regexp.MustCompile(`^([0-9]+)\.([a-z]+)\.([A-Za-z0-9_-]+)$`)
+
+func historyID(date int64, source SaveSource, hash string) string {
+	return fmt.Sprintf("%d.%s.%s", date, source, hash)
+}
+
+func parseHistoryID(id string) (HistoryEntry, bool) {
+	m := historyIDRegex.FindStringSubmatch(id)
+	if m == nil {
+		return HistoryEntry{}, false
+	}
+	date, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return HistoryEntry{}, false
+	}
+	return HistoryEntry{
+		ID:     id,
+		Date:   date,
+		Source: SaveSource(m[2]),
+		Hash:   m[3],
+	}, true
+}
+
+// retention returns the retention rules of the config.
+func (c HistoryConfig) retention() retention.Rules {
+	return retention.Rules{
+		Last:   c.KeepLast,
+		Daily:  c.KeepDaily,
+		Weekly: c.KeepWeekly,
+	}
+}
+
+func (e *autosyncExtension) listHistory(w http.ResponseWriter, r *http.Request) {
+	key, err := e.saveKeyFor(r.Context(), slotFromRequest(r))
+	if err != nil {
+		writeMergeError(w, 400, err)
+		return
+	}
+
+	entries, err := e.store.History(r.Context(), key)
+	if err != nil {
+		writeMergeError(w, 500, err)
+		return
+	}
+
+	type ListHistoryResponse struct {
+		Entries []HistoryEntry `json:"entries"`
+	}
+
+	if entries == nil {
+		entries = []HistoryEntry{}
+	}
+
+	// Summarizing an entry reads and decodes its whole save, so it is only
+	// done if asked for.
+	if r.FormValue("summary") != "" {
+		for i, entry := range entries {
+			_, save, err := e.store.HistoryEntry(r.Context(), key, entry.ID)
+			if err != nil {
+				// The entry may have been pruned or found to be corrupt since
+				// it was listed. It is still listed, just without a summary.
+				continue
+			}
+			entries[i].Summary = e.summaries.get(entry.Hash, save)
+			entries[i].Device = save.Device
+		}
+	}
+
+	writeJSON(w, 200, ListHistoryResponse{Entries: entries})
+}
+
+func (e *autosyncExtension) getHistoryEntry(w http.ResponseWriter, r *http.Request) {
+	key, err := e.saveKeyFor(r.Context(), slotFromRequest(r))
+	if err != nil {
+		writeMergeError(w, 400, err)
+		return
+	}
+
+	entry, save, err := e.store.HistoryEntry(r.Context(), key, chi.URLParam(r, "id"))
+	if err != nil {
+		writeHistoryError(w, err)
+		return
+	}
+	entry.Summary = e.summaries.get(entry.Hash, save)
+	entry.Device = save.Device
+
+	type GetHistoryEntryResponse struct {
+		Entry *HistoryEntry `json:"entry"`
+		Save  *SaveData     `json:"save"`
+	}
+
+	writeJSON(w, 200, GetHistoryEntryResponse{
+		Entry: entry,
+		Save:  save,
+	})
+}
+
+func (e *autosyncExtension) restoreHistoryEntry(w http.ResponseWriter, r *http.Request) {
+	key, err := e.saveKeyFor(r.Context(), slotFromRequest(r))
+	if err != nil {
+		writeMergeError(w, 400, err)
+		return
+	}
+
+	if !e.checkLease(w, r) {
+		return
+	}
+
+	entry, save, err := e.store.HistoryEntry(r.Context(), key, chi.URLParam(r, "id"))
+	if err != nil {
+		writeHistoryError(w, err)
+		return
+	}
+
+	current, err := e.store.Get(r.Context(), key)
+	if err != nil {
+		writeMergeError(w, 500, fmt.Errorf("reading server save data: %w", err))
+		return
+	}
+
+	log := extension.LoggerFromContext(r.Context())
+	log.Info(
+		"restoring autosync data from history",
+		"slot", slotFromRequest(r),
+		"entry", entry.ID)
+
+	// The restored save becomes the newest save, so that clients that are
+	// still on the replaced save notice the change.
+	restored := &SaveData{
+		Data:   save.Data,
+		Date:   time.Now().UnixMilli(),
+		Device: deviceIDFromRequest(r),
+	}
+
+	if _, err := e.putSave(r.Context(), slotFromRequest(r), key, hashData(current), restored, SourceRestore); err != nil {
+		e.writePutError(w, r, key, err)
+		return
+	}
+
+	writeMergeResult(w, 200, MergeOKData{
+		Consistent: false,
+		Hash:       hashData(restored),
+	})
+}
+
+// savesSince returns the number of saves in the history that are newer than
+// the save with the given hash. It returns errNoAncestor if the save is not in
+// the history.
+func (e *autosyncExtension) savesSince(ctx context.Context, key, hash string) (int, error) {
+	if hash == "" {
+		return 0, errNoAncestor
+	}
+
+	entries, err := e.store.History(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, entry := range entries {
+		if entry.Hash == hash {
+			return i, nil
+		}
+	}
+
+	return 0, errNoAncestor
+}
+
+func writeHistoryError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrHistoryEntryNotFound) {
+		writeMergeError(w, 404, err)
+		return
+	}
+	writeMergeError(w, 500, err)
+}
@@ -0,0 +1,224 @@
+package autosync
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"libdb.so/dol-server/extension"
+)
+
+// LeaseConfig configures play session leases. While a tab is open, it holds
+// the lease of its game, and merges from other devices are refused until the
+// lease expires or is taken over.
+type LeaseConfig struct {
+	// Enabled turns leases on. Otherwise, every device can sync at any time.
+	Enabled bool `json:"enabled"`
+	// TTL is how long a lease lasts unless the tab renews it, such as "1m".
+	// Tabs renew their lease three times per TTL. It defaults to 45 seconds.
+	TTL string `json:"ttl"`
+}
+
+// defaultLeaseTTL is how long a lease lasts by default.
+const defaultLeaseTTL = 45 * time.Second
+
+// Lease describes the play session lease of a game.
+type Lease struct {
+	// Holder is the device that holds the lease.
+	Holder *Device `json:"holder"`
+	// Expires is when the lease expires unless it is renewed, in Unix
+	// milliseconds.
+	Expires int64 `json:"expires"`
+	// TTL is how long renewing the lease extends it by, in milliseconds.
+	TTL int64 `json:"ttl"`
+}
+
+// leaseTable keeps the leases of all games in memory. Leases are short-lived,
+// so they are not stored: after a restart, tabs simply take them again.
+type leaseTable struct {
+	ttl time.Duration
+
+	mu     sync.Mutex
+	leases map[string]lease
+}
+
+type lease struct {
+	device  string
+	expires time.Time
+}
+
+func newLeaseTable(cfg LeaseConfig) (*leaseTable, error) {
+	ttl := defaultLeaseTTL
+	if cfg.TTL != "" {
+		var err error
+		ttl, err = time.ParseDuration(cfg.TTL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ttl: %w", err)
+		}
+		if ttl < 5*time.Second {
+			return nil, fmt.Errorf("ttl must be at least 5 seconds")
+		}
+	}
+
+	return &leaseTable{
+		ttl:    ttl,
+		leases: make(map[string]lease),
+	}, nil
+}
+
+// holder returns the lease of the given key if it has not expired.
+func (t *leaseTable) holder(key string) (lease, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.current(key)
+}
+
+// current returns the lease of the given key if it has not expired. Expired
+// leases are removed. t.mu must be held.
+func (t *leaseTable) current(key string) (lease, bool) {
+	l, ok := t.leases[key]
+	if ok && time.Now().After(l.expires) {
+		delete(t.leases, key)
+		return lease{}, false
+	}
+	return l, ok
+}
+
+// acquire gives the lease of the given key to the device, or renews it if the
+// device already holds it. If another device holds the lease, it is only
+// taken from it if takeover is true. It returns the lease of the key, which
+// belongs to another device if the device did not get it, and the device that
+// held the lease before, if any.
+func (t *leaseTable) acquire(key, device string, takeover bool) (l lease, previous string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	current, ok := t.current(key)
+	if ok {
+		previous = current.device
+		if current.device != device && !takeover {
+			return current, previous
+		}
+	}
+
+	l = lease{
+		device:  device,
+		expires: time.Now().Add(t.ttl),
+	}
+	t.leases[key] = l
+	return l, previous
+}
+
+// release gives up the lease of the given key if the device holds it.
+func (t *leaseTable) release(key, device string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if l, ok := t.current(key); ok && l.device == device {
+		delete(t.leases, key)
+	}
+}
+
+// leaseInfo describes the lease for clients.
+func (e *autosyncExtension) leaseInfo(r *http.Request, l lease) Lease {
+	holder, err := e.device(r.Context(), l.device)
+	if err != nil {
+		log := extension.LoggerFromContext(r.Context())
+		log.Warn(
+			"cannot look up the device that holds the lease",
+			"err", err)
+		holder = &Device{ID: l.device}
+	}
+
+	return Lease{
+		Holder:  holder,
+		Expires: l.expires.UnixMilli(),
+		TTL:     e.leases.ttl.Milliseconds(),
+	}
+}
+
+// checkLease returns true if the device that sent the request may write saves
+// of its game. If another device holds the lease of the game, a locked result
+// is written and false is returned. Requests without a device ID come from
+// scripts and other tools rather than from tabs, so they are never locked
+// out; they rely on conflict detection instead.
+func (e *autosyncExtension) checkLease(w http.ResponseWriter, r *http.Request) bool {
+	if e.leases == nil {
+		return true
+	}
+
+	device := deviceIDFromRequest(r)
+	if device == "" {
+		return true
+	}
+
+	l, ok := e.leases.holder(e.gameSaveKey(r.Context()))
+	if !ok || l.device == device {
+		return true
+	}
+
+	writeMergeResult(w, 423, MergeLockedData{Lease: e.leaseInfo(r, l)})
+	return false
+}
+
+type leaseResponse struct {
+	Lease *Lease `json:"lease"`
+}
+
+func (e *autosyncExtension) getLease(w http.ResponseWriter, r *http.Request) {
+	l, ok := e.leases.holder(e.gameSaveKey(r.Context()))
+	if !ok {
+		writeJSON(w, 200, leaseResponse{})
+		return
+	}
+
+	info := e.leaseInfo(r, l)
+	writeJSON(w, 200, leaseResponse{Lease: &info})
+}
+
+// acquireLease takes or renews the lease of the game for the device that sent
+// the request. Tabs call it when they start and then as a heartbeat. If
+// another device holds the lease, a locked result is returned.
+func (e *autosyncExtension) acquireLease(w http.ResponseWriter, r *http.Request) {
+	e.takeLease(w, r, false)
+}
+
+// takeOverLease takes the lease of the game for the device that sent the
+// request, even if another device holds it.
+func (e *autosyncExtension) takeOverLease(w http.ResponseWriter, r *http.Request) {
+	e.takeLease(w, r, true)
+}
+
+func (e *autosyncExtension) takeLease(w http.ResponseWriter, r *http.Request, takeover bool) {
+	device := deviceIDFromRequest(r)
+	if device == "" {
+		writeMergeError(w, 400, fmt.Errorf("missing or invalid %s header", deviceHeader))
+		return
+	}
+
+	l, previous := e.leases.acquire(e.gameSaveKey(r.Context()), device, takeover)
+	if l.device != device {
+		writeMergeResult(w, 423, MergeLockedData{Lease: e.leaseInfo(r, l)})
+		return
+	}
+
+	if previous != "" && previous != device {
+		log := extension.LoggerFromContext(r.Context())
+		log.Info(
+			"play session taken over by another device",
+			"device", device,
+			"previous_device", previous)
+	}
+
+	info := e.leaseInfo(r, l)
+	writeJSON(w, 200, leaseResponse{Lease: &info})
+}
+
+// releaseLease gives up the lease of the game if the device that sent the
+// request holds it. Tabs call it when they are closed.
+func (e *autosyncExtension) releaseLease(w http.ResponseWriter, r *http.Request) {
+	e.leases.release(e.gameSaveKey(r.Context()), deviceIDFromRequest(r))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,196 @@
+package autosync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"libdb.so/dol-server/extension"
+	"libdb.so/dol-server/internal/sugarcube"
+)
+
+// errNoAncestor is returned by findAncestor if the save that the client last
+// synced is not in the history anymore.
+var errNoAncestor = errors.New("last synced save is not in the history")
+
+// findAncestor returns the save with the given hash from the history. This is
+// the save that the client last synced, so it is the last common ancestor of
+// the client and the server save.
+func (e *autosyncExtension) findAncestor(ctx context.Context, key, hash string) (*SaveData, error) {
+	if hash == "" {
+		return nil, errNoAncestor
+	}
+
+	entries, err := e.store.History(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.Hash != hash {
+			continue
+		}
+		_, save, err := e.store.HistoryEntry(ctx, key, entry.ID)
+		if err != nil {
+			return nil, err
+		}
+		return save, nil
+	}
+
+	return nil, errNoAncestor
+}
+
+// mergeSaves merges the variables that were changed in the client save and
+// the server save since their common ancestor. The merged save is the client
+// save with the merged variables, so that the client stays on its current
+// passage. If a variable was changed differently on both sides, the save
+// cannot be merged, and the names of these variables are returned instead.
+func mergeSaves(ancestor, server, client *SaveData) (*SaveData, []string, error) {
+	current := func(data *SaveData) (*sugarcube.Save, *sugarcube.Moment, error) {
+		save, err := sugarcube.Decode(data.Data)
+		if err != nil {
+			return nil, nil, err
+		}
+		moment, err := save.Current()
+		if err != nil {
+			return nil, nil, err
+		}
+		return save, moment, nil
+	}
+
+	_, ancestorMoment, err := current(ancestor)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ancestor save: %w", err)
+	}
+
+	_, serverMoment, err := current(server)
+	if err != nil {
+		return nil, nil, fmt.Errorf("server save: %w", err)
+	}
+
+	clientSave, clientMoment, err := current(client)
+	if err != nil {
+		return nil, nil, fmt.Errorf("client save: %w", err)
+	}
+
+	merged, conflicts := mergeVariables(
+		ancestorMoment.Variables,
+		serverMoment.Variables,
+		clientMoment.Variables)
+	if len(conflicts) > 0 {
+		return nil, conflicts, nil
+	}
+
+	clientMoment.Variables = merged
+
+	data, err := clientSave.Encode()
+	if err != nil {
+		return nil, nil, fmt.Errorf("encoding merged save: %w", err)
+	}
+
+	return &SaveData{
+		Data: data,
+		Date: time.Now().UnixMilli(),
+	}, nil, nil
+}
+
+// mergeVariables does a three-way merge of the given variables. A variable
+// that was only changed on one side takes that side's value. A variable that
+// was changed on both sides is only merged if both sides agree. Deleting a
+// variable counts as changing it.
+func mergeVariables(ancestor, server, client map[string]json.RawMessage) (map[string]json.RawMessage, []string) {
+	merged := make(map[string]json.RawMessage, len(client))
+	var conflicts []string
+
+	names := make(map[string]struct{}, len(client))
+	for _, vars := range []map[string]json.RawMessage{ancestor, server, client} {
+		for name := range vars {
+			names[name] = struct{}{}
+		}
+	}
+
+	for name := range names {
+		a, inAncestor := ancestor[name]
+		s, inServer := server[name]
+		c, inClient := client[name]
+
+		var value json.RawMessage
+		var ok bool
+
+		switch {
+		case sameValue(s, inServer, c, inClient):
+			value, ok = c, inClient
+		case sameValue(a, inAncestor, s, inServer):
+			value, ok = c, inClient
+		case sameValue(a, inAncestor, c, inClient):
+			value, ok = s, inServer
+		default:
+			conflicts = append(conflicts, name)
+			continue
+		}
+
+		if ok {
+			merged[name] = value
+		}
+	}
+
+	sort.Strings(conflicts)
+	return merged, conflicts
+}
+
+// sameValue returns true if both variables are unset or have the same value.
+// Objects are compared by value, since the order of their keys may differ
+// between saves.
+func sameValue(a json.RawMessage, aSet bool, b json.RawMessage, bSet bool) bool {
+	if !aSet || !bSet {
+		return aSet == bSet
+	}
+	if bytes.Equal(a, b) {
+		return true
+	}
+
+	var av, bv any
+	if json.Unmarshal(a, &av) != nil || json.Unmarshal(b, &bv) != nil {
+		return false
+	}
+	return reflect.DeepEqual(av, bv)
+}
+
+// mergeWithServer tries to merge the client save with the newer server save.
+// It returns the merged save, or nil and the names of the conflicting
+// variables if the saves cannot be merged. If the saves cannot be merged for
+// another reason, such as the ancestor being pruned from the history, there
+// are no conflicting variables.
+func (e *autosyncExtension) mergeWithServer(ctx context.Context, key, lastHash string, server, client *SaveData) (*SaveData, []string) {
+	log := extension.LoggerFromContext(ctx)
+
+	ancestor, err := e.findAncestor(ctx, key, lastHash)
+	if err != nil {
+		log.Debug(
+			"cannot merge autosync data without an ancestor",
+			"err", err)
+		return nil, nil
+	}
+
+	merged, conflicts, err := mergeSaves(ancestor, server, client)
+	if err != nil {
+		log.Debug(
+			"cannot merge autosync data",
+			"err", err)
+		return nil, nil
+	}
+
+	if len(conflicts) > 0 {
+		log.Debug(
+			"autosync data has conflicting variables",
+			"conflicts", conflicts)
+		return nil, conflicts
+	}
+
+	return merged, nil
+}
@@ -0,0 +1,199 @@
+package autosync
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+
+	"libdb.so/dol-server/internal/lzstring"
+	"libdb.so/dol-server/internal/sugarcube"
+)
+
+func testVariables(t *testing.T, s string) map[string]json.RawMessage {
+	t.Helper()
+	if s == "" {
+		return nil
+	}
+	var vars map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(s), &vars); err != nil {
+		t.Fatalf("invalid variables %q: %v", s, err)
+	}
+	return vars
+}
+
+func TestMergeVariables(t *testing.T) {
+	tests := []struct {
+		name                     string
+		ancestor, server, client string
+		want                     string
+		conflicts                []string
+	}{
+		{
+			name:     "unchanged",
+			ancestor: `{"money":1}`,
+			server:   `{"money":1}`,
+			client:   `{"money":1}`,
+			want:     `{"money":1}`,
+		},
+		{
+			name:     "changed on the client",
+			ancestor: `{"money":1,"day":1}`,
+			server:   `{"money":1,"day":1}`,
+			client:   `{"money":5,"day":1}`,
+			want:     `{"money":5,"day":1}`,
+		},
+		{
+			name:     "changed on the server",
+			ancestor: `{"money":1,"day":1}`,
+			server:   `{"money":1,"day":2}`,
+			client:   `{"money":1,"day":1}`,
+			want:     `{"money":1,"day":2}`,
+		},
+		{
+			name:     "changed on both sides",
+			ancestor: `{"money":1,"day":1}`,
+			server:   `{"money":1,"day":2}`,
+			client:   `{"money":5,"day":1}`,
+			want:     `{"money":5,"day":2}`,
+		},
+		{
+			name:     "changed the same way",
+			ancestor: `{"money":1}`,
+			server:   `{"money":5}`,
+			client:   `{"money":5}`,
+			want:     `{"money":5}`,
+		},
+		{
+			name:     "objects with reordered keys",
+			ancestor: `{"pc":{"a":1,"b":2}}`,
+			server:   `{"pc":{"b":2,"a":1}}`,
+			client:   `{"pc":{"a":1,"b":3}}`,
+			want:     `{"pc":{"a":1,"b":3}}`,
+		},
+		{
+			name:     "added on the server",
+			ancestor: `{}`,
+			server:   `{"new":true}`,
+			client:   `{}`,
+			want:     `{"new":true}`,
+		},
+		{
+			name:     "deleted on the client",
+			ancestor: `{"old":1,"money":1}`,
+			server:   `{"old":1,"money":2}`,
+			client:   `{"money":1}`,
+			want:     `{"money":2}`,
+		},
+		{
+			name:      "conflict",
+			ancestor:  `{"money":1,"day":1}`,
+			server:    `{"money":2,"day":2}`,
+			client:    `{"money":3,"day":1}`,
+			conflicts: []string{"money"},
+		},
+		{
+			name:      "deleted on one side and changed on the other",
+			ancestor:  `{"money":1}`,
+			server:    `{}`,
+			client:    `{"money":3}`,
+			conflicts: []string{"money"},
+		},
+		{
+			name:      "added differently on both sides",
+			ancestor:  ``,
+			server:    `{"b":1,"a":1}`,
+			client:    `{"b":2,"a":2}`,
+			conflicts: []string{"a", "b"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			merged, conflicts := mergeVariables(
+				testVariables(t, test.ancestor),
+				testVariables(t, test.server),
+				testVariables(t, test.client))
+
+			if !slices.Equal(conflicts, test.conflicts) {
+				t.Fatalf("conflicts are %q, want %q", conflicts, test.conflicts)
+			}
+			if test.conflicts != nil {
+				return
+			}
+
+			want := testVariables(t, test.want)
+			if len(merged) != len(want) {
+				t.Fatalf("merged variables are %s, want %s", mustMarshal(t, merged), test.want)
+			}
+			for name, value := range want {
+				got, ok := merged[name]
+				if !sameValue(got, ok, value, true) {
+					t.Errorf("merged variables are %s, want %s", mustMarshal(t, merged), test.want)
+					break
+				}
+			}
+		})
+	}
+}
+
+func mustMarshal(t *testing.T, v any) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// testSaveData returns a save of a story whose current moment is on the given
+// passage and has the given variables.
+func testSaveData(t *testing.T, passage, vars string) *SaveData {
+	t.Helper()
+	save := `{"id":"dol","state":{"history":[{"title":"` + passage + `","variables":` + vars + `}],"index":0}}`
+	return &SaveData{Data: lzstring.CompressToBase64(save)}
+}
+
+func TestMergeSaves(t *testing.T) {
+	ancestor := testSaveData(t, "Start", `{"money":1,"day":1}`)
+	server := testSaveData(t, "Bed", `{"money":1,"day":2}`)
+	client := testSaveData(t, "Shop", `{"money":5,"day":1}`)
+
+	merged, conflicts, err := mergeSaves(ancestor, server, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conflicts != nil {
+		t.Fatalf("unexpected conflicts %q", conflicts)
+	}
+
+	save, err := sugarcube.Decode(merged.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moment, err := save.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The client stays on its passage.
+	if moment.Title != "Shop" {
+		t.Errorf("merged save is on passage %q, want Shop", moment.Title)
+	}
+	if save.ID != "dol" {
+		t.Errorf("merged save is of story %q, want dol", save.ID)
+	}
+
+	var money, day int
+	if !moment.Variable("money", &money) || !moment.Variable("day", &day) || money != 5 || day != 2 {
+		t.Errorf("merged variables are %s", mustMarshal(t, moment.Variables))
+	}
+
+	conflicting := testSaveData(t, "Bed", `{"money":3,"day":1}`)
+	merged, conflicts, err = mergeSaves(ancestor, conflicting, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged != nil || !slices.Equal(conflicts, []string{"money"}) {
+		t.Errorf("merge of conflicting saves returned %v and conflicts %q", merged, conflicts)
+	}
+}
@@ -0,0 +1,262 @@
+package autosync
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"libdb.so/dol-server/extension"
+)
+
+// ProfilesConfig configures how the user of a request is identified. Every
+// user gets their own profile, which holds all of their saves. If no resolver
+// is set, everyone shares the same saves.
+type ProfilesConfig struct {
+	// Resolver is how the user is identified. It is one of:
+	//
+	//   - "" (the default): everyone shares the same saves.
+	//   - "header": a trusted reverse proxy sets the user in Header.
+	//   - "basic_auth": the user logs in with HTTP basic auth, checked against
+	//     Users.
+	//   - "cookie": the user picks a profile on their first visit, which is
+	//     remembered in a cookie.
+	Resolver string `json:"resolver"`
+	// Header is the header that the reverse proxy sets to the user's name.
+	// Only used by the "header" resolver. It defaults to
+	// "Tailscale-User-Login", which Tailscale Serve sets.
+	Header string `json:"header"`
+	// Users maps user names to passwords. Only used by the "basic_auth"
+	// resolver.
+	Users map[string]string `json:"users"`
+}
+
+// IdentityResolver resolves the profile that a request belongs to.
+type IdentityResolver interface {
+	// ResolveProfile returns the profile name of the request. It returns
+	// errNoProfile if the request does not identify a user.
+	ResolveProfile(r *http.Request) (string, error)
+}
+
+// errNoProfile is returned by an IdentityResolver if the request does not
+// identify a user.
+var errNoProfile = errors.New("no profile selected")
+
+// profileNameRegex matches valid profile names. Profile names are used as
+// directory names, but should still allow e-mail addresses, which is what
+// most proxies identify users with.
+var profileNameRegex = regexp.MustCompile(`^[A-Za-z0-9_@-][A-Za-z0-9._@+-]{0,127}$`)
+
+func validProfileName(profile string) bool {
+	return profileNameRegex.MatchString(profile)
+}
+
+// newIdentityResolver returns the IdentityResolver for the given config.
+func newIdentityResolver(cfg ProfilesConfig) (IdentityResolver, error) {
+	switch cfg.Resolver {
+	case "":
+		return sharedResolver{}, nil
+	case "header":
+		header := cfg.Header
+		if header == "" {
+			header = "Tailscale-User-Login"
+		}
+		return headerResolver{header}, nil
+	case "basic_auth":
+		if len(cfg.Users) == 0 {
+			return nil, fmt.Errorf("basic_auth resolver needs users")
+		}
+		for user := range cfg.Users {
+			if !validProfileName(user) {
+				return nil, fmt.Errorf("invalid user name %q", user)
+			}
+		}
+		return basicAuthResolver{cfg.Users}, nil
+	case "cookie":
+		return cookieResolver{}, nil
+	default:
+		return nil, fmt.Errorf("unknown profile resolver %q", cfg.Resolver)
+	}
+}
+
+// sharedResolver puts everyone in the same unnamed profile.
+type sharedResolver struct{}
+
+func (sharedResolver) ResolveProfile(*http.Request) (string, error) { return "", nil }
+
+// headerResolver trusts a header set by a reverse proxy.
+type headerResolver struct {
+	header string
+}
+
+func (h headerResolver) ResolveProfile(r *http.Request) (string, error) {
+	profile := r.Header.Get(h.header)
+	if profile == "" {
+		return "", errNoProfile
+	}
+	return profile, nil
+}
+
+// basicAuthResolver checks the user's basic auth credentials.
+type basicAuthResolver struct {
+	users map[string]string
+}
+
+func (b basicAuthResolver) ResolveProfile(r *http.Request) (string, error) {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return "", errNoProfile
+	}
+
+	want, ok := b.users[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(pass), []byte(want)) != 1 {
+		return "", errNoProfile
+	}
+
+	return user, nil
+}
+
+// profileCookie is the cookie that the cookie resolver remembers the profile
+// in. It is not scoped to a game, so that all games share the same profile.
+const profileCookie = "dol_autosync_profile"
+
+// cookieResolver uses the profile that the user picked.
+type cookieResolver struct{}
+
+func (cookieResolver) ResolveProfile(r *http.Request) (string, error) {
+	cookie, err := r.Cookie(profileCookie)
+	if err != nil || cookie.Value == "" {
+		return "", errNoProfile
+	}
+	return cookie.Value, nil
+}
+
+type profileCtxKey struct{}
+
+func withProfile(ctx context.Context, profile string) context.Context {
+	return context.WithValue(ctx, profileCtxKey{}, profile)
+}
+
+// profileFromContext returns the profile that the context belongs to. It
+// returns an empty string for the shared profile.
+func profileFromContext(ctx context.Context) string {
+	profile, _ := ctx.Value(profileCtxKey{}).(string)
+	return profile
+}
+
+// requireProfile is a middleware that resolves the profile of the request.
+// Requests without a profile are rejected.
+func (e *autosyncExtension) requireProfile(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		profile, err := e.resolver.ResolveProfile(r)
+		if err == nil && profile != "" && !validProfileName(profile) {
+			err = fmt.Errorf("invalid profile name %q", profile)
+		}
+		if err != nil {
+			if _, ok := e.resolver.(basicAuthResolver); ok {
+				w.Header().Set("WWW-Authenticate", `Basic realm="dol-server", charset="UTF-8"`)
+			}
+			writeMergeError(w, 401, err)
+			return
+		}
+
+		ctx := withProfile(r.Context(), profile)
+		if profile != "" {
+			ctx = extension.WithLogger(ctx, extension.LoggerFromContext(ctx).With("profile", profile))
+		}
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// ProfileInfo describes the profile of the current user.
+type ProfileInfo struct {
+	// Resolver is the configured resolver.
+	Resolver string `json:"resolver"`
+	// Profile is the profile of the current user. It is null if the user
+	// has not picked a profile yet.
+	Profile *string `json:"profile"`
+	// Profiles is the list of existing profiles. It is only returned by the
+	// cookie resolver, since only that resolver lets users pick a profile.
+	Profiles []string `json:"profiles,omitempty"`
+}
+
+func (e *autosyncExtension) getProfile(w http.ResponseWriter, r *http.Request) {
+	info := ProfileInfo{Resolver: e.cfg.Profiles.Resolver}
+
+	if profile, err := e.resolver.ResolveProfile(r); err == nil && validProfileName(profile) {
+		info.Profile = &profile
+	}
+
+	if _, ok := e.resolver.(cookieResolver); ok {
+		profiles, err := e.listProfiles(r.Context())
+		if err != nil {
+			writeMergeError(w, 500, err)
+			return
+		}
+		info.Profiles = profiles
+	}
+
+	writeJSON(w, 200, info)
+}
+
+func (e *autosyncExtension) setProfile(w http.ResponseWriter, r *http.Request) {
+	if _, ok := e.resolver.(cookieResolver); !ok {
+		writeMergeError(w, 400, fmt.Errorf("profiles cannot be picked with the %q resolver", e.cfg.Profiles.Resolver))
+		return
+	}
+
+	var req struct {
+		Profile string `json:"profile"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeMergeError(w, 400, fmt.Errorf("decoding request body: %w", err))
+		return
+	}
+
+	if !validProfileName(req.Profile) {
+		writeMergeError(w, 400, fmt.Errorf("invalid profile name %q", req.Profile))
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     profileCookie,
+		Value:    req.Profile,
+		Path:     "/",
+		MaxAge:   int((10 * 365 * 24 * time.Hour).Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	writeJSON(w, 200, ProfileInfo{
+		Resolver: e.cfg.Profiles.Resolver,
+		Profile:  &req.Profile,
+	})
+}
+
+// listProfiles returns the names of all profiles that have saves.
+func (e *autosyncExtension) listProfiles(ctx context.Context) ([]string, error) {
+	keys, err := e.store.Keys(ctx, "profiles/")
+	if err != nil {
+		return nil, fmt.Errorf("reading profiles: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	profiles := []string{}
+	for _, key := range keys {
+		profile, _, _ := strings.Cut(strings.TrimPrefix(key, "profiles/"), "/")
+		if validProfileName(profile) && !seen[profile] {
+			seen[profile] = true
+			profiles = append(profiles, profile)
+		}
+	}
+	sort.Strings(profiles)
+
+	return profiles, nil
+}
@@ -0,0 +1,607 @@
+package autosync
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"libdb.so/dol-server/extension"
+)
+
+// ReplicationConfig configures replication with another dol-server, such as
+// one on a laptop that is not always online. Both servers pull the saves that
+// the other one has moved ahead on, so both must be configured with each
+// other as the peer.
+type ReplicationConfig struct {
+	// Peer is the URL of the autosync extension of the other server, such as
+	// "http://laptop:19384/x/autosync". Saves are pulled from it.
+	Peer string `json:"peer"`
+	// Token authenticates the servers to each other. Both servers must have
+	// the same token. The replication endpoints are only served if it is set.
+	Token string `json:"token"`
+	// Interval is how often saves are pulled from the peer, such as "1m". It
+	// defaults to 30 seconds.
+	Interval string `json:"interval"`
+}
+
+// defaultReplicationInterval is how often saves are pulled from the peer by
+// default.
+const defaultReplicationInterval = 30 * time.Second
+
+// peerConflictName is the name of the blob that holds a save of the peer that
+// diverged from the local save, relative to the save's key.
+const peerConflictName = "peer-conflict.json"
+
+// ReplicaHead describes the current save of a key. Servers exchange heads to
+// find out which saves they need to pull.
+type ReplicaHead struct {
+	// Key is the store key of the save.
+	Key string `json:"key"`
+	// Hash is the hash of the current save.
+	Hash string `json:"hash"`
+	// History are the hashes of the saves in the history, newest first.
+	History []string `json:"history"`
+}
+
+// peerConflict is a save of the peer that diverged from the local save. It is
+// not resolved by the server, but by the next client that syncs the save.
+type peerConflict struct {
+	// Save is the save of the peer.
+	Save SaveData `json:"save"`
+	// Ancestor is the hash of the newest save that is in the history of both
+	// servers. It is empty if there is none.
+	Ancestor string `json:"ancestor,omitempty"`
+}
+
+// parseSaveKey parses a store key as returned by saveKeyFor into the key of
+// its game and its slot. It returns false if key is not a valid save key.
+func parseSaveKey(key string) (gameKey, slot string, ok bool) {
+	if key == "" {
+		return "", AutosaveSlot, true
+	}
+
+	parts := strings.Split(key, "/")
+	i := 0
+	if i+1 < len(parts) && parts[i] == "profiles" {
+		if !validProfileName(parts[i+1]) {
+			return "", "", false
+		}
+		i += 2
+	}
+	if i+1 < len(parts) && parts[i] == "games" {
+		if game := parts[i+1]; game == "" || game == "." || game == ".." {
+			return "", "", false
+		}
+		i += 2
+	}
+
+	gameKey = strings.Join(parts[:i], "/")
+	slot = AutosaveSlot
+
+	if i+1 < len(parts) && parts[i] == "slots" {
+		if !validSlotName(parts[i+1]) {
+			return "", "", false
+		}
+		slot = parts[i+1]
+		i += 2
+	}
+
+	return gameKey, slot, i == len(parts)
+}
+
+// PeerConflict returns the save of the peer that diverged from the current
+// save, or nil if there is none.
+func (s *saveStore) PeerConflict(ctx context.Context, key string) (*peerConflict, error) {
+	unlock, err := s.lock(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	b, err := s.blobs.get(ctx, path.Join(key, peerConflictName))
+	if err != nil {
+		if errors.Is(err, errBlobNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("reading peer conflict: %w", err)
+	}
+
+	b, err = s.open(b)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting peer conflict: %w", err)
+	}
+
+	var conflict peerConflict
+	if err := json.Unmarshal(b, &conflict); err != nil {
+		return nil, fmt.Errorf("decoding peer conflict: %w", err)
+	}
+
+	return &conflict, nil
+}
+
+// SetPeerConflict stores the save of the peer that diverged from the current
+// save. If conflict is nil, the stored conflict is removed.
+func (s *saveStore) SetPeerConflict(ctx context.Context, key string, conflict *peerConflict) error {
+	unlock, err := s.lock(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	name := path.Join(key, peerConflictName)
+
+	if conflict == nil {
+		if err := s.blobs.delete(ctx, name); err != nil {
+			return fmt.Errorf("deleting peer conflict: %w", err)
+		}
+		return nil
+	}
+
+	b, err := json.Marshal(conflict)
+	if err != nil {
+		return fmt.Errorf("encoding peer conflict: %w", err)
+	}
+
+	b, err = s.seal(b)
+	if err != nil {
+		return fmt.Errorf("encrypting peer conflict: %w", err)
+	}
+
+	if err := s.blobs.put(ctx, name, b); err != nil {
+		return fmt.Errorf("writing peer conflict: %w", err)
+	}
+
+	return nil
+}
+
+// AddHistory adds the save to the history without making it the current
+// save. Saves that are already in the history are not added again.
+func (s *saveStore) AddHistory(ctx context.Context, key string, data *SaveData, source SaveSource) error {
+	unlock, err := s.lock(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	entries, err := s.listHistory(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	hash := hashData(data)
+	for _, entry := range entries {
+		if entry.Hash == hash {
+			return nil
+		}
+	}
+
+	_, err = s.addHistory(ctx, key, data, source)
+	return err
+}
+
+// requireReplicationToken only lets requests with the replication token
+// through.
+func (e *autosyncExtension) requireReplicationToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(e.cfg.Replication.Token)) != 1 {
+			writeMergeError(w, 401, fmt.Errorf("invalid replication token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (e *autosyncExtension) listReplicaHeads(w http.ResponseWriter, r *http.Request) {
+	keys, err := e.store.Keys(r.Context(), "")
+	if err != nil {
+		writeMergeError(w, 500, err)
+		return
+	}
+
+	heads := make([]ReplicaHead, 0, len(keys))
+	for _, key := range keys {
+		save, err := e.store.Get(r.Context(), key)
+		if err != nil {
+			writeMergeError(w, 500, fmt.Errorf("reading save %q: %w", key, err))
+			return
+		}
+		if save == nil {
+			continue
+		}
+
+		entries, err := e.store.History(r.Context(), key)
+		if err != nil {
+			writeMergeError(w, 500, fmt.Errorf("reading history of %q: %w", key, err))
+			return
+		}
+
+		head := ReplicaHead{
+			Key:     key,
+			Hash:    hashData(save),
+			History: make([]string, len(entries)),
+		}
+		for i, entry := range entries {
+			head.History[i] = entry.Hash
+		}
+
+		heads = append(heads, head)
+	}
+
+	type ListReplicaHeadsResponse struct {
+		Heads []ReplicaHead `json:"heads"`
+	}
+
+	writeJSON(w, 200, ListReplicaHeadsResponse{Heads: heads})
+}
+
+func (e *autosyncExtension) getReplicaSave(w http.ResponseWriter, r *http.Request) {
+	key := r.FormValue("key")
+	if _, _, ok := parseSaveKey(key); !ok {
+		writeMergeError(w, 400, fmt.Errorf("invalid save key %q", key))
+		return
+	}
+
+	save, err := e.store.Get(r.Context(), key)
+	if err != nil {
+		writeMergeError(w, 500, fmt.Errorf("reading server save data: %w", err))
+		return
+	}
+	if save == nil {
+		writeMergeError(w, 404, ErrNoSave)
+		return
+	}
+
+	type GetReplicaSaveResponse struct {
+		Save *SaveData `json:"save"`
+	}
+
+	writeJSON(w, 200, GetReplicaSaveResponse{Save: save})
+}
+
+// peerClient talks to the replication endpoints of the peer.
+type peerClient struct {
+	url      *url.URL
+	token    string
+	interval time.Duration
+	client   *http.Client
+}
+
+func newPeerClient(cfg ReplicationConfig) (*peerClient, error) {
+	if cfg.Token == "" {
+		return nil, fmt.Errorf("a token is required to replicate with a peer")
+	}
+
+	u, err := url.Parse(cfg.Peer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("peer URL must be an http or https URL")
+	}
+
+	interval := defaultReplicationInterval
+	if cfg.Interval != "" {
+		interval, err = time.ParseDuration(cfg.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid interval: %w", err)
+		}
+		if interval < time.Second {
+			return nil, fmt.Errorf("interval must be at least a second")
+		}
+	}
+
+	return &peerClient{
+		url:      u,
+		token:    cfg.Token,
+		interval: interval,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (p *peerClient) get(ctx context.Context, endpoint string, query url.Values, v any) error {
+	u := p.url.JoinPath(endpoint)
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		var result struct {
+			Data MergeErrorData `json:"data"`
+		}
+		json.NewDecoder(resp.Body).Decode(&result)
+		return fmt.Errorf("peer returned %s: %s", resp.Status, result.Data.Error)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("decoding peer response: %w", err)
+	}
+
+	return nil
+}
+
+func (p *peerClient) heads(ctx context.Context) ([]ReplicaHead, error) {
+	var resp struct {
+		Heads []ReplicaHead `json:"heads"`
+	}
+	if err := p.get(ctx, "replication/heads", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Heads, nil
+}
+
+func (p *peerClient) save(ctx context.Context, key string) (*SaveData, error) {
+	var resp struct {
+		Save *SaveData `json:"save"`
+	}
+	if err := p.get(ctx, "replication/save", url.Values{"key": {key}}, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Save == nil {
+		return nil, ErrNoSave
+	}
+	return resp.Save, nil
+}
+
+// replicate pulls saves from the peer until ctx is done.
+func (e *autosyncExtension) replicate(ctx context.Context) {
+	log := extension.LoggerFromContext(ctx).With("peer", e.peer.url.Redacted())
+
+	ticker := time.NewTicker(e.peer.interval)
+	defer ticker.Stop()
+
+	var peerDown bool
+	for {
+		err := e.pullFromPeer(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// The peer is often a laptop that is offline, so only log when it
+		// comes and goes.
+		switch {
+		case err != nil && !peerDown:
+			log.Warn(
+				"cannot replicate autosync data with the peer, will keep trying",
+				"err", err)
+			peerDown = true
+		case err == nil && peerDown:
+			log.Info("replicating autosync data with the peer again")
+			peerDown = false
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pullFromPeer pulls the saves that the peer has moved ahead on. Saves that
+// diverged are stored as peer conflicts. It only returns an error if the
+// peer cannot be reached; errors of single saves are logged.
+func (e *autosyncExtension) pullFromPeer(ctx context.Context) error {
+	heads, err := e.peer.heads(ctx)
+	if err != nil {
+		return err
+	}
+
+	log := extension.LoggerFromContext(ctx)
+
+	for _, head := range heads {
+		if err := e.pullSaveFromPeer(ctx, head); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Warn(
+				"cannot replicate autosync data from the peer",
+				"key", head.Key,
+				"err", err)
+		}
+	}
+
+	return nil
+}
+
+// pullSaveFromPeer compares the local save with the head of the peer. This
+// is the same comparison as in handleMerge, with the peer as the client and
+// the histories telling which save the other side last had:
+//
+//   - If the local save is in the peer's history, the peer is ahead and its
+//     save replaces the local one.
+//   - If the peer's save is in the local history, the peer is behind and
+//     pulls the local save itself.
+//   - Otherwise, both saves changed. The peer's save is kept as a peer
+//     conflict for the next client to resolve.
+func (e *autosyncExtension) pullSaveFromPeer(ctx context.Context, head ReplicaHead) error {
+	gameKey, slot, ok := parseSaveKey(head.Key)
+	if !ok {
+		return fmt.Errorf("invalid save key")
+	}
+
+	local, err := e.store.Get(ctx, head.Key)
+	if err != nil {
+		return fmt.Errorf("reading local save: %w", err)
+	}
+	localHash := hashData(local)
+
+	if localHash == head.Hash {
+		return e.store.SetPeerConflict(ctx, head.Key, nil)
+	}
+
+	var localHistory []string
+	if local != nil {
+		entries, err := e.store.History(ctx, head.Key)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			localHistory = append(localHistory, entry.Hash)
+		}
+	}
+
+	if slices.Contains(localHistory, head.Hash) {
+		return nil
+	}
+
+	save, err := e.peer.save(ctx, head.Key)
+	if err != nil {
+		return fmt.Errorf("pulling save: %w", err)
+	}
+	if hashData(save) != head.Hash {
+		// The save changed on the peer in the meantime. It is pulled in
+		// the next round.
+		return nil
+	}
+
+	log := extension.LoggerFromContext(ctx).With(
+		"key", head.Key,
+		"peer_hash", stringMaxLen(head.Hash, 8),
+		"local_hash", stringMaxLen(localHash, 8))
+
+	if local == nil || slices.Contains(head.History, localHash) {
+		entry, err := e.store.Put(ctx, head.Key, localHash, save, SourceReplicate)
+		if err != nil {
+			if errors.Is(err, ErrSaveChanged) {
+				return nil
+			}
+			return fmt.Errorf("writing save: %w", err)
+		}
+
+		log.Debug("pulled newer autosync data from the peer")
+		e.publishSave(gameKey, slot, entry, SourceReplicate, nil)
+
+		return e.store.SetPeerConflict(ctx, head.Key, nil)
+	}
+
+	conflict := &peerConflict{Save: *save}
+	for _, hash := range localHistory {
+		if slices.Contains(head.History, hash) {
+			conflict.Ancestor = hash
+			break
+		}
+	}
+
+	if prev, err := e.store.PeerConflict(ctx, head.Key); err == nil && prev != nil && hashData(&prev.Save) == head.Hash {
+		return nil
+	}
+
+	if err := e.store.SetPeerConflict(ctx, head.Key, conflict); err != nil {
+		return err
+	}
+
+	log.Info("autosync data diverged from the peer, the next client to sync will resolve it")
+	return nil
+}
+
+// mergePeerConflict merges the client save with the save of the peer that
+// diverged from the current save, just like handleMerge merges a client save
+// with a newer server save. The client save must be consistent with the
+// current save. It returns false if there is no peer conflict, in which case
+// nothing is written to w.
+func (e *autosyncExtension) mergePeerConflict(w http.ResponseWriter, r *http.Request, slot, key string, serverSave *SaveData, clientSave *saveDataRequest) bool {
+	ctx := r.Context()
+	log := extension.LoggerFromContext(ctx)
+
+	conflict, err := e.store.PeerConflict(ctx, key)
+	if err != nil {
+		log.Warn(
+			"cannot read the peer conflict of the autosync data",
+			"err", err)
+		return false
+	}
+	if conflict == nil {
+		return false
+	}
+
+	// A client that loaded the peer's save resolves the conflict as it is.
+	data := &clientSave.SaveData
+	var merged *SaveData
+
+	if hashData(data) != hashData(&conflict.Save) {
+		var conflicts []string
+		merged, conflicts = e.mergeWithServer(ctx, key, conflict.Ancestor, &conflict.Save, data)
+		if merged == nil {
+			// The client is shown the peer's save, but with the hash of the
+			// local save, so that loading the peer's save is consistent.
+			result := e.conflictData(ctx, key, &conflict.Save, clientSave)
+			result.ServerHash = hashData(serverSave)
+			result.ConflictingKeys = conflicts
+			result.Writer = nil
+			result.SavesAhead = nil
+			result.Peer = true
+			writeMergeResult(w, 409, result)
+			return true
+		}
+		merged.Device = clientSave.Device
+		data = merged
+	}
+
+	if _, err := e.putSave(ctx, slot, key, hashData(serverSave), data, SourceMerge); err != nil {
+		e.writePutError(w, r, key, err)
+		return true
+	}
+
+	e.resolvePeerConflict(ctx, key, conflict)
+
+	writeMergeResult(w, 200, MergeOKData{
+		Consistent: merged == nil,
+		Hash:       hashData(data),
+		Save:       merged,
+	})
+	return true
+}
+
+// resolvePeerConflict removes the peer conflict of the save after a client
+// wrote a new save. The peer's save is added to the history, so that the peer
+// sees that the new save replaces it and pulls it. If conflict is nil, it is
+// read from the store.
+func (e *autosyncExtension) resolvePeerConflict(ctx context.Context, key string, conflict *peerConflict) {
+	log := extension.LoggerFromContext(ctx)
+
+	if conflict == nil {
+		var err error
+		conflict, err = e.store.PeerConflict(ctx, key)
+		if err != nil {
+			log.Warn(
+				"cannot read the peer conflict of the autosync data",
+				"err", err)
+			return
+		}
+		if conflict == nil {
+			return
+		}
+	}
+
+	if err := e.store.AddHistory(ctx, key, &conflict.Save, SourceReplicate); err != nil {
+		log.Warn(
+			"cannot add the save of the peer to the history",
+			"err", err)
+		return
+	}
+
+	if err := e.store.SetPeerConflict(ctx, key, nil); err != nil {
+		log.Warn(
+			"cannot remove the peer conflict of the autosync data",
+			"err", err)
+	}
+}
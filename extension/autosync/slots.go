@@ -0,0 +1,114 @@
+package autosync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// AutosaveSlot is the slot of the autosave. Routes without a slot act on it.
+const AutosaveSlot = "autosave"
+
+// slotNameRegex matches valid slot names. Slot names are used as directory
+// names, so they are kept short and simple.
+var slotNameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,63}$`)
+
+// errInvalidSlot is returned if a slot name is not valid.
+var errInvalidSlot = errors.New("invalid slot name")
+
+// reservedSlotNames are names that cannot be used as slots, because they
+// would clash with other routes.
+var reservedSlotNames = map[string]bool{
+	"summary": true,
+}
+
+func validSlotName(slot string) bool {
+	return slotNameRegex.MatchString(slot) && !reservedSlotNames[slot]
+}
+
+// slotFromRequest returns the slot that the request is for.
+func slotFromRequest(r *http.Request) string {
+	if slot := chi.URLParam(r, "slot"); slot != "" {
+		return slot
+	}
+	return AutosaveSlot
+}
+
+// SlotInfo describes a slot that has a save on the server.
+type SlotInfo struct {
+	// Slot is the name of the slot.
+	Slot string `json:"slot"`
+	// Hash is the hash of the slot's save.
+	Hash string `json:"hash"`
+	// Date is the date of the slot's save in Unix milliseconds.
+	Date int64 `json:"date"`
+}
+
+func (e *autosyncExtension) listSlots(w http.ResponseWriter, r *http.Request) {
+	slotsKey := path.Join(e.gameSaveKey(r.Context()), "slots") + "/"
+
+	keys, err := e.store.Keys(r.Context(), slotsKey)
+	if err != nil {
+		writeMergeError(w, 500, fmt.Errorf("reading slots: %w", err))
+		return
+	}
+
+	slots := []string{AutosaveSlot}
+	for _, key := range keys {
+		slot := strings.TrimPrefix(key, slotsKey)
+		if validSlotName(slot) && slot != AutosaveSlot {
+			slots = append(slots, slot)
+		}
+	}
+
+	infos := make([]SlotInfo, 0, len(slots))
+	for _, slot := range slots {
+		info, err := e.slotInfo(r.Context(), slot)
+		if err != nil {
+			writeMergeError(w, 500, fmt.Errorf("slot %q: %w", slot, err))
+			return
+		}
+		if info != nil {
+			infos = append(infos, *info)
+		}
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Slot < infos[j].Slot
+	})
+
+	type ListSlotsResponse struct {
+		Slots []SlotInfo `json:"slots"`
+	}
+
+	writeJSON(w, 200, ListSlotsResponse{Slots: infos})
+}
+
+// slotInfo returns the info of the given slot, or nil if the slot has no save.
+func (e *autosyncExtension) slotInfo(ctx context.Context, slot string) (*SlotInfo, error) {
+	key, err := e.saveKeyFor(ctx, slot)
+	if err != nil {
+		return nil, err
+	}
+
+	save, err := e.store.Get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("reading server save data: %w", err)
+	}
+	if save == nil {
+		return nil, nil
+	}
+
+	return &SlotInfo{
+		Slot: slot,
+		Hash: hashData(save),
+		Date: save.Date,
+	}, nil
+}
@@ -0,0 +1,727 @@
+package autosync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+	"libdb.so/dol-server/extension"
+)
+
+// SaveStore stores saves along with their history. Saves are addressed by a
+// key, which is a slash-separated path such as "profiles/alice/games/beta" or
+// "slots/1". The autosave of the shared profile and the unnamed game has the
+// empty key.
+type SaveStore interface {
+	// Get returns the current save, or nil if there is none.
+	Get(ctx context.Context, key string) (*SaveData, error)
+	// Put replaces the current save and adds it to the history, but only if
+	// the hash of the current save is still prevHash, which is empty if there
+	// is no save. Otherwise, it returns ErrSaveChanged.
+	Put(ctx context.Context, key, prevHash string, data *SaveData, source SaveSource) (*HistoryEntry, error)
+	// History returns all history entries, newest first.
+	History(ctx context.Context, key string) ([]HistoryEntry, error)
+	// HistoryEntry returns the history entry with the given ID and its save.
+	// It returns ErrHistoryEntryNotFound if there is no such entry.
+	HistoryEntry(ctx context.Context, key, id string) (*HistoryEntry, *SaveData, error)
+	// Keys returns the keys of all saves whose key starts with prefix.
+	Keys(ctx context.Context, prefix string) ([]string, error)
+	// Close closes the store.
+	Close() error
+}
+
+var (
+	// ErrSaveChanged is returned by SaveStore.Put if the current save is not
+	// the one that the caller expected.
+	ErrSaveChanged = errors.New("save was changed in the meantime")
+	// ErrHistoryEntryNotFound is returned if a history entry does not exist.
+	ErrHistoryEntryNotFound = errors.New("history entry not found")
+)
+
+// StoreConfig configures where saves are stored.
+type StoreConfig struct {
+	// Type is the type of the store. It is one of:
+	//
+	//   - "fs" (the default): saves are stored as files in SavePath.
+	//   - "sqlite": saves are stored in an SQLite database at Path.
+	//   - "s3": saves are stored in an S3-compatible bucket.
+	Type string `json:"type"`
+	// Path is the path to the SQLite database. It defaults to autosync.db in
+	// SavePath.
+	Path string `json:"path"`
+	// S3 configures the "s3" store.
+	S3 S3Config `json:"s3"`
+}
+
+// newSaveStore returns the SaveStore described by the config.
+func newSaveStore(cfg Config) (*saveStore, error) {
+	var blobs blobStore
+	var err error
+
+	switch cfg.Store.Type {
+	case "", "fs":
+		blobs, err = newFSBlobStore(cfg.SavePath)
+	case "sqlite":
+		path := cfg.Store.Path
+		if path == "" {
+			path = filepath.Join(cfg.SavePath, "autosync.db")
+		}
+		blobs, err = newSQLiteBlobStore(path)
+	case "s3":
+		blobs, err = newS3BlobStore(cfg.Store.S3)
+	default:
+		return nil, fmt.Errorf("unknown store type %q", cfg.Store.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s := &saveStore{
+		blobs:    blobs,
+		history:  cfg.History,
+		storeSem: semaphore.NewWeighted(storeSemWeight),
+		locks:    make(map[string]chan struct{}),
+	}
+
+	if cfg.Encryption.enabled() {
+		secret, err := loadEncryptionSecret(cfg.Encryption)
+		if err != nil {
+			blobs.close()
+			return nil, fmt.Errorf("encryption: %w", err)
+		}
+
+		salt, err := loadEncryptionSalt(context.Background(), blobs)
+		if err != nil {
+			blobs.close()
+			return nil, fmt.Errorf("encryption: %w", err)
+		}
+
+		s.cipher = newSaveCipher([]encryptionSecret{secret}, salt)
+	}
+
+	return s, nil
+}
+
+// blobStore is the storage that saveStore keeps its saves in. Blobs are
+// addressed by slash-separated names.
+type blobStore interface {
+	// get returns the blob, or errBlobNotFound if it does not exist.
+	get(ctx context.Context, name string) ([]byte, error)
+	// put replaces the blob. Readers must either see the old or the new blob.
+	put(ctx context.Context, name string, b []byte) error
+	// delete deletes the blob. Deleting a blob that does not exist is not an
+	// error.
+	delete(ctx context.Context, name string) error
+	// list returns all blobs whose name starts with prefix.
+	list(ctx context.Context, prefix string) ([]blobInfo, error)
+	// lock locks the save with the given key against other processes. Stores
+	// that cannot be shared between processes do nothing.
+	lock(ctx context.Context, key string) (unlock func(), err error)
+	// lockStore locks the whole store against other processes. Locking a save
+	// waits until the store is unlocked.
+	lockStore(ctx context.Context) (unlock func(), err error)
+	// close closes the store.
+	close() error
+}
+
+type blobInfo struct {
+	name string
+	size int64
+}
+
+// errBlobNotFound is returned by blobStore.get if a blob does not exist.
+var errBlobNotFound = errors.New("blob not found")
+
+// versionedBlobStore is a blobStore that can replace a blob only if it did not
+// change since it was read. Stores that cannot lock saves against other
+// processes implement it, so that putting a save stays a compare-and-swap
+// even if the store is shared.
+type versionedBlobStore interface {
+	blobStore
+	// getVersion is like get, but also returns the version of the blob.
+	getVersion(ctx context.Context, name string) ([]byte, string, error)
+	// putVersion replaces the blob, but only if its version is still version,
+	// which is empty if the blob must not exist yet. Otherwise, it returns
+	// errBlobChanged.
+	putVersion(ctx context.Context, name string, b []byte, version string) error
+}
+
+// errBlobChanged is returned by versionedBlobStore.putVersion if the blob was
+// changed in the meantime.
+var errBlobChanged = errors.New("blob was changed in the meantime")
+
+const (
+	// currentSaveName is the name of the blob of the current save, relative to
+	// its key.
+	currentSaveName = "autosync.dat"
+	// historyDirName is the directory of the history blobs, relative to the
+	// key.
+	historyDirName = "history"
+)
+
+// saveLockTimeout is how long to wait for a save to be unlocked.
+const saveLockTimeout = 5 * time.Second
+
+// storeSemWeight is the weight of saveStore.storeSem. It is more than the
+// number of saves that can ever be locked at once.
+const storeSemWeight = 1 << 30
+
+// saveStore implements SaveStore on top of a blobStore. It takes care of
+// checksums, corruption recovery and history retention, so that every
+// backend behaves the same.
+type saveStore struct {
+	blobs   blobStore
+	history HistoryConfig
+	// cipher encrypts blobs. It is nil if encryption is not configured.
+	cipher *saveCipher
+
+	// storeSem is held with a weight of 1 while a save is locked, and with
+	// all of its weight while the whole store is locked. Unlike a
+	// sync.RWMutex, waiting for it can be cancelled.
+	storeSem *semaphore.Weighted
+	locksMu  sync.Mutex
+	locks    map[string]chan struct{}
+}
+
+var _ SaveStore = (*saveStore)(nil)
+
+// lock locks the save with the given key, both within this process and
+// against other processes sharing the store.
+func (s *saveStore) lock(ctx context.Context, key string) (unlock func(), err error) {
+	ctx, cancel := context.WithTimeout(ctx, saveLockTimeout)
+	defer cancel()
+
+	if err := s.storeSem.Acquire(ctx, 1); err != nil {
+		return nil, fmt.Errorf("acquiring save lock: %w", err)
+	}
+
+	s.locksMu.Lock()
+	l, ok := s.locks[key]
+	if !ok {
+		l = make(chan struct{}, 1)
+		s.locks[key] = l
+	}
+	s.locksMu.Unlock()
+
+	select {
+	case l <- struct{}{}:
+	case <-ctx.Done():
+		s.storeSem.Release(1)
+		return nil, fmt.Errorf("acquiring save lock: %w", ctx.Err())
+	}
+
+	unlockBlobs, err := s.blobs.lock(ctx, key)
+	if err != nil {
+		<-l
+		s.storeSem.Release(1)
+		return nil, fmt.Errorf("acquiring save lock: %w", err)
+	}
+
+	return func() {
+		unlockBlobs()
+		<-l
+		s.storeSem.Release(1)
+	}, nil
+}
+
+// lockStore locks every save in the store, both within this process and
+// against other processes sharing the store, such as while the store is being
+// backed up or restored.
+func (s *saveStore) lockStore(ctx context.Context) (unlock func(), err error) {
+	if err := s.storeSem.Acquire(ctx, storeSemWeight); err != nil {
+		return nil, fmt.Errorf("acquiring store lock: %w", err)
+	}
+
+	unlockBlobs, err := s.blobs.lockStore(ctx)
+	if err != nil {
+		s.storeSem.Release(storeSemWeight)
+		return nil, fmt.Errorf("acquiring store lock: %w", err)
+	}
+
+	return func() {
+		unlockBlobs()
+		s.storeSem.Release(storeSemWeight)
+	}, nil
+}
+
+// Get implements SaveStore.
+func (s *saveStore) Get(ctx context.Context, key string) (*SaveData, error) {
+	unlock, err := s.lock(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return s.get(ctx, key)
+}
+
+// Put implements SaveStore.
+func (s *saveStore) Put(ctx context.Context, key, prevHash string, data *SaveData, source SaveSource) (*HistoryEntry, error) {
+	unlock, err := s.lock(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	current, version, err := s.getVersion(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if hashData(current) != prevHash {
+		return nil, ErrSaveChanged
+	}
+
+	b, err := s.encode(data)
+	if err != nil {
+		return nil, fmt.Errorf("encoding save data: %w", err)
+	}
+
+	// The history is written first, so that a save never becomes current
+	// without its history entry. Three-way merges need it as the ancestor.
+	entry, err := s.addHistory(ctx, key, data, source)
+	if err != nil {
+		return nil, fmt.Errorf("adding save to history: %w", err)
+	}
+
+	if err := s.putVersion(ctx, key, b, version); err != nil {
+		// The save never became current, so it does not belong in the
+		// history either.
+		if err := s.blobs.delete(ctx, historyBlobName(key, entry.ID)); err != nil {
+			log := extension.LoggerFromContext(ctx)
+			log.Warn(
+				"cannot delete the history entry of a save that was not written",
+				"key", key,
+				"entry", entry.ID,
+				"err", err)
+		}
+
+		if errors.Is(err, errBlobChanged) {
+			return nil, ErrSaveChanged
+		}
+		return nil, fmt.Errorf("writing save: %w", err)
+	}
+
+	return entry, nil
+}
+
+// History implements SaveStore.
+func (s *saveStore) History(ctx context.Context, key string) ([]HistoryEntry, error) {
+	unlock, err := s.lock(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return s.listHistory(ctx, key)
+}
+
+// HistoryEntry implements SaveStore.
+func (s *saveStore) HistoryEntry(ctx context.Context, key, id string) (*HistoryEntry, *SaveData, error) {
+	unlock, err := s.lock(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+
+	return s.readHistoryEntry(ctx, key, id)
+}
+
+// Keys implements SaveStore.
+func (s *saveStore) Keys(ctx context.Context, prefix string) ([]string, error) {
+	blobs, err := s.blobs.list(ctx, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("listing saves: %w", err)
+	}
+
+	var keys []string
+	for _, blob := range blobs {
+		if path.Base(blob.name) != currentSaveName {
+			continue
+		}
+		key := path.Dir(blob.name)
+		if key == "." {
+			key = ""
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// Close implements SaveStore.
+func (s *saveStore) Close() error {
+	return s.blobs.close()
+}
+
+// get reads the current save. If the save is corrupt, it is replaced with the
+// newest good save from the history. The save must be locked.
+func (s *saveStore) get(ctx context.Context, key string) (*SaveData, error) {
+	name := path.Join(key, currentSaveName)
+
+	b, err := s.blobs.get(ctx, name)
+	if err != nil {
+		if errors.Is(err, errBlobNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("reading save: %w", err)
+	}
+
+	data, err := s.decode(b)
+	if err == nil {
+		return data, nil
+	}
+	if !errors.Is(err, errCorruptSave) {
+		return nil, fmt.Errorf("reading save: %w", err)
+	}
+
+	return s.recover(ctx, key, b, err)
+}
+
+// getVersion is like get, but also returns the version of the current save's
+// blob if the store is a versionedBlobStore. The version is empty otherwise, or
+// if there is no save.
+func (s *saveStore) getVersion(ctx context.Context, key string) (*SaveData, string, error) {
+	blobs, ok := s.blobs.(versionedBlobStore)
+	if !ok {
+		data, err := s.get(ctx, key)
+		return data, "", err
+	}
+
+	name := path.Join(key, currentSaveName)
+
+	b, version, err := blobs.getVersion(ctx, name)
+	if err != nil {
+		if errors.Is(err, errBlobNotFound) {
+			return nil, "", nil
+		}
+		return nil, "", fmt.Errorf("reading save: %w", err)
+	}
+
+	data, err := s.decode(b)
+	if err == nil {
+		return data, version, nil
+	}
+	if !errors.Is(err, errCorruptSave) {
+		return nil, "", fmt.Errorf("reading save: %w", err)
+	}
+
+	if data, err = s.recover(ctx, key, b, err); err != nil {
+		return nil, "", err
+	}
+
+	// Recovering replaced the blob, so its version changed.
+	_, version, err = blobs.getVersion(ctx, name)
+	if err != nil && !errors.Is(err, errBlobNotFound) {
+		return nil, "", fmt.Errorf("reading save: %w", err)
+	}
+
+	return data, version, nil
+}
+
+// putVersion replaces the current save. If the store is a versionedBlobStore,
+// it is only replaced if its blob still has the given version.
+func (s *saveStore) putVersion(ctx context.Context, key string, b []byte, version string) error {
+	name := path.Join(key, currentSaveName)
+
+	if blobs, ok := s.blobs.(versionedBlobStore); ok {
+		return blobs.putVersion(ctx, name, b, version)
+	}
+	return s.blobs.put(ctx, name, b)
+}
+
+// recover replaces the corrupt current save with the newest good save from
+// the history. The corrupt save is kept next to it for inspection. If there is
+// no good save, the store acts as if there was no save, so that the next
+// client can upload theirs.
+func (s *saveStore) recover(ctx context.Context, key string, corrupt []byte, corruptErr error) (*SaveData, error) {
+	name := path.Join(key, currentSaveName)
+	log := extension.LoggerFromContext(ctx).With(
+		"save", name,
+		"err", corruptErr)
+
+	corruptName := fmt.Sprintf("%s.corrupt-%d", name, time.Now().UnixMilli())
+	if err := s.blobs.put(ctx, corruptName, corrupt); err != nil {
+		return nil, fmt.Errorf("keeping corrupt save: %w", err)
+	}
+
+	entry, data, err := s.newestGoodHistoryEntry(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("finding last good save: %w", err)
+	}
+
+	if data == nil {
+		if err := s.blobs.delete(ctx, name); err != nil {
+			return nil, fmt.Errorf("deleting corrupt save: %w", err)
+		}
+
+		log.Error(
+			"AUTOSYNC SAVE IS CORRUPT and there is no good copy in the history, "+
+				"the next save from a client will replace it",
+			"corrupt_save", corruptName)
+		return nil, nil
+	}
+
+	b, err := s.encode(data)
+	if err != nil {
+		return nil, fmt.Errorf("encoding last good save: %w", err)
+	}
+
+	if err := s.blobs.put(ctx, name, b); err != nil {
+		return nil, fmt.Errorf("restoring last good save: %w", err)
+	}
+
+	log.Error(
+		"AUTOSYNC SAVE IS CORRUPT, restored the last good copy from the history",
+		"corrupt_save", corruptName,
+		"restored_entry", entry.ID,
+		"restored_date", time.UnixMilli(entry.Date))
+
+	return data, nil
+}
+
+// newestGoodHistoryEntry returns the newest history entry that is not
+// corrupt, or nil if there is none.
+func (s *saveStore) newestGoodHistoryEntry(ctx context.Context, key string) (*HistoryEntry, *SaveData, error) {
+	entries, err := s.listHistory(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, entry := range entries {
+		e, data, err := s.readHistoryEntry(ctx, key, entry.ID)
+		if err != nil {
+			if errors.Is(err, errCorruptSave) {
+				continue
+			}
+			return nil, nil, err
+		}
+		return e, data, nil
+	}
+
+	return nil, nil, nil
+}
+
+func historyBlobName(key, id string) string {
+	return path.Join(key, historyDirName, id+".json")
+}
+
+// listHistory returns all history entries, newest first.
+func (s *saveStore) listHistory(ctx context.Context, key string) ([]HistoryEntry, error) {
+	prefix := path.Join(key, historyDirName) + "/"
+
+	blobs, err := s.blobs.list(ctx, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("reading history: %w", err)
+	}
+
+	entries := make([]HistoryEntry, 0, len(blobs))
+	for _, blob := range blobs {
+		id, ok := strings.CutSuffix(strings.TrimPrefix(blob.name, prefix), ".json")
+		if !ok {
+			continue
+		}
+		entry, ok := parseHistoryID(id)
+		if !ok {
+			continue
+		}
+		entry.Size = blob.size
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Date != entries[j].Date {
+			return entries[i].Date > entries[j].Date
+		}
+		return entries[i].ID > entries[j].ID
+	})
+
+	return entries, nil
+}
+
+// readHistoryEntry reads the save of the history entry with the given ID.
+func (s *saveStore) readHistoryEntry(ctx context.Context, key, id string) (*HistoryEntry, *SaveData, error) {
+	entry, ok := parseHistoryID(id)
+	if !ok {
+		return nil, nil, ErrHistoryEntryNotFound
+	}
+
+	b, err := s.blobs.get(ctx, historyBlobName(key, id))
+	if err != nil {
+		if errors.Is(err, errBlobNotFound) {
+			return nil, nil, ErrHistoryEntryNotFound
+		}
+		return nil, nil, fmt.Errorf("reading history entry: %w", err)
+	}
+
+	data, err := s.decode(b)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decoding history entry %s: %w", id, err)
+	}
+
+	entry.Size = int64(len(b))
+	return &entry, data, nil
+}
+
+// addHistory adds the save to the history and prunes old entries.
+func (s *saveStore) addHistory(ctx context.Context, key string, data *SaveData, source SaveSource) (*HistoryEntry, error) {
+	b, err := s.encode(data)
+	if err != nil {
+		return nil, fmt.Errorf("encoding history entry: %w", err)
+	}
+
+	entry := HistoryEntry{
+		ID:     historyID(data.Date, source, hashData(data)),
+		Hash:   hashData(data),
+		Date:   data.Date,
+		Source: source,
+		Size:   int64(len(b)),
+	}
+
+	if err := s.blobs.put(ctx, historyBlobName(key, entry.ID), b); err != nil {
+		return nil, fmt.Errorf("writing history entry: %w", err)
+	}
+
+	if err := s.pruneHistory(ctx, key); err != nil {
+		return nil, fmt.Errorf("pruning history: %w", err)
+	}
+
+	return &entry, nil
+}
+
+// pruneHistory deletes the history entries that no retention rule keeps.
+func (s *saveStore) pruneHistory(ctx context.Context, key string) error {
+	entries, err := s.listHistory(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	// Days and weeks are counted in the server's time zone.
+	times := make([]time.Time, len(entries))
+	for i, entry := range entries {
+		times[i] = time.UnixMilli(entry.Date).In(time.Local)
+	}
+	keep := s.history.retention().Kept(times)
+
+	for i, entry := range entries {
+		if keep[i] {
+			continue
+		}
+		if err := s.blobs.delete(ctx, historyBlobName(key, entry.ID)); err != nil {
+			return fmt.Errorf("deleting history entry: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// check checks every save in the store, recovering corrupt saves. Stores that
+// can have leftovers from interrupted writes are also cleaned up.
+func (s *saveStore) check(ctx context.Context) {
+	log := extension.LoggerFromContext(ctx)
+
+	if c, ok := s.blobs.(interface{ cleanup(context.Context) error }); ok {
+		if err := c.cleanup(ctx); err != nil && ctx.Err() == nil {
+			log.Error(
+				"failed to clean up autosync store",
+				"err", err)
+		}
+	}
+
+	keys, err := s.Keys(ctx, "")
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Error(
+				"failed to check autosync saves",
+				"err", err)
+		}
+		return
+	}
+
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			return
+		}
+		if _, err := s.Get(ctx, key); err != nil {
+			log.Error(
+				"failed to check autosync save",
+				"key", key,
+				"err", err)
+		}
+	}
+}
+
+// storedSave is how a save is stored, both as the current save and in the
+// history.
+type storedSave struct {
+	SaveData
+	// Checksum is the checksum of the save data. It is empty in saves that
+	// were written before checksums were added.
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// errCorruptSave is returned when a stored save cannot be decoded or does not
+// match its checksum.
+var errCorruptSave = errors.New("save is corrupt")
+
+func saveChecksum(data *SaveData) string {
+	h := sha256.New()
+	h.Write([]byte(strconv.FormatInt(data.Date, 10)))
+	h.Write([]byte{0})
+	h.Write([]byte(data.Data))
+	// The device is only checksummed if it is set, so that the checksums of
+	// saves from before devices were tracked stay the same.
+	if data.Device != "" {
+		h.Write([]byte{0})
+		h.Write([]byte(data.Device))
+	}
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+func encodeSave(data *SaveData) ([]byte, error) {
+	return json.Marshal(storedSave{
+		SaveData: *data,
+		Checksum: saveChecksum(data),
+	})
+}
+
+func decodeSave(b []byte) (*SaveData, error) {
+	var stored storedSave
+	if err := json.Unmarshal(b, &stored); err != nil {
+		return nil, fmt.Errorf("%w: %v", errCorruptSave, err)
+	}
+	if stored.Checksum != "" && stored.Checksum != saveChecksum(&stored.SaveData) {
+		return nil, fmt.Errorf("%w: checksum mismatch", errCorruptSave)
+	}
+	return &stored.SaveData, nil
+}
+
+// encode encodes the save and encrypts it if encryption is configured.
+func (s *saveStore) encode(data *SaveData) ([]byte, error) {
+	b, err := encodeSave(data)
+	if err != nil {
+		return nil, err
+	}
+	return s.seal(b)
+}
+
+// decode decrypts the save if it is encrypted and decodes it.
+func (s *saveStore) decode(b []byte) (*SaveData, error) {
+	b, err := s.open(b)
+	if err != nil {
+		return nil, err
+	}
+	return decodeSave(b)
+}
@@ -0,0 +1,241 @@
+package autosync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofrs/flock"
+	"libdb.so/dol-server/extension"
+)
+
+// storeLockName is the name of the lock file of the whole store, relative to
+// the store's root.
+const storeLockName = "store.lock"
+
+// saveLocksDir is the directory of the save lock files, relative to the
+// store's root.
+const saveLocksDir = ".locks"
+
+// saveLockFiles is the number of save lock files. Saves are spread over them
+// by their key, so that locking a save never creates anything on disk that is
+// specific to the save.
+const saveLockFiles = 64
+
+// fsBlobStore stores blobs as files in a directory. Saves are locked with lock
+// files, so that several servers can share the same directory.
+type fsBlobStore struct {
+	root string
+}
+
+func newFSBlobStore(root string) (*fsBlobStore, error) {
+	if err := os.MkdirAll(filepath.Join(root, saveLocksDir), 0755); err != nil {
+		return nil, fmt.Errorf("creating save path: %w", err)
+	}
+
+	return &fsBlobStore{root: root}, nil
+}
+
+func (s *fsBlobStore) path(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(name))
+}
+
+func (s *fsBlobStore) get(ctx context.Context, name string) ([]byte, error) {
+	b, err := os.ReadFile(s.path(name))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, errBlobNotFound
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+func (s *fsBlobStore) put(ctx context.Context, name string, b []byte) error {
+	path := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b)
+}
+
+func (s *fsBlobStore) delete(ctx context.Context, name string) error {
+	if err := os.Remove(s.path(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *fsBlobStore) list(ctx context.Context, prefix string) ([]blobInfo, error) {
+	// Only walk the directory that the prefix is in.
+	dir, _ := path.Split(prefix)
+
+	var blobs []blobInfo
+	err := filepath.WalkDir(s.path(dir), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() || isTempFile(d.Name()) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+
+		name := filepath.ToSlash(rel)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		blobs = append(blobs, blobInfo{name: name, size: info.Size()})
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	return blobs, nil
+}
+
+func (s *fsBlobStore) lock(ctx context.Context, key string) (func(), error) {
+	// Every save lock holds a shared lock on the store, so that lockStore
+	// waits for them. Each lock opens its lock file on its own, since locks on
+	// the same file descriptor would be released together.
+	storeLock := flock.New(s.path(storeLockName))
+	if _, err := storeLock.TryRLockContext(ctx, 250*time.Millisecond); err != nil {
+		return nil, err
+	}
+
+	l := flock.New(s.saveLockPath(key))
+	if _, err := l.TryLockContext(ctx, 250*time.Millisecond); err != nil {
+		storeLock.Unlock()
+		return nil, err
+	}
+
+	return func() {
+		if err := l.Unlock(); err != nil {
+			panic(fmt.Errorf("releasing save data lock: %w", err))
+		}
+		if err := storeLock.Unlock(); err != nil {
+			panic(fmt.Errorf("releasing store lock: %w", err))
+		}
+	}, nil
+}
+
+// saveLockPath returns the path of the lock file of the save with the given
+// key. Saves whose keys hash the same share a lock file, which only means that
+// they cannot be written at the same time.
+func (s *fsBlobStore) saveLockPath(key string) string {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	name := fmt.Sprintf("%02x.lock", h.Sum32()%saveLockFiles)
+	return filepath.Join(s.root, saveLocksDir, name)
+}
+
+func (s *fsBlobStore) lockStore(ctx context.Context) (func(), error) {
+	l := flock.New(s.path(storeLockName))
+	if _, err := l.TryLockContext(ctx, 250*time.Millisecond); err != nil {
+		return nil, err
+	}
+
+	return func() {
+		if err := l.Unlock(); err != nil {
+			panic(fmt.Errorf("releasing store lock: %w", err))
+		}
+	}, nil
+}
+
+func (s *fsBlobStore) close() error { return nil }
+
+// cleanup removes temporary files left over from interrupted writes.
+func (s *fsBlobStore) cleanup(ctx context.Context) error {
+	log := extension.LoggerFromContext(ctx)
+
+	return filepath.WalkDir(s.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() || !isTempFile(d.Name()) {
+			return nil
+		}
+
+		log.Info(
+			"removing temporary file left over from an interrupted write",
+			"path", path)
+
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	})
+}
+
+// tempFileSuffix is the suffix of the temporary files that writeFileAtomic
+// writes to.
+const tempFileSuffix = ".tmp"
+
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, tempFileSuffix)
+}
+
+// writeFileAtomic writes the file so that it either has its old or its new
+// content, even if the server dies halfway through the write.
+func writeFileAtomic(path string, b []byte) error {
+	dir, name := filepath.Split(path)
+
+	f, err := os.CreateTemp(dir, "."+name+".*"+tempFileSuffix)
+	if err != nil {
+		return fmt.Errorf("creating temp file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.Write(b); err != nil {
+		return fmt.Errorf("writing temp file: %w", err)
+	}
+
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("syncing temp file: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("closing temp file: %w", err)
+	}
+
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return fmt.Errorf("setting temp file mode: %w", err)
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("renaming temp file: %w", err)
+	}
+
+	// Make sure that the rename itself is durable. Not every platform can sync
+	// directories, so this is best effort.
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,378 @@
+package autosync
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Config configures the "s3" store. Any S3-compatible object store works,
+// such as MinIO or the object store of a NAS.
+type S3Config struct {
+	// Endpoint is the URL of the object store, such as
+	// "https://s3.us-east-1.amazonaws.com" or "http://nas.local:9000".
+	Endpoint string `json:"endpoint"`
+	// Region is the region of the bucket. It defaults to "us-east-1", which
+	// most S3-compatible stores accept.
+	Region string `json:"region"`
+	// Bucket is the bucket to store saves in.
+	Bucket string `json:"bucket"`
+	// Prefix is prepended to the names of all objects, so that the bucket can
+	// be shared with other data.
+	Prefix string `json:"prefix"`
+	// AccessKeyID and SecretAccessKey are the credentials to use. They default
+	// to the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment
+	// variables.
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	// VirtualHosted addresses the bucket as a subdomain of the endpoint
+	// instead of as the first path element.
+	VirtualHosted bool `json:"virtual_hosted"`
+}
+
+// s3BlobStore stores blobs as objects in an S3 bucket. It cannot lock saves
+// against other processes, so current saves are replaced with conditional
+// writes instead. Several servers can share a bucket prefix as long as the
+// object store supports conditional writes, which AWS S3 and MinIO do.
+type s3BlobStore struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+func newS3BlobStore(cfg S3Config) (*s3BlobStore, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3 store needs an endpoint and a bucket")
+	}
+
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint: %w", err)
+	}
+
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.AccessKeyID == "" {
+		cfg.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if cfg.SecretAccessKey == "" {
+		cfg.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+		return nil, fmt.Errorf("s3 store needs credentials")
+	}
+
+	return &s3BlobStore{
+		cfg:      cfg,
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// objectURL returns the URL of the object with the given key. An empty key
+// refers to the bucket itself.
+func (s *s3BlobStore) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	if s.cfg.VirtualHosted {
+		u.Host = s.cfg.Bucket + "." + u.Host
+		u.Path = "/" + key
+	} else {
+		u.Path = "/" + s.cfg.Bucket + "/" + key
+	}
+	u.RawPath = ""
+	return &u
+}
+
+var _ versionedBlobStore = (*s3BlobStore)(nil)
+
+func (s *s3BlobStore) do(ctx context.Context, method string, u *url.URL, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	s.sign(req, body, time.Now())
+	return s.client.Do(req)
+}
+
+func (s *s3BlobStore) get(ctx context.Context, name string) ([]byte, error) {
+	b, _, err := s.getVersion(ctx, name)
+	return b, err
+}
+
+// getVersion implements versionedBlobStore. The version of an object is its
+// ETag.
+func (s *s3BlobStore) getVersion(ctx context.Context, name string) ([]byte, string, error) {
+	resp, err := s.do(ctx, "GET", s.objectURL(s.cfg.Prefix+name), nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, "", err
+		}
+		return b, resp.Header.Get("ETag"), nil
+	case http.StatusNotFound:
+		return nil, "", errBlobNotFound
+	default:
+		return nil, "", s3Error(resp)
+	}
+}
+
+func (s *s3BlobStore) put(ctx context.Context, name string, b []byte) error {
+	return s.putHeader(ctx, name, b, nil)
+}
+
+// putVersion implements versionedBlobStore. The object is written with
+// If-Match, or with If-None-Match if it must not exist yet.
+func (s *s3BlobStore) putVersion(ctx context.Context, name string, b []byte, version string) error {
+	header := make(http.Header)
+	if version != "" {
+		header.Set("If-Match", version)
+	} else {
+		header.Set("If-None-Match", "*")
+	}
+	return s.putHeader(ctx, name, b, header)
+}
+
+func (s *s3BlobStore) putHeader(ctx context.Context, name string, b []byte, header http.Header) error {
+	resp, err := s.do(ctx, "PUT", s.objectURL(s.cfg.Prefix+name), header, b)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusPreconditionFailed, http.StatusConflict:
+		// S3 answers with 409 if another conditional write to the same object
+		// is in progress.
+		if header != nil {
+			return errBlobChanged
+		}
+		return s3Error(resp)
+	default:
+		return s3Error(resp)
+	}
+}
+
+func (s *s3BlobStore) delete(ctx context.Context, name string) error {
+	resp, err := s.do(ctx, "DELETE", s.objectURL(s.cfg.Prefix+name), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	default:
+		return s3Error(resp)
+	}
+}
+
+func (s *s3BlobStore) list(ctx context.Context, prefix string) ([]blobInfo, error) {
+	var blobs []blobInfo
+	var token string
+
+	for {
+		u := s.objectURL("")
+		q := url.Values{
+			"list-type": {"2"},
+			"prefix":    {s.cfg.Prefix + prefix},
+		}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		// The query is sent exactly as it is signed, which url.Values.Encode
+		// would not do for spaces.
+		u.RawQuery = s3CanonicalQuery(q)
+
+		resp, err := s.do(ctx, "GET", u, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			err := s3Error(resp)
+			resp.Body.Close()
+			return nil, err
+		}
+
+		var result struct {
+			Contents []struct {
+				Key  string
+				Size int64
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decoding object list: %w", err)
+		}
+
+		for _, obj := range result.Contents {
+			blobs = append(blobs, blobInfo{
+				name: strings.TrimPrefix(obj.Key, s.cfg.Prefix),
+				size: obj.Size,
+			})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return blobs, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *s3BlobStore) lock(ctx context.Context, key string) (func(), error) {
+	return func() {}, nil
+}
+
+func (s *s3BlobStore) lockStore(ctx context.Context) (func(), error) {
+	return func() {}, nil
+}
+
+func (s *s3BlobStore) close() error { return nil }
+
+func s3Error(resp *http.Response) error {
+	var s3Err struct {
+		Code    string
+		Message string
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if xml.Unmarshal(b, &s3Err) == nil && s3Err.Code != "" {
+		return fmt.Errorf("s3: %s: %s: %s", resp.Status, s3Err.Code, s3Err.Message)
+	}
+	return fmt.Errorf("s3: %s", resp.Status)
+}
+
+// sign signs the request with AWS Signature Version 4.
+func (s *s3BlobStore) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	payloadHash := sha256.Sum256(body)
+	payloadHashHex := hex.EncodeToString(payloadHash[:])
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHashHex)
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHashHex,
+		"x-amz-date":           amzDate,
+	}
+	headerNames := make([]string, 0, len(headers))
+	for name := range headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range headerNames {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHashHex,
+	}, "\n")
+
+	scope := date + "/" + s.cfg.Region + "/s3/aws4_request"
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalRequestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretAccessKey), date)
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKeyID, scope, signedHeaders, signature))
+
+	// The request must be sent with the exact path that was signed.
+	req.URL.RawPath = s3EscapePath(req.URL.Path)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape escapes s the way that AWS Signature Version 4 expects: everything
+// except unreserved characters is percent-encoded.
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3EscapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func s3CanonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), q[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,109 @@
+package autosync
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteBlobStore stores blobs in an SQLite database. The database is only
+// meant to be used by a single server.
+type sqliteBlobStore struct {
+	db *sql.DB
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS blobs (
+	name TEXT PRIMARY KEY,
+	data BLOB NOT NULL
+);
+`
+
+func newSQLiteBlobStore(path string) (*sqliteBlobStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("creating database directory: %w", err)
+	}
+
+	db, err := sql.Open("sqlite", "file:"+path+
+		"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(FULL)")
+	if err != nil {
+		return nil, fmt.Errorf("opening database: %w", err)
+	}
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating database schema: %w", err)
+	}
+
+	return &sqliteBlobStore{db: db}, nil
+}
+
+func (s *sqliteBlobStore) get(ctx context.Context, name string) ([]byte, error) {
+	var b []byte
+	err := s.db.QueryRowContext(ctx, `SELECT data FROM blobs WHERE name = ?`, name).Scan(&b)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errBlobNotFound
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+func (s *sqliteBlobStore) put(ctx context.Context, name string, b []byte) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO blobs (name, data) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET data = excluded.data`,
+		name, b)
+	return err
+}
+
+func (s *sqliteBlobStore) delete(ctx context.Context, name string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM blobs WHERE name = ?`, name)
+	return err
+}
+
+func (s *sqliteBlobStore) list(ctx context.Context, prefix string) ([]blobInfo, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT name, length(data) FROM blobs
+		WHERE substr(name, 1, length(?1)) = ?1`,
+		prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blobs []blobInfo
+	for rows.Next() {
+		var blob blobInfo
+		if err := rows.Scan(&blob.name, &blob.size); err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, blob)
+	}
+
+	return blobs, rows.Err()
+}
+
+func (s *sqliteBlobStore) lock(ctx context.Context, key string) (func(), error) {
+	return func() {}, nil
+}
+
+// lockStore checkpoints the database, so that the database file holds every
+// blob while the store is locked. Nothing else needs to be locked, since the
+// database is not shared with other processes.
+func (s *sqliteBlobStore) lockStore(ctx context.Context) (func(), error) {
+	if _, err := s.db.ExecContext(ctx, `PRAGMA wal_checkpoint(TRUNCATE)`); err != nil {
+		return nil, fmt.Errorf("checkpointing database: %w", err)
+	}
+	return func() {}, nil
+}
+
+func (s *sqliteBlobStore) close() error {
+	return s.db.Close()
+}
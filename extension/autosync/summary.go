@@ -0,0 +1,203 @@
+package autosync
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+
+	"libdb.so/dol-server/internal/sugarcube"
+)
+
+// SaveSummary describes what is in a save, so that people can tell saves
+// apart. Only Size is always set. The other fields are omitted if the save
+// cannot be decoded or does not have them.
+type SaveSummary struct {
+	// Passage is the name of the current passage.
+	Passage string `json:"passage,omitempty"`
+	// Day is the in-game day, starting at 1.
+	Day int `json:"day,omitempty"`
+	// Time is the in-game time of day as "HH:MM".
+	Time string `json:"time,omitempty"`
+	// Money is the money of the character in pence.
+	Money *int64 `json:"money,omitempty"`
+	// Name is the name of the character.
+	Name string `json:"name,omitempty"`
+	// Size is the size of the save data in bytes.
+	Size int `json:"size"`
+}
+
+// minutesSince returns how many in-game minutes s is ahead of other. It
+// returns false if either summary has no in-game time.
+func (s *SaveSummary) minutesSince(other *SaveSummary) (int, bool) {
+	if s == nil || other == nil {
+		return 0, false
+	}
+
+	a, ok := s.inGameMinutes()
+	if !ok {
+		return 0, false
+	}
+
+	b, ok := other.inGameMinutes()
+	if !ok {
+		return 0, false
+	}
+
+	return a - b, true
+}
+
+// inGameMinutes returns the in-game minutes since the start of the first day.
+func (s *SaveSummary) inGameMinutes() (int, bool) {
+	var hour, minute int
+	if s.Day == 0 {
+		return 0, false
+	}
+	if _, err := fmt.Sscanf(s.Time, "%d:%d", &hour, &minute); err != nil {
+		return 0, false
+	}
+	return (s.Day-1)*24*60 + hour*60 + minute, true
+}
+
+// summarizeSave summarizes the given save. Saves that cannot be decoded only
+// get their size.
+func summarizeSave(save *SaveData) *SaveSummary {
+	summary := &SaveSummary{Size: len(save.Data)}
+
+	decoded, err := sugarcube.Decode(save.Data)
+	if err != nil {
+		return summary
+	}
+
+	moment, err := decoded.Current()
+	if err != nil {
+		return summary
+	}
+
+	summary.Passage = moment.Title
+
+	var money float64
+	if moment.Variable("money", &money) && !math.IsNaN(money) && !math.IsInf(money, 0) {
+		m := int64(money)
+		summary.Money = &m
+	}
+
+	summary.Day, summary.Time = momentTime(moment)
+	summary.Name = momentName(moment)
+
+	return summary
+}
+
+// momentTime returns the in-game day and time of day of the moment. Older
+// builds of the game count time in $days, $hour and $minute. Newer builds
+// count the seconds since $startDate in $timeStamp.
+func momentTime(m *sugarcube.Moment) (day int, timeOfDay string) {
+	var days, hour, minute int
+	if m.Variable("days", &days) && m.Variable("hour", &hour) {
+		m.Variable("minute", &minute)
+		return days, fmt.Sprintf("%02d:%02d", hour, minute)
+	}
+
+	var timeStamp, startDate int64
+	if !m.Variable("timeStamp", &timeStamp) {
+		return 0, ""
+	}
+	m.Variable("startDate", &startDate)
+
+	const secondsPerDay = 24 * 60 * 60
+	now := startDate + timeStamp
+	firstDay := startDate - startDate%secondsPerDay
+	secs := now % secondsPerDay
+
+	day = int((now-firstDay)/secondsPerDay) + 1
+	return day, fmt.Sprintf("%02d:%02d", secs/3600, secs%3600/60)
+}
+
+// momentName returns the name of the character, if the game or one of its
+// mods stores one.
+func momentName(m *sugarcube.Moment) string {
+	var player struct {
+		Name string `json:"name"`
+	}
+	if m.Variable("player", &player) && player.Name != "" {
+		return player.Name
+	}
+
+	for _, variable := range []string{"playerName", "playername", "name"} {
+		var name string
+		if m.Variable(variable, &name) && name != "" {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// summaryCacheSize is the number of summaries that are cached. Summaries are
+// cached by save hash, so that listing the history does not decode every
+// save every time.
+const summaryCacheSize = 256
+
+type summaryCache struct {
+	mu        sync.Mutex
+	summaries map[string]*SaveSummary
+}
+
+// get returns the summary of the given save with the given hash. It returns
+// nil if there is no save.
+func (c *summaryCache) get(hash string, save *SaveData) *SaveSummary {
+	if save == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	summary, ok := c.summaries[hash]
+	c.mu.Unlock()
+	if ok {
+		return summary
+	}
+
+	summary = summarizeSave(save)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.summaries == nil || len(c.summaries) >= summaryCacheSize {
+		c.summaries = make(map[string]*SaveSummary, summaryCacheSize)
+	}
+	c.summaries[hash] = summary
+
+	return summary
+}
+
+func (e *autosyncExtension) getSaveSummary(w http.ResponseWriter, r *http.Request) {
+	key, err := e.saveKeyFor(r.Context(), slotFromRequest(r))
+	if err != nil {
+		writeMergeError(w, 400, err)
+		return
+	}
+
+	serverSave, err := e.store.Get(r.Context(), key)
+	if err != nil {
+		writeMergeError(w, 500, fmt.Errorf("reading server save data: %w", err))
+		return
+	}
+
+	type GetSummaryResponse struct {
+		Summary    *SaveSummary `json:"summary"`
+		Date       int64        `json:"date,omitempty"`
+		ServerHash string       `json:"server_hash,omitempty"`
+	}
+
+	if serverSave == nil {
+		writeJSON(w, 200, GetSummaryResponse{})
+		return
+	}
+
+	hash := hashData(serverSave)
+	writeJSON(w, 200, GetSummaryResponse{
+		Summary:    e.summaries.get(hash, serverSave),
+		Date:       serverSave.Date,
+		ServerHash: hash,
+	})
+}
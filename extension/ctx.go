@@ -10,6 +10,7 @@ type ctxKey uint8
 const (
 	ctxKeyExtension ctxKey = iota
 	ctxKeySlog
+	ctxKeyGame
 )
 
 // ExtensionFromContext returns the extension ID from the context.
@@ -26,3 +27,26 @@ func LoggerFromContext(ctx context.Context) *slog.Logger {
 	}
 	return logger
 }
+
+// WithLogger returns a new context with the given logger. Extensions can use
+// it to annotate the logger of a request with their own attributes.
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, ctxKeySlog, logger)
+}
+
+// WithGame returns a new context that belongs to the game with the given name.
+// The logger in the context is also annotated with the game name.
+func WithGame(ctx context.Context, game string) context.Context {
+	ctx = context.WithValue(ctx, ctxKeyGame, game)
+	if game != "" {
+		ctx = context.WithValue(ctx, ctxKeySlog, LoggerFromContext(ctx).With("game", game))
+	}
+	return ctx
+}
+
+// GameFromContext returns the name of the game that the context belongs to.
+// If the server is only serving a single game, it returns an empty string.
+func GameFromContext(ctx context.Context) string {
+	game, _ := ctx.Value(ctxKeyGame).(string)
+	return game
+}
@@ -4,11 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"net/http"
+
+	"libdb.so/dol-server/storydata"
 )
 
 // Extension is an interface that defines the lifecycle of an extension.
 type Extension interface {
-	// Start starts the extension.
+	// Start starts the extension. It must not block. Background work started
+	// by the extension should stop when ctx is done.
 	Start(ctx context.Context) error
 	// Stop stops the extension.
 	Stop() error
@@ -30,6 +33,60 @@ type ExtensionJSHookable interface {
 	JSPaths() []string
 }
 
+// ExtensionHTMLInjector is an extension that injects elements such as scripts,
+// stylesheets and meta tags into the game HTML.
+type ExtensionHTMLInjector interface {
+	Extension
+	// HTMLInjections returns the elements that should be injected into the
+	// game HTML, in order.
+	HTMLInjections() []Injection
+}
+
+// ExtensionHTMLPatcher is an extension that rewrites the game HTML before it is
+// served. Patchers run in extension order before any injections are made, so
+// each patcher sees the output of the previous one.
+type ExtensionHTMLPatcher interface {
+	Extension
+	// PatchHTML returns the patched game HTML. It is called every time the
+	// game is loaded, and the context belongs to the game that is being
+	// loaded. The given HTML must not be modified in place.
+	PatchHTML(ctx context.Context, html []byte) ([]byte, error)
+}
+
+// ExtensionStoryPatcher is an extension that adds, replaces or patches the
+// passages of the game before it is served. Story patchers run in extension
+// order before any HTML patchers.
+type ExtensionStoryPatcher interface {
+	Extension
+	// PatchStory patches the story data of the game. It is called every time
+	// the game is loaded, and the context belongs to the game that is being
+	// loaded.
+	PatchStory(ctx context.Context, story *storydata.Story) error
+}
+
+// ExtensionDataDir is an extension that keeps its data in a directory on the
+// local disk. The directory is included in backups.
+type ExtensionDataDir interface {
+	Extension
+	// DataDir returns the directory that the extension keeps its data in. It
+	// returns an empty string if the extension has no data on the local disk.
+	DataDir() string
+	// LockData stops the extension, and any other process sharing the data
+	// directory, from writing to it until unlock is called. Backups hold the
+	// lock while the directory is copied or restored.
+	LockData(ctx context.Context) (unlock func(), err error)
+}
+
+// ExtensionDataFiles is an ExtensionDataDir that only owns some of the files in
+// its data directory, such as a database in a directory that also holds other
+// data. Only those files are backed up and restored, and the rest of the
+// directory is left alone.
+type ExtensionDataFiles interface {
+	ExtensionDataDir
+	// DataFiles returns the names of the extension's files in DataDir.
+	DataFiles() []string
+}
+
 // ExtensionInfo is a struct that contains information about an extension.
 // It supplies a constructor that creates an extension from a config.
 type ExtensionInfo struct {
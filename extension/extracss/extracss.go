@@ -1,11 +1,9 @@
 package extracss
 
 import (
-	"bytes"
 	"context"
 	"embed"
 	"encoding/json"
-	"fmt"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
@@ -24,7 +22,7 @@ var cssPaths = func() []string {
 	files, _ := cssFiles.ReadDir(".")
 	paths := make([]string, len(files))
 	for i, file := range files {
-		paths[i] = "/x/extracss/" + file.Name()
+		paths[i] = "/" + file.Name()
 	}
 	return paths
 }()
@@ -42,30 +40,15 @@ type extraCSSExtension struct {
 }
 
 var (
-	_ extension.Extension            = (*extraCSSExtension)(nil)
-	_ extension.ExtensionHTTPHandler = (*extraCSSExtension)(nil)
-	_ extension.ExtensionJSHookable  = (*extraCSSExtension)(nil)
+	_ extension.Extension             = (*extraCSSExtension)(nil)
+	_ extension.ExtensionHTTPHandler  = (*extraCSSExtension)(nil)
+	_ extension.ExtensionJSHookable   = (*extraCSSExtension)(nil)
+	_ extension.ExtensionHTMLInjector = (*extraCSSExtension)(nil)
 )
 
 // New returns a new extracss extension.
 func New(json.RawMessage) (extension.Extension, error) {
-	var injector bytes.Buffer
-	injector.WriteString(`const cssPaths = `)
-	if err := json.NewEncoder(&injector).Encode(cssPaths); err != nil {
-		panic(fmt.Sprintf("failed to encode css paths: %v", err))
-	}
-
-	injector.WriteString(`
-		for (const url of cssPaths) {
-			const link = document.createElement('link');
-			link.rel = 'stylesheet';
-			link.href = url;
-			document.head.appendChild(link);
-		}
-	`)
-
 	e := &extraCSSExtension{Mux: chi.NewMux()}
-	e.Get("/inject.js", httputil.BytesServer("text/javascript", injector.Bytes()))
 	e.Get("/updaters.js", httputil.BytesServer("text/javascript", updatersScript))
 	e.Mount("/", http.StripPrefix("/x/extracss", http.FileServer(http.FS(cssFiles))))
 
@@ -81,7 +64,15 @@ func (e *extraCSSExtension) Stop() error { return nil }
 // JSPath implements the extension.ExtensionJSHookable interface.
 func (e *extraCSSExtension) JSPaths() []string {
 	return []string{
-		"/inject.js",
 		"/updaters.js",
 	}
 }
+
+// HTMLInjections implements the extension.ExtensionHTMLInjector interface.
+func (e *extraCSSExtension) HTMLInjections() []extension.Injection {
+	injections := make([]extension.Injection, len(cssPaths))
+	for i, path := range cssPaths {
+		injections[i] = extension.StylesheetInjection{Href: path}
+	}
+	return injections
+}
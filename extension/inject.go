@@ -0,0 +1,186 @@
+package extension
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"path"
+	"strings"
+
+	"libdb.so/dol-server/internal/htmlinject"
+)
+
+// InjectionPoint is a point in the game HTML where an Injection is placed.
+type InjectionPoint = htmlinject.Point
+
+const (
+	// InjectHeadEnd places the injection right before </head>. It is the
+	// default.
+	InjectHeadEnd = htmlinject.HeadEnd
+	// InjectHeadStart places the injection right after <head>.
+	InjectHeadStart = htmlinject.HeadStart
+	// InjectBodyEnd places the injection right before </body>.
+	InjectBodyEnd = htmlinject.BodyEnd
+)
+
+// Injection is an element that is injected into the game HTML. It is one of
+// ScriptInjection, StylesheetInjection, MetaInjection or SnippetInjection.
+//
+// URLs in injections are relative to the root of the extension, the same as
+// ExtensionJSHookable.JSPaths, unless they are full URLs.
+type Injection interface {
+	// InjectAt returns where the injection is placed.
+	InjectAt() InjectionPoint
+	// appendHTML appends the HTML of the injection to b. Extension-relative
+	// URLs are resolved against base.
+	appendHTML(b *strings.Builder, base string) error
+}
+
+// ScriptInjection injects a <script> tag. Exactly one of Src or Content must
+// be set.
+type ScriptInjection struct {
+	At InjectionPoint
+	// Src is the URL of the script.
+	Src string
+	// Content is the inline script source.
+	Content string
+	// Module makes the script an ES module instead of a classic script.
+	Module bool
+	// Defer defers executing a classic script until the document is parsed.
+	Defer bool
+	// Async executes the script as soon as it is available.
+	Async bool
+}
+
+// InjectAt implements Injection.
+func (i ScriptInjection) InjectAt() InjectionPoint { return i.At }
+
+func (i ScriptInjection) appendHTML(b *strings.Builder, base string) error {
+	if (i.Src == "") == (i.Content == "") {
+		return fmt.Errorf("script injection must have exactly one of src or content")
+	}
+	if err := checkRawText(i.Content, "script"); err != nil {
+		return err
+	}
+
+	b.WriteString("<script")
+	if i.Src != "" {
+		writeAttr(b, "src", resolveInjectionURL(base, i.Src))
+	}
+	if i.Module {
+		writeAttr(b, "type", "module")
+	}
+	if i.Defer {
+		b.WriteString(" defer")
+	}
+	if i.Async {
+		b.WriteString(" async")
+	}
+	b.WriteString(">")
+	b.WriteString(i.Content)
+	b.WriteString("</script>")
+	return nil
+}
+
+// StylesheetInjection injects a stylesheet, either as a <link> tag or as an
+// inline <style> tag. Exactly one of Href or Content must be set.
+type StylesheetInjection struct {
+	At InjectionPoint
+	// Href is the URL of the stylesheet.
+	Href string
+	// Content is the inline stylesheet.
+	Content string
+}
+
+// InjectAt implements Injection.
+func (i StylesheetInjection) InjectAt() InjectionPoint { return i.At }
+
+func (i StylesheetInjection) appendHTML(b *strings.Builder, base string) error {
+	if (i.Href == "") == (i.Content == "") {
+		return fmt.Errorf("stylesheet injection must have exactly one of href or content")
+	}
+
+	if i.Href != "" {
+		b.WriteString(`<link rel="stylesheet"`)
+		writeAttr(b, "href", resolveInjectionURL(base, i.Href))
+		b.WriteString(">")
+		return nil
+	}
+
+	if err := checkRawText(i.Content, "style"); err != nil {
+		return err
+	}
+
+	b.WriteString("<style>")
+	b.WriteString(i.Content)
+	b.WriteString("</style>")
+	return nil
+}
+
+// MetaInjection injects a <meta> tag. Exactly one of Name or Property must be
+// set.
+type MetaInjection struct {
+	At       InjectionPoint
+	Name     string
+	Property string
+	Content  string
+}
+
+// InjectAt implements Injection.
+func (i MetaInjection) InjectAt() InjectionPoint { return i.At }
+
+func (i MetaInjection) appendHTML(b *strings.Builder, base string) error {
+	if (i.Name == "") == (i.Property == "") {
+		return fmt.Errorf("meta injection must have exactly one of name or property")
+	}
+
+	b.WriteString("<meta")
+	if i.Name != "" {
+		writeAttr(b, "name", i.Name)
+	} else {
+		writeAttr(b, "property", i.Property)
+	}
+	writeAttr(b, "content", i.Content)
+	b.WriteString(">")
+	return nil
+}
+
+// SnippetInjection injects an arbitrary HTML snippet as is.
+type SnippetInjection struct {
+	At   InjectionPoint
+	HTML string
+}
+
+// InjectAt implements Injection.
+func (i SnippetInjection) InjectAt() InjectionPoint { return i.At }
+
+func (i SnippetInjection) appendHTML(b *strings.Builder, base string) error {
+	b.WriteString(i.HTML)
+	return nil
+}
+
+func writeAttr(b *strings.Builder, name, value string) {
+	b.WriteString(" ")
+	b.WriteString(name)
+	b.WriteString(`="`)
+	b.WriteString(html.EscapeString(value))
+	b.WriteString(`"`)
+}
+
+// checkRawText checks that inline content does not close its own tag early.
+func checkRawText(content, tag string) error {
+	if strings.Contains(strings.ToLower(content), "</"+tag) {
+		return fmt.Errorf("inline %s must not contain </%s>", tag, tag)
+	}
+	return nil
+}
+
+// resolveInjectionURL resolves an extension-relative URL against base. Full
+// URLs are returned as is.
+func resolveInjectionURL(base, ref string) string {
+	u, err := url.Parse(ref)
+	if err == nil && (u.Scheme != "" || u.Host != "") {
+		return ref
+	}
+	return path.Join(base, ref)
+}
@@ -1,26 +1,42 @@
 package extension
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"path"
+	"strings"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"golang.org/x/sync/errgroup"
+	"libdb.so/dol-server/internal/htmlinject"
+	"libdb.so/dol-server/storydata"
 )
 
 type extension struct {
 	Extension
-	id string
+	id  string
+	cfg json.RawMessage
+	// cancel cancels the context that the extension was started with. It is
+	// nil until the extension is started.
+	cancel context.CancelFunc
+}
+
+// context returns a new context that belongs to the extension.
+func (ext extension) context(ctx context.Context) context.Context {
+	ctx = context.WithValue(ctx, ctxKeyExtension, ext.id)
+	ctx = context.WithValue(ctx, ctxKeySlog,
+		LoggerFromContext(ctx).With("extension", ext.id))
+	return ctx
 }
 
 // ExtensionsManager manages starting and stopping of all extensions.
 type ExtensionsManager struct {
-	extensions []extension
+	extensions []*extension
 }
 
 // NewExtensionsManager creates a new ExtensionsManager.
@@ -31,8 +47,23 @@ func NewExtensionsManager(cfg map[string]json.RawMessage) (*ExtensionsManager, e
 // NewExtensionsManagerFromExtensions creates a new ExtensionManager from a list
 // of extensions.
 func NewExtensionsManagerFromExtensions(extensionConfigs map[string]json.RawMessage, extensionInfos []ExtensionInfo) (*ExtensionsManager, error) {
+	return newExtensionsManager(extensionConfigs, extensionInfos, nil)
+}
+
+// Reload creates a new ExtensionsManager from the given configs. Extensions
+// whose config has not changed are carried over from m as they are, so they
+// keep running along with their in-memory state. Only the other extensions
+// are created anew.
+//
+// Once the new manager is in use, m must be stopped with StopExcept, so that
+// the carried over extensions are left running.
+func (m *ExtensionsManager) Reload(cfg map[string]json.RawMessage) (*ExtensionsManager, error) {
+	return newExtensionsManager(cfg, extensions, m)
+}
+
+func newExtensionsManager(extensionConfigs map[string]json.RawMessage, extensionInfos []ExtensionInfo, old *ExtensionsManager) (*ExtensionsManager, error) {
 	var firstErr error
-	extensions := make([]extension, 0, len(extensionInfos))
+	m := &ExtensionsManager{make([]*extension, 0, len(extensionInfos))}
 
 	for _, ext := range extensionInfos {
 		ecfg, ok := extensionConfigs[ext.ID]
@@ -43,6 +74,15 @@ func NewExtensionsManagerFromExtensions(extensionConfigs map[string]json.RawMess
 			continue
 		}
 
+		if prev := old.find(ext.ID); prev != nil && sameConfig(prev.cfg, ecfg) {
+			slog.Debug(
+				"keeping extension since its config did not change",
+				"extension", ext.ID)
+
+			m.extensions = append(m.extensions, prev)
+			continue
+		}
+
 		e, err := ext.New(ecfg)
 		if err != nil {
 			if firstErr == nil {
@@ -55,24 +95,58 @@ func NewExtensionsManagerFromExtensions(extensionConfigs map[string]json.RawMess
 			"created extension",
 			"extension", ext.ID)
 
-		extensions = append(extensions, extension{e, ext.ID})
+		m.extensions = append(m.extensions, &extension{
+			Extension: e,
+			id:        ext.ID,
+			cfg:       ecfg,
+		})
 	}
 
 	if firstErr != nil {
-		for _, ext := range extensions {
-			ext.Stop()
-		}
+		m.StopExcept(old)
 		return nil, firstErr
 	}
 
-	return &ExtensionsManager{extensions}, nil
+	return m, nil
+}
+
+// find returns the extension with the given ID, or nil if there is none. m
+// may be nil.
+func (m *ExtensionsManager) find(id string) *extension {
+	if m == nil {
+		return nil
+	}
+	for _, ext := range m.extensions {
+		if ext.id == id {
+			return ext
+		}
+	}
+	return nil
 }
 
-// Start starts all extensions.
+// sameConfig returns true if the two raw configs are the same, ignoring any
+// insignificant whitespace.
+func sameConfig(a, b json.RawMessage) bool {
+	var ca, cb bytes.Buffer
+	if json.Compact(&ca, a) != nil || json.Compact(&cb, b) != nil {
+		return bytes.Equal(a, b)
+	}
+	return bytes.Equal(ca.Bytes(), cb.Bytes())
+}
+
+// Start starts all extensions that are not running yet. Each extension gets its
+// own context derived from ctx, which lives until the extension is stopped.
+// Extensions carried over by Reload are already running and are left alone.
 func (m *ExtensionsManager) Start(ctx context.Context) error {
-	wg, ctx := errgroup.WithContext(ctx)
+	var wg errgroup.Group
 	for _, ext := range m.extensions {
+		if ext.cancel != nil {
+			continue
+		}
+
 		ext := ext
+		ctx, cancel := context.WithCancel(ctx)
+		ext.cancel = cancel
 		wg.Go(func() error { return ext.Start(ctx) })
 	}
 	return wg.Wait()
@@ -80,10 +154,25 @@ func (m *ExtensionsManager) Start(ctx context.Context) error {
 
 // Stop stops all extensions.
 func (m *ExtensionsManager) Stop() error {
+	return m.StopExcept(nil)
+}
+
+// StopExcept stops all extensions that are not also part of keep. It is used to
+// stop the extensions that a reload replaced, and keep may be nil.
+func (m *ExtensionsManager) StopExcept(keep *ExtensionsManager) error {
 	var wg errgroup.Group
 	for _, ext := range m.extensions {
+		if keep.find(ext.id) == ext {
+			continue
+		}
+
 		ext := ext
-		wg.Go(func() error { return ext.Stop() })
+		wg.Go(func() error {
+			if ext.cancel != nil {
+				ext.cancel()
+			}
+			return ext.Stop()
+		})
 	}
 	return wg.Wait()
 }
@@ -101,10 +190,7 @@ func (m *ExtensionsManager) BindRouter(router chi.Router) {
 
 		middleware := func(next http.Handler) http.Handler {
 			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				ctx := r.Context()
-				ctx = context.WithValue(ctx, ctxKeyExtension, ext.id)
-				ctx = context.WithValue(ctx, ctxKeySlog,
-					LoggerFromContext(ctx).With("extension", ext.id))
+				ctx := ext.context(r.Context())
 				next.ServeHTTP(w, r.WithContext(ctx))
 			})
 		}
@@ -121,6 +207,20 @@ func (m *ExtensionsManager) BindRouter(router chi.Router) {
 	})
 }
 
+// DataDirs returns the extensions that keep data on the local disk, keyed by
+// extension ID.
+func (m *ExtensionsManager) DataDirs() map[string]ExtensionDataDir {
+	dirs := make(map[string]ExtensionDataDir)
+	for _, ext := range m.extensions {
+		dataDir, ok := ext.Extension.(ExtensionDataDir)
+		if !ok || dataDir.DataDir() == "" {
+			continue
+		}
+		dirs[ext.id] = dataDir
+	}
+	return dirs
+}
+
 // JSPaths returns the paths to all JS files that should be loaded for all
 // extensions.
 func (m *ExtensionsManager) JSPaths() []string {
@@ -136,3 +236,101 @@ func (m *ExtensionsManager) JSPaths() []string {
 	}
 	return paths
 }
+
+// HTMLSnippets renders the elements that all extensions inject into the game
+// HTML, grouped by where they are injected. Scripts from JSPaths are injected
+// as modules at the end of the head. URLs are resolved under root, which is
+// where the game is served.
+func (m *ExtensionsManager) HTMLSnippets(root string) (htmlinject.Snippets, error) {
+	snippets := make(htmlinject.Snippets)
+
+	for _, ext := range m.extensions {
+		var injections []Injection
+		if hookable, ok := ext.Extension.(ExtensionJSHookable); ok {
+			for _, p := range hookable.JSPaths() {
+				injections = append(injections, ScriptInjection{Src: p, Module: true})
+			}
+		}
+		if injector, ok := ext.Extension.(ExtensionHTMLInjector); ok {
+			injections = append(injections, injector.HTMLInjections()...)
+		}
+
+		base := path.Join(root, "x", ext.id)
+		for _, injection := range injections {
+			var b strings.Builder
+			if err := injection.appendHTML(&b, base); err != nil {
+				return nil, fmt.Errorf("extension %q: %w", ext.id, err)
+			}
+
+			slog.Debug(
+				"injecting into Degrees of Lewdity HTML file",
+				"extension", ext.id,
+				"at", injection.InjectAt(),
+				"html", b.String())
+
+			snippets[injection.InjectAt()] = append(snippets[injection.InjectAt()], b.String()...)
+		}
+	}
+
+	return snippets, nil
+}
+
+// PatchStory runs the story data in the game HTML through all extensions that
+// implement ExtensionStoryPatcher, in order, and returns the patched HTML. The
+// story data is only parsed if there is at least one such extension.
+func (m *ExtensionsManager) PatchStory(ctx context.Context, html []byte) ([]byte, error) {
+	var story *storydata.Story
+
+	for _, ext := range m.extensions {
+		patcher, ok := ext.Extension.(ExtensionStoryPatcher)
+		if !ok {
+			continue
+		}
+
+		if story == nil {
+			var err error
+			story, err = storydata.Parse(html)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse story data: %w", err)
+			}
+		}
+
+		if err := patcher.PatchStory(ext.context(ctx), story); err != nil {
+			return nil, fmt.Errorf("extension %q failed to patch story: %w", ext.id, err)
+		}
+
+		LoggerFromContext(ctx).Debug(
+			"patched Degrees of Lewdity story data",
+			"extension", ext.id)
+	}
+
+	if story == nil {
+		return html, nil
+	}
+	return story.Bytes(), nil
+}
+
+// PatchHTML runs the game HTML through all extensions that implement
+// ExtensionHTMLPatcher, in order, and returns the result.
+func (m *ExtensionsManager) PatchHTML(ctx context.Context, html []byte) ([]byte, error) {
+	for _, ext := range m.extensions {
+		patcher, ok := ext.Extension.(ExtensionHTMLPatcher)
+		if !ok {
+			continue
+		}
+
+		patched, err := patcher.PatchHTML(ext.context(ctx), html)
+		if err != nil {
+			return nil, fmt.Errorf("extension %q failed to patch HTML: %w", ext.id, err)
+		}
+
+		LoggerFromContext(ctx).Debug(
+			"patched Degrees of Lewdity HTML file",
+			"extension", ext.id,
+			"old_size", len(html),
+			"new_size", len(patched))
+
+		html = patched
+	}
+	return html, nil
+}
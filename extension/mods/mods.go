@@ -0,0 +1,224 @@
+// Package mods implements the mods extension. It loads mods from a directory
+// of Twee files, scripts and stylesheets and applies them to the game.
+package mods
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"libdb.so/dol-server/extension"
+	"libdb.so/dol-server/storydata"
+)
+
+// Extension is the extension info for the mods extension.
+var Extension = extension.ExtensionInfo{
+	ID:  "mods",
+	New: New,
+}
+
+func init() { extension.Register(Extension) }
+
+// Config is the configuration for the mods extension.
+type Config struct {
+	// Path is the directory that contains the mods. Every .twee or .tw file
+	// in it is a set of passages that are added to the game or override the
+	// game's passages of the same name. Every .js and .css file in it is
+	// injected into the game. Subdirectories are searched as well.
+	// If unset, a directory in os.UserConfigDir() is used.
+	Path string `json:"path"`
+}
+
+type modsExtension struct {
+	*chi.Mux
+	cfg        Config
+	passages   []modPassage
+	injections []extension.Injection
+}
+
+// modPassage is a passage along with the file that it came from.
+type modPassage struct {
+	storydata.Passage
+	file string
+}
+
+var (
+	_ extension.Extension             = (*modsExtension)(nil)
+	_ extension.ExtensionHTTPHandler  = (*modsExtension)(nil)
+	_ extension.ExtensionHTMLInjector = (*modsExtension)(nil)
+	_ extension.ExtensionStoryPatcher = (*modsExtension)(nil)
+	_ extension.ExtensionDataDir      = (*modsExtension)(nil)
+)
+
+// New returns a new mods extension.
+func New(cfgJSON json.RawMessage) (extension.Extension, error) {
+	var cfg Config
+	if err := json.Unmarshal(cfgJSON, &cfg); err != nil {
+		return nil, fmt.Errorf("unmarshaling config: %w", err)
+	}
+
+	if cfg.Path == "" {
+		base, err := os.UserConfigDir()
+		if err != nil {
+			return nil, fmt.Errorf("getting user config dir: %w", err)
+		}
+		cfg.Path = filepath.Join(base, "dol-server", "mods")
+	}
+
+	if err := os.MkdirAll(cfg.Path, 0755); err != nil {
+		return nil, fmt.Errorf("creating mods path: %w", err)
+	}
+
+	e := &modsExtension{
+		Mux: chi.NewRouter(),
+		cfg: cfg,
+	}
+
+	if err := e.loadMods(); err != nil {
+		return nil, err
+	}
+
+	e.Mount("/", http.StripPrefix("/x/mods", http.FileServer(http.Dir(cfg.Path))))
+
+	return e, nil
+}
+
+// loadMods reads all mods in the mods directory. Files are read in lexical
+// order, so the order of injected scripts and stylesheets is predictable.
+func (e *modsExtension) loadMods() error {
+	owners := make(map[string]string) // passage name -> file
+
+	return fs.WalkDir(os.DirFS(e.cfg.Path), ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		switch strings.ToLower(path.Ext(name)) {
+		case ".twee", ".tw":
+			src, err := os.ReadFile(filepath.Join(e.cfg.Path, filepath.FromSlash(name)))
+			if err != nil {
+				return fmt.Errorf("reading mod: %w", err)
+			}
+
+			passages, err := storydata.ParseTwee(src)
+			if err != nil {
+				return fmt.Errorf("parsing mod %q: %w", name, err)
+			}
+
+			for _, p := range passages {
+				if isSpecialTweePassage(p.Name) {
+					continue
+				}
+				if owner, ok := owners[p.Name]; ok {
+					if owner == name {
+						return fmt.Errorf(
+							"mod %q defines passage %q more than once",
+							name, p.Name)
+					}
+					return fmt.Errorf(
+						"mods %q and %q both define passage %q",
+						owner, name, p.Name)
+				}
+				owners[p.Name] = name
+				e.passages = append(e.passages, modPassage{p, name})
+			}
+
+		case ".js":
+			// Classic scripts at the end of the body run after SugarCube is
+			// defined but before the story starts, so they can add macros.
+			e.injections = append(e.injections, extension.ScriptInjection{
+				At:  extension.InjectBodyEnd,
+				Src: fileURL(name),
+			})
+
+		case ".mjs":
+			e.injections = append(e.injections, extension.ScriptInjection{
+				At:     extension.InjectBodyEnd,
+				Src:    fileURL(name),
+				Module: true,
+			})
+
+		case ".css":
+			e.injections = append(e.injections, extension.StylesheetInjection{
+				Href: fileURL(name),
+			})
+		}
+
+		return nil
+	})
+}
+
+// isSpecialTweePassage returns true for passages that only describe the story
+// in Twee files. They must not end up in the game.
+func isSpecialTweePassage(name string) bool {
+	return name == "StoryTitle" || name == "StoryData"
+}
+
+// fileURL returns the URL of the given mod file, relative to the extension.
+func fileURL(name string) string {
+	return "/" + (&url.URL{Path: name}).EscapedPath()
+}
+
+// PatchStory implements extension.ExtensionStoryPatcher.
+func (e *modsExtension) PatchStory(ctx context.Context, story *storydata.Story) error {
+	log := extension.LoggerFromContext(ctx)
+
+	files := make(map[string]int)
+	for _, p := range e.passages {
+		if story.Passage(p.Name) != nil {
+			log.Debug(
+				"mod overrides passage",
+				"file", p.file,
+				"passage", p.Name)
+		}
+		story.SetPassage(p.Passage)
+		files[p.file]++
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		log.Info(
+			"applied mod",
+			"file", name,
+			"passages", files[name])
+	}
+
+	return nil
+}
+
+// HTMLInjections implements extension.ExtensionHTMLInjector.
+func (e *modsExtension) HTMLInjections() []extension.Injection {
+	return e.injections
+}
+
+// Start implements extension.Extension.
+func (e *modsExtension) Start(context.Context) error { return nil }
+
+// Stop implements extension.Extension.
+func (e *modsExtension) Stop() error { return nil }
+
+// DataDir implements extension.ExtensionDataDir.
+func (e *modsExtension) DataDir() string { return e.cfg.Path }
+
+// LockData implements extension.ExtensionDataDir. Mods are only ever read, so
+// there is nothing to lock.
+func (e *modsExtension) LockData(context.Context) (func(), error) {
+	return func() {}, nil
+}
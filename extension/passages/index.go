@@ -0,0 +1,310 @@
+package passages
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"libdb.so/dol-server/storydata"
+)
+
+// passage is an indexed passage.
+type passage struct {
+	Name  string
+	Tags  []string
+	Text  string
+	Links []link
+}
+
+// link is an edge in the passage graph.
+type link struct {
+	To   string
+	Kind linkKind
+}
+
+type linkKind string
+
+const (
+	// linkWiki is a [[link]].
+	linkWiki linkKind = "link"
+	// linkMacro is a <<link>> or <<button>> macro.
+	linkMacro linkKind = "macro"
+	// linkGoto is a <<goto>> macro.
+	linkGoto linkKind = "goto"
+)
+
+// index is a full-text index over all passages of a single game.
+type index struct {
+	passages []passage
+	byName   map[string]int
+	// terms maps each term to the passages that contain it, along with how
+	// often the term occurs in each passage.
+	terms map[string]map[int]int
+}
+
+func newIndex(story *storydata.Story) *index {
+	idx := &index{
+		byName: make(map[string]int),
+		terms:  make(map[string]map[int]int),
+	}
+
+	for _, p := range story.Passages() {
+		i := len(idx.passages)
+		idx.passages = append(idx.passages, passage{
+			Name: p.Name,
+			Tags: p.Tags,
+			Text: p.Text,
+		})
+		idx.byName[p.Name] = i
+
+		for _, term := range tokenize(p.Name + " " + p.Text) {
+			postings, ok := idx.terms[term]
+			if !ok {
+				postings = make(map[int]int)
+				idx.terms[term] = postings
+			}
+			postings[i]++
+		}
+	}
+
+	// Links can only be resolved once all passages are known.
+	for i := range idx.passages {
+		p := &idx.passages[i]
+		for _, l := range findLinks(p.Text) {
+			if _, ok := idx.byName[l.To]; ok {
+				p.Links = append(p.Links, l)
+			}
+		}
+	}
+
+	return idx
+}
+
+// neighborhood returns the passages within depth links of the given passage,
+// following links in either direction.
+func (idx *index) neighborhood(from string, depth int) map[string]bool {
+	adjacent := make(map[string][]string)
+	for _, p := range idx.passages {
+		for _, l := range p.Links {
+			adjacent[p.Name] = append(adjacent[p.Name], l.To)
+			adjacent[l.To] = append(adjacent[l.To], p.Name)
+		}
+	}
+
+	seen := map[string]bool{from: true}
+	frontier := []string{from}
+	for ; depth > 0 && len(frontier) > 0; depth-- {
+		var next []string
+		for _, name := range frontier {
+			for _, adj := range adjacent[name] {
+				if !seen[adj] {
+					seen[adj] = true
+					next = append(next, adj)
+				}
+			}
+		}
+		frontier = next
+	}
+
+	return seen
+}
+
+// tokenize splits text into lowercase terms.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// searchResult is a single search result.
+type searchResult struct {
+	Name    string   `json:"name"`
+	Tags    []string `json:"tags,omitempty"`
+	Score   int      `json:"score"`
+	Snippet string   `json:"snippet"`
+}
+
+// nameMatchScore is added to the score of a passage for every query term that
+// appears in its name, since people usually search for scenes by name.
+const nameMatchScore = 10
+
+// search returns the passages that contain all terms in the query, best
+// matches first.
+func (idx *index) search(query string, limit int) []searchResult {
+	terms := tokenize(query)
+	if len(terms) == 0 {
+		return nil
+	}
+
+	var scores map[int]int
+	for _, term := range terms {
+		postings := idx.terms[term]
+		next := make(map[int]int, len(postings))
+		for i, count := range postings {
+			if scores == nil {
+				next[i] = count
+			} else if score, ok := scores[i]; ok {
+				next[i] = score + count
+			}
+		}
+		scores = next
+	}
+
+	results := make([]searchResult, 0, len(scores))
+	for i, score := range scores {
+		p := idx.passages[i]
+		name := strings.ToLower(p.Name)
+		for _, term := range terms {
+			if strings.Contains(name, term) {
+				score += nameMatchScore
+			}
+		}
+
+		results = append(results, searchResult{
+			Name:    p.Name,
+			Tags:    p.Tags,
+			Score:   score,
+			Snippet: snippet(p.Text, terms[0]),
+		})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Name < results[j].Name
+	})
+
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	return results
+}
+
+// snippetRadius is the number of bytes shown around a match in a snippet.
+const snippetRadius = 60
+
+// snippet returns the text around the first occurrence of term, which must be
+// in lower case.
+func snippet(text, term string) string {
+	i, n := indexLower(text, term)
+	if i == -1 {
+		i, n = 0, 0
+	}
+
+	start := max(i-snippetRadius, 0)
+	end := min(i+n+snippetRadius, len(text))
+
+	// Don't cut UTF-8 sequences in half.
+	for start > 0 && !isRuneStart(text[start]) {
+		start--
+	}
+	for end < len(text) && !isRuneStart(text[end]) {
+		end++
+	}
+
+	s := strings.Join(strings.Fields(text[start:end]), " ")
+	if start > 0 {
+		s = "…" + s
+	}
+	if end < len(text) {
+		s += "…"
+	}
+	return s
+}
+
+func isRuneStart(b byte) bool { return b&0xC0 != 0x80 }
+
+// indexLower returns the byte offset and length of the first occurrence of
+// term in text, comparing text in lower case. term must be in lower case. The
+// offset and length are those in text itself, since lowercasing can change
+// the length of a character. It returns -1 if term is not found.
+func indexLower(text, term string) (int, int) {
+	var buf [utf8.UTFMax]byte
+	for i := range text {
+		j, k := i, 0
+		for k < len(term) && j < len(text) {
+			r, size := utf8.DecodeRuneInString(text[j:])
+			lower := buf[:utf8.EncodeRune(buf[:], unicode.ToLower(r))]
+			if !strings.HasPrefix(term[k:], string(lower)) {
+				break
+			}
+			j += size
+			k += len(lower)
+		}
+		if k == len(term) {
+			return i, j - i
+		}
+	}
+	return -1, 0
+}
+
+var (
+	wikiLinkRegex = regexp.MustCompile(`\[\[(.*?)\]\]`)
+	// macroLinkRegex matches <<link "text" "passage">> and its <<button>>
+	// equivalent. Links whose passage is an expression cannot be followed.
+	macroLinkRegex = regexp.MustCompile(`<<(?:link|button)\s+(?:"(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*')\s+("(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*')`)
+	gotoRegex      = regexp.MustCompile(`<<goto\s+("(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*')`)
+)
+
+// findLinks returns the passages that the passage text links to, in order of
+// appearance, without duplicates.
+func findLinks(text string) []link {
+	type match struct {
+		pos int
+		link
+	}
+	var matches []match
+
+	for _, m := range wikiLinkRegex.FindAllStringSubmatchIndex(text, -1) {
+		if to := wikiLinkTarget(text[m[2]:m[3]]); to != "" {
+			matches = append(matches, match{m[0], link{to, linkWiki}})
+		}
+	}
+	for _, m := range macroLinkRegex.FindAllStringSubmatchIndex(text, -1) {
+		matches = append(matches, match{m[0], link{unquote(text[m[2]:m[3]]), linkMacro}})
+	}
+	for _, m := range gotoRegex.FindAllStringSubmatchIndex(text, -1) {
+		matches = append(matches, match{m[0], link{unquote(text[m[2]:m[3]]), linkGoto}})
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].pos < matches[j].pos })
+
+	seen := make(map[link]bool, len(matches))
+	links := make([]link, 0, len(matches))
+	for _, m := range matches {
+		if !seen[m.link] {
+			seen[m.link] = true
+			links = append(links, m.link)
+		}
+	}
+	return links
+}
+
+// wikiLinkTarget returns the passage of the inside of a [[link]], which is one
+// of "passage", "text|passage", "text->passage" or "passage<-text", optionally
+// followed by a "][$setter" part.
+func wikiLinkTarget(inner string) string {
+	if i := strings.Index(inner, "]["); i != -1 {
+		inner = inner[:i]
+	}
+
+	switch {
+	case strings.Contains(inner, "|"):
+		inner = inner[strings.LastIndex(inner, "|")+1:]
+	case strings.Contains(inner, "->"):
+		inner = inner[strings.LastIndex(inner, "->")+2:]
+	case strings.Contains(inner, "<-"):
+		inner = inner[:strings.Index(inner, "<-")]
+	}
+
+	return strings.TrimSpace(inner)
+}
+
+func unquote(s string) string {
+	s = s[1 : len(s)-1]
+	return strings.NewReplacer(`\"`, `"`, `\'`, `'`, `\\`, `\`).Replace(s)
+}
@@ -0,0 +1,51 @@
+package passages
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSnippet(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		term string
+		want string
+	}{
+		{
+			name: "short",
+			text: "You walk into the Forest.",
+			term: "forest",
+			want: "You walk into the Forest.",
+		},
+		{
+			name: "cut",
+			text: strings.Repeat("a ", 50) + "Forest" + strings.Repeat(" b", 50),
+			term: "forest",
+			want: "…" + strings.TrimSpace(strings.Repeat("a ", 30)) + " Forest " +
+				strings.TrimSpace(strings.Repeat(" b", 30)) + "…",
+		},
+		{
+			// Ⱥ is 2 bytes long, but its lower case ⱥ is 3 bytes long.
+			name: "lowercase is longer",
+			text: strings.Repeat("Ⱥ", 100) + " forest",
+			term: "forest",
+			want: "…" + strings.Repeat("Ⱥ", 30) + " forest",
+		},
+		{
+			name: "not found",
+			text: "You walk into the forest.",
+			term: "lake",
+			want: "You walk into the forest.",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := snippet(test.text, test.term)
+			if got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
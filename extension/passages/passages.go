@@ -0,0 +1,232 @@
+// Package passages implements the passages extension. It indexes the passages
+// of the game for full-text search and exports the link graph between them.
+package passages
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+	"libdb.so/dol-server/extension"
+	"libdb.so/dol-server/storydata"
+)
+
+// Extension is the extension info for the passages extension.
+var Extension = extension.ExtensionInfo{
+	ID:  "passages",
+	New: New,
+}
+
+func init() { extension.Register(Extension) }
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 200
+)
+
+type passagesExtension struct {
+	*chi.Mux
+
+	indexesMu sync.RWMutex
+	indexes   map[string]*index // keyed by game name
+}
+
+var (
+	_ extension.Extension             = (*passagesExtension)(nil)
+	_ extension.ExtensionHTTPHandler  = (*passagesExtension)(nil)
+	_ extension.ExtensionStoryPatcher = (*passagesExtension)(nil)
+)
+
+// New returns a new passages extension.
+func New(json.RawMessage) (extension.Extension, error) {
+	e := &passagesExtension{
+		Mux:     chi.NewRouter(),
+		indexes: make(map[string]*index),
+	}
+
+	e.Get("/search", e.handleSearch)
+	e.Get("/graph.json", e.handleGraphJSON)
+	e.Get("/graph.dot", e.handleGraphDOT)
+
+	return e, nil
+}
+
+// PatchStory implements extension.ExtensionStoryPatcher. The story is only
+// indexed, not changed. Since extensions run in order, the index includes
+// passages added by extensions such as mods.
+func (e *passagesExtension) PatchStory(ctx context.Context, story *storydata.Story) error {
+	idx := newIndex(story)
+
+	e.indexesMu.Lock()
+	e.indexes[extension.GameFromContext(ctx)] = idx
+	e.indexesMu.Unlock()
+
+	extension.LoggerFromContext(ctx).Debug(
+		"indexed passages",
+		"passages", len(idx.passages),
+		"terms", len(idx.terms))
+
+	return nil
+}
+
+func (e *passagesExtension) indexFor(ctx context.Context) *index {
+	e.indexesMu.RLock()
+	defer e.indexesMu.RUnlock()
+	return e.indexes[extension.GameFromContext(ctx)]
+}
+
+func (e *passagesExtension) handleSearch(w http.ResponseWriter, r *http.Request) {
+	idx := e.indexFor(r.Context())
+	if idx == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("game is not loaded yet"))
+		return
+	}
+
+	limit := defaultSearchLimit
+	if s := r.FormValue("limit"); s != "" {
+		l, err := strconv.Atoi(s)
+		if err != nil || l < 1 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", s))
+			return
+		}
+		limit = min(l, maxSearchLimit)
+	}
+
+	type SearchResponse struct {
+		Results []searchResult `json:"results"`
+	}
+
+	results := idx.search(r.FormValue("q"), limit)
+	if results == nil {
+		results = []searchResult{}
+	}
+
+	writeJSON(w, http.StatusOK, SearchResponse{Results: results})
+}
+
+// graph is the link graph between passages.
+type graph struct {
+	Nodes []graphNode `json:"nodes"`
+	Edges []graphEdge `json:"edges"`
+}
+
+type graphNode struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags,omitempty"`
+}
+
+type graphEdge struct {
+	From string   `json:"from"`
+	To   string   `json:"to"`
+	Kind linkKind `json:"kind"`
+}
+
+// graphFor returns the link graph of the request's game. If the "from" query
+// parameter is given, only passages within "depth" links of that passage
+// (default 1) are included, in either direction.
+func (e *passagesExtension) graphFor(r *http.Request) (*graph, int, error) {
+	idx := e.indexFor(r.Context())
+	if idx == nil {
+		return nil, http.StatusServiceUnavailable, fmt.Errorf("game is not loaded yet")
+	}
+
+	include := func(string) bool { return true }
+
+	if from := r.FormValue("from"); from != "" {
+		if _, ok := idx.byName[from]; !ok {
+			return nil, http.StatusNotFound, fmt.Errorf("passage %q not found", from)
+		}
+
+		depth := 1
+		if s := r.FormValue("depth"); s != "" {
+			d, err := strconv.Atoi(s)
+			if err != nil || d < 0 {
+				return nil, http.StatusBadRequest, fmt.Errorf("invalid depth %q", s)
+			}
+			depth = d
+		}
+
+		reachable := idx.neighborhood(from, depth)
+		include = func(name string) bool { return reachable[name] }
+	}
+
+	var g graph
+	for _, p := range idx.passages {
+		if !include(p.Name) {
+			continue
+		}
+		g.Nodes = append(g.Nodes, graphNode{Name: p.Name, Tags: p.Tags})
+		for _, l := range p.Links {
+			if include(l.To) {
+				g.Edges = append(g.Edges, graphEdge{From: p.Name, To: l.To, Kind: l.Kind})
+			}
+		}
+	}
+
+	return &g, http.StatusOK, nil
+}
+
+func (e *passagesExtension) handleGraphJSON(w http.ResponseWriter, r *http.Request) {
+	g, code, err := e.graphFor(r)
+	if err != nil {
+		writeError(w, code, err)
+		return
+	}
+	writeJSON(w, code, g)
+}
+
+func (e *passagesExtension) handleGraphDOT(w http.ResponseWriter, r *http.Request) {
+	g, code, err := e.graphFor(r)
+	if err != nil {
+		writeError(w, code, err)
+		return
+	}
+
+	var dot strings.Builder
+	dot.WriteString("digraph passages {\n")
+	for _, n := range g.Nodes {
+		fmt.Fprintf(&dot, "\t%s;\n", dotQuote(n.Name))
+	}
+	for _, edge := range g.Edges {
+		fmt.Fprintf(&dot, "\t%s -> %s", dotQuote(edge.From), dotQuote(edge.To))
+		if edge.Kind != linkWiki {
+			fmt.Fprintf(&dot, " [label=%s]", dotQuote(string(edge.Kind)))
+		}
+		dot.WriteString(";\n")
+	}
+	dot.WriteString("}\n")
+
+	w.Header().Set("Content-Type", "text/vnd.graphviz; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write([]byte(dot.String()))
+}
+
+// dotQuote quotes a string as a Graphviz DOT ID.
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, obj any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(obj)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, struct {
+		Error string `json:"error"`
+	}{
+		Error: err.Error(),
+	})
+}
+
+// Start implements extension.Extension.
+func (e *passagesExtension) Start(context.Context) error { return nil }
+
+// Stop implements extension.Extension.
+func (e *passagesExtension) Stop() error { return nil }
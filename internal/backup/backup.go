@@ -0,0 +1,441 @@
+// Package backup makes backups of the data directories of extensions. Every
+// backup is a tar.gz archive with a directory for each extension, named after
+// the time that it was made.
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"libdb.so/dol-server/internal/retention"
+)
+
+// Config configures where backups are stored, how often they are made and
+// which ones are kept. A backup is kept if any of the rules keeps it. If no
+// rule is set, the defaults are used.
+type Config struct {
+	// Path is the directory that backups are stored in.
+	Path string `json:"path"`
+	// Interval is how often a backup is made, such as "6h". It defaults to an
+	// hour.
+	Interval string `json:"interval"`
+	// KeepHourly is the number of most recent hours to keep the last backup
+	// of.
+	KeepHourly int `json:"keep_hourly"`
+	// KeepDaily is the number of most recent days to keep the last backup of.
+	KeepDaily int `json:"keep_daily"`
+	// KeepWeekly is the number of most recent weeks to keep the last backup
+	// of.
+	KeepWeekly int `json:"keep_weekly"`
+}
+
+const (
+	defaultInterval   = time.Hour
+	defaultKeepHourly = 24
+	defaultKeepDaily  = 7
+	defaultKeepWeekly = 4
+)
+
+// Validate checks the config.
+func (c Config) Validate() error {
+	if c.Path == "" {
+		return fmt.Errorf("no path")
+	}
+	if c.KeepHourly < 0 || c.KeepDaily < 0 || c.KeepWeekly < 0 {
+		return fmt.Errorf("retention must not be negative")
+	}
+	_, err := c.interval()
+	return err
+}
+
+// ValidateSources checks that the backups are not stored in the directory of
+// any of the sources. Otherwise, every backup would include all earlier
+// backups, and restoring a backup would delete them.
+func (c Config) ValidateSources(sources []Source) error {
+	return checkOutsideSources(c.Path, sources)
+}
+
+// checkOutsideSources returns an error if dir is within the directory of any
+// of the sources that own their whole directory.
+func checkOutsideSources(dir string, sources []Source) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, src := range sources {
+		if len(src.Files) > 0 {
+			continue
+		}
+
+		srcDir, err := filepath.Abs(src.Dir)
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(srcDir, dir)
+		if err == nil && filepath.IsLocal(rel) {
+			return fmt.Errorf("backups in %s would be inside the data directory of %s", dir, src.Name)
+		}
+	}
+
+	return nil
+}
+
+func (c Config) interval() (time.Duration, error) {
+	if c.Interval == "" {
+		return defaultInterval, nil
+	}
+
+	interval, err := time.ParseDuration(c.Interval)
+	if err != nil {
+		return 0, fmt.Errorf("invalid interval: %w", err)
+	}
+	if interval < time.Minute {
+		return 0, fmt.Errorf("interval must be at least a minute")
+	}
+	return interval, nil
+}
+
+// retention returns the retention rules of the config, or the default rules if
+// none are set.
+func (c Config) retention() retention.Rules {
+	if c.KeepHourly == 0 && c.KeepDaily == 0 && c.KeepWeekly == 0 {
+		c.KeepHourly = defaultKeepHourly
+		c.KeepDaily = defaultKeepDaily
+		c.KeepWeekly = defaultKeepWeekly
+	}
+	return retention.Rules{
+		Hourly: c.KeepHourly,
+		Daily:  c.KeepDaily,
+		Weekly: c.KeepWeekly,
+	}
+}
+
+// Source is a directory that is backed up.
+type Source struct {
+	// Name is the name of the source's directory in backups. It is the ID of
+	// the extension that the directory belongs to.
+	Name string
+	// Dir is the directory that is backed up.
+	Dir string
+	// Files are the names of the files in Dir that belong to the source, if
+	// the source does not own all of Dir. Only those files are backed up,
+	// restored or removed, and the rest of Dir is left alone.
+	Files []string
+	// Lock stops the directory from being written to until unlock is called.
+	// It is held while the directory is backed up or restored.
+	Lock func(ctx context.Context) (unlock func(), err error)
+}
+
+// owns returns true if the file with the given slash-separated path within Dir
+// belongs to the source.
+func (src Source) owns(rel string) bool {
+	if len(src.Files) == 0 {
+		return true
+	}
+	for _, name := range src.Files {
+		if filepath.ToSlash(name) == rel {
+			return true
+		}
+	}
+	return false
+}
+
+// Backup describes a backup.
+type Backup struct {
+	// Name is the file name of the backup.
+	Name string
+	// Path is the path to the backup.
+	Path string
+	// Time is when the backup was made.
+	Time time.Time
+	// Size is the size of the backup in bytes.
+	Size int64
+}
+
+const (
+	backupPrefix     = "dol-server-"
+	backupSuffix     = ".tar.gz"
+	backupTimeFormat = "20060102-150405"
+)
+
+// isLockFile returns true if the file is a lock file. Lock files only matter
+// to running processes, so they are never backed up or restored.
+func isLockFile(name string) bool {
+	return strings.HasSuffix(name, ".lock")
+}
+
+// Create makes a backup of the given sources in dir. Every source is locked
+// while it is copied.
+func Create(ctx context.Context, dir string, sources []Source) (*Backup, error) {
+	if err := checkOutsideSources(dir, sources); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating backup path: %w", err)
+	}
+
+	now := time.Now()
+	name := backupPrefix + now.Format(backupTimeFormat) + backupSuffix
+	dst := filepath.Join(dir, name)
+
+	if _, err := os.Stat(dst); err == nil {
+		return nil, fmt.Errorf("backup %s already exists", name)
+	}
+
+	f, err := os.CreateTemp(dir, "."+name+".tmp-*")
+	if err != nil {
+		return nil, fmt.Errorf("creating backup file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	for _, src := range sortedSources(sources) {
+		if err := addSource(ctx, tw, src, now); err != nil {
+			return nil, fmt.Errorf("backing up %s: %w", src.Name, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("writing backup: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, fmt.Errorf("writing backup: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return nil, fmt.Errorf("writing backup: %w", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("writing backup: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("writing backup: %w", err)
+	}
+	if err := os.Rename(f.Name(), dst); err != nil {
+		return nil, fmt.Errorf("writing backup: %w", err)
+	}
+
+	return &Backup{
+		Name: name,
+		Path: dst,
+		Time: now,
+		Size: info.Size(),
+	}, nil
+}
+
+func sortedSources(sources []Source) []Source {
+	sources = append([]Source(nil), sources...)
+	sort.Slice(sources, func(i, j int) bool {
+		return sources[i].Name < sources[j].Name
+	})
+	return sources
+}
+
+// addSource adds the files of the source to the archive under the source's
+// name. A source whose directory or files do not exist yet is added as an
+// empty directory.
+func addSource(ctx context.Context, tw *tar.Writer, src Source, now time.Time) error {
+	unlock, err := src.Lock(ctx)
+	if err != nil {
+		return fmt.Errorf("locking data: %w", err)
+	}
+	defer unlock()
+
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     src.Name + "/",
+		Mode:     0755,
+		ModTime:  now,
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(src.Files) > 0 {
+		for _, name := range src.Files {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !filepath.IsLocal(name) {
+				return fmt.Errorf("invalid file %q", name)
+			}
+
+			p := filepath.Join(src.Dir, name)
+			info, err := os.Lstat(p)
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					continue
+				}
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				continue
+			}
+
+			if err := addFile(tw, src, p, name, info); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	err = filepath.WalkDir(src.Dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if p == src.Dir {
+			return nil
+		}
+
+		// Only back up plain files and directories, and skip anything that
+		// is left over from an interrupted restore.
+		if !d.IsDir() && (!d.Type().IsRegular() || isLockFile(d.Name())) {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), restoreTempPrefix) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(src.Dir, p)
+		if err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if !d.IsDir() {
+			return addFile(tw, src, p, rel, info)
+		}
+
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = path.Join(src.Name, filepath.ToSlash(rel)) + "/"
+		return tw.WriteHeader(hdr)
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// addFile adds the file at p to the archive, as rel within the source.
+func addFile(tw *tar.Writer, src Source, p, rel string, info fs.FileInfo) error {
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = path.Join(src.Name, filepath.ToSlash(rel))
+
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(tw, f, hdr.Size); err != nil {
+		return fmt.Errorf("copying %s: %w", rel, err)
+	}
+	return nil
+}
+
+// List returns the backups in dir, newest first.
+func List(dir string) ([]Backup, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var backups []Backup
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, backupPrefix) || !strings.HasSuffix(name, backupSuffix) {
+			continue
+		}
+
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, backupPrefix), backupSuffix)
+		t, err := time.ParseInLocation(backupTimeFormat, stamp, time.Local)
+		if err != nil {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		backups = append(backups, Backup{
+			Name: name,
+			Path: filepath.Join(dir, name),
+			Time: t,
+			Size: info.Size(),
+		})
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Time.After(backups[j].Time)
+	})
+
+	return backups, nil
+}
+
+// Prune deletes the backups in the config's path that no retention rule of
+// the config keeps, and returns them.
+func Prune(cfg Config) ([]Backup, error) {
+	backups, err := List(cfg.Path)
+	if err != nil {
+		return nil, fmt.Errorf("listing backups: %w", err)
+	}
+
+	times := make([]time.Time, len(backups))
+	for i, backup := range backups {
+		times[i] = backup.Time
+	}
+	keep := cfg.retention().Kept(times)
+
+	var pruned []Backup
+	for i, backup := range backups {
+		if keep[i] {
+			continue
+		}
+		if err := os.Remove(backup.Path); err != nil {
+			return pruned, fmt.Errorf("deleting backup: %w", err)
+		}
+		pruned = append(pruned, backup)
+	}
+
+	return pruned, nil
+}
@@ -0,0 +1,228 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// restoreTempPrefix is the prefix of the temporary files that restored files
+// are written to before they replace the files of a source.
+const restoreTempPrefix = ".dol-server-restore-"
+
+// Restore replaces the data of the sources with their data in the backup at
+// the given path and returns the names of the sources that it restored.
+// Sources that are not in the backup are left alone. The backup is read in
+// full before any source is touched, so a damaged backup changes nothing.
+// The restored sources stay locked until all of them are restored.
+func Restore(ctx context.Context, backupPath string, sources []Source) ([]string, error) {
+	contents := make(map[string]map[string]bool)
+	err := walkBackup(ctx, backupPath, func(name, rel string, hdr *tar.Header, r io.Reader) error {
+		files, ok := contents[name]
+		if !ok {
+			files = make(map[string]bool)
+			contents[name] = files
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			files[rel] = true
+		}
+		_, err := io.Copy(io.Discard, r)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading backup: %w", err)
+	}
+
+	var restoring []Source
+	for _, src := range sortedSources(sources) {
+		if _, ok := contents[src.Name]; ok {
+			restoring = append(restoring, src)
+		}
+	}
+	if len(restoring) == 0 {
+		return nil, fmt.Errorf("backup has none of the configured extensions")
+	}
+
+	// Restoring removes the files that are not in the backup, which would
+	// include the backup itself.
+	if err := checkOutsideSources(filepath.Dir(backupPath), restoring); err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]Source, len(restoring))
+	for _, src := range restoring {
+		unlock, err := src.Lock(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("locking data of %s: %w", src.Name, err)
+		}
+		defer unlock()
+
+		if err := os.MkdirAll(src.Dir, 0755); err != nil {
+			return nil, fmt.Errorf("creating data directory of %s: %w", src.Name, err)
+		}
+		byName[src.Name] = src
+	}
+
+	err = walkBackup(ctx, backupPath, func(name, rel string, hdr *tar.Header, r io.Reader) error {
+		src, ok := byName[name]
+		if !ok || rel == "" {
+			return nil
+		}
+		if len(src.Files) > 0 && (hdr.Typeflag == tar.TypeDir || !src.owns(rel)) {
+			// Never write anything else into a directory that the source
+			// only shares.
+			return nil
+		}
+
+		dst := filepath.Join(src.Dir, filepath.FromSlash(rel))
+		if hdr.Typeflag == tar.TypeDir {
+			return os.MkdirAll(dst, 0755)
+		}
+		if err := restoreFile(dst, r, hdr.FileInfo().Mode().Perm(), hdr.ModTime); err != nil {
+			return fmt.Errorf("restoring %s of %s: %w", rel, name, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(restoring))
+	for _, src := range restoring {
+		if err := removeExtraFiles(src, contents[src.Name]); err != nil {
+			return nil, fmt.Errorf("removing files of %s that are not in the backup: %w", src.Name, err)
+		}
+		names = append(names, src.Name)
+	}
+
+	return names, nil
+}
+
+// walkBackup calls fn for every entry of the backup at the given path, along
+// with the name of the entry's source and its slash-separated path within the
+// source. The entry of the source's directory itself has an empty path. Entries
+// that are not plain files or directories, or that point outside of their
+// source, are an error.
+func walkBackup(ctx context.Context, backupPath string, fn func(name, rel string, hdr *tar.Header, r io.Reader) error) error {
+	f, err := os.Open(backupPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return err
+		}
+
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeDir {
+			return fmt.Errorf("unsupported entry %q", hdr.Name)
+		}
+
+		name, rel, _ := strings.Cut(strings.TrimSuffix(hdr.Name, "/"), "/")
+		if name == "" || (rel != "" && !filepath.IsLocal(filepath.FromSlash(rel))) {
+			return fmt.Errorf("invalid entry %q", hdr.Name)
+		}
+
+		if err := fn(name, rel, hdr, tr); err != nil {
+			return err
+		}
+	}
+
+	// Read the rest of the stream, so that the gzip checksum is verified.
+	_, err = io.Copy(io.Discard, gz)
+	return err
+}
+
+// restoreFile atomically replaces the file at dst with the contents of r.
+func restoreFile(dst string, r io.Reader, perm fs.FileMode, modTime time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(dst), restoreTempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chtimes(f.Name(), modTime, modTime); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), dst)
+}
+
+// removeExtraFiles removes the files of the source that are not in files.
+// Lock files are kept, since processes that share the source may hold them.
+// If the source only owns some files of its directory, only those are
+// removed.
+func removeExtraFiles(src Source, files map[string]bool) error {
+	if len(src.Files) > 0 {
+		for _, name := range src.Files {
+			if files[filepath.ToSlash(name)] || !filepath.IsLocal(name) {
+				continue
+			}
+			err := os.Remove(filepath.Join(src.Dir, name))
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return filepath.WalkDir(src.Dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || isLockFile(d.Name()) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(src.Dir, p)
+		if err != nil {
+			return err
+		}
+		if files[filepath.ToSlash(rel)] {
+			return nil
+		}
+
+		return os.Remove(p)
+	})
+}
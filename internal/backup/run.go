@@ -0,0 +1,89 @@
+package backup
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Run makes a backup of the sources every interval of the config and prunes
+// the backups that are no longer kept, until ctx is done. The first backup is
+// made once an interval has passed since the newest backup, so restarting the
+// server does not make a backup every time. The config must be valid.
+func Run(ctx context.Context, cfg Config, sources []Source) {
+	interval, err := cfg.interval()
+	if err != nil {
+		panic(err)
+	}
+
+	var failed bool
+	for {
+		wait := interval
+		if !failed {
+			wait = untilNextBackup(cfg.Path, interval)
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+
+		failed = !runOnce(ctx, cfg, sources)
+	}
+}
+
+// untilNextBackup returns how long to wait until the next backup is due.
+func untilNextBackup(dir string, interval time.Duration) time.Duration {
+	backups, err := List(dir)
+	if err != nil {
+		slog.Error(
+			"failed to list backups",
+			"path", dir,
+			"error", err)
+		return interval
+	}
+
+	if len(backups) == 0 {
+		return 0
+	}
+	return time.Until(backups[0].Time.Add(interval))
+}
+
+// runOnce makes a backup and prunes old backups. It returns false if the
+// backup could not be made.
+func runOnce(ctx context.Context, cfg Config, sources []Source) bool {
+	backup, err := Create(ctx, cfg.Path, sources)
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Error(
+				"failed to create backup",
+				"path", cfg.Path,
+				"error", err)
+		}
+		return false
+	}
+
+	slog.Info(
+		"created backup",
+		"backup", backup.Path,
+		"size", backup.Size)
+
+	pruned, err := Prune(cfg)
+	if err != nil {
+		slog.Error(
+			"failed to prune backups",
+			"path", cfg.Path,
+			"error", err)
+	}
+
+	for _, backup := range pruned {
+		slog.Debug(
+			"pruned backup",
+			"backup", backup.Path)
+	}
+
+	return true
+}
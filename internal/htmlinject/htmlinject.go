@@ -0,0 +1,168 @@
+// Package htmlinject injects HTML snippets into an HTML document. It tokenizes
+// the document to find the real head and body, so tags that only appear inside
+// scripts, styles or comments are never mistaken for them.
+package htmlinject
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Point is a point in the document where snippets can be injected.
+type Point uint8
+
+const (
+	// HeadEnd is right before the closing </head> tag. It is the zero value,
+	// since that is where scripts are usually injected.
+	HeadEnd Point = iota
+	// HeadStart is right after the opening <head> tag.
+	HeadStart
+	// BodyEnd is right before the closing </body> tag.
+	BodyEnd
+	pointCount
+)
+
+// points lists all points in document order.
+var points = [pointCount]Point{HeadStart, HeadEnd, BodyEnd}
+
+// String implements fmt.Stringer.
+func (p Point) String() string {
+	switch p {
+	case HeadStart:
+		return "head-start"
+	case HeadEnd:
+		return "head-end"
+	case BodyEnd:
+		return "body-end"
+	default:
+		return fmt.Sprintf("Point(%d)", p)
+	}
+}
+
+// Snippets maps injection points to the HTML injected at them.
+type Snippets map[Point][]byte
+
+// Inject returns a copy of doc with the snippets injected at their points. It
+// returns an error if a point that has a snippet cannot be found in doc.
+//
+// The end of the head falls back to the opening <body> tag if </head> was
+// omitted, and the end of the body falls back to </html> if </body> was
+// omitted.
+func Inject(doc []byte, snippets Snippets) ([]byte, error) {
+	offsets, err := findPoints(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	type insertion struct {
+		offset  int
+		snippet []byte
+	}
+
+	for point := range snippets {
+		if point >= pointCount {
+			return nil, fmt.Errorf("unknown injection point %v", point)
+		}
+	}
+
+	insertions := make([]insertion, 0, len(snippets))
+	for _, point := range points {
+		snippet := snippets[point]
+		if len(snippet) == 0 {
+			continue
+		}
+		if offsets[point] < 0 {
+			return nil, fmt.Errorf("cannot find %v in HTML document", point)
+		}
+		insertions = append(insertions, insertion{offsets[point], snippet})
+	}
+
+	// Points may share an offset, e.g. an empty head, so keep them in order.
+	sort.SliceStable(insertions, func(i, j int) bool {
+		return insertions[i].offset < insertions[j].offset
+	})
+
+	var out bytes.Buffer
+	out.Grow(len(doc))
+
+	var last int
+	for _, ins := range insertions {
+		out.Write(doc[last:ins.offset])
+		out.Write(ins.snippet)
+		last = ins.offset
+	}
+	out.Write(doc[last:])
+
+	return out.Bytes(), nil
+}
+
+// findPoints returns the byte offset of every point in doc. Points that
+// cannot be found have an offset of -1.
+func findPoints(doc []byte) ([pointCount]int, error) {
+	var offsets [pointCount]int
+	for i := range offsets {
+		offsets[i] = -1
+	}
+
+	htmlEnd := -1
+	bodyStart := -1
+
+	z := html.NewTokenizer(bytes.NewReader(doc))
+	var offset int
+
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if err := z.Err(); !errors.Is(err, io.EOF) {
+				return offsets, fmt.Errorf("tokenizing HTML: %w", err)
+			}
+			break
+		}
+
+		start := offset
+		offset += len(z.Raw())
+
+		name, _ := z.TagName()
+		tag := atom.Lookup(name)
+
+		switch tt {
+		case html.StartTagToken:
+			switch tag {
+			case atom.Head:
+				if offsets[HeadStart] == -1 {
+					offsets[HeadStart] = offset
+				}
+			case atom.Body:
+				if bodyStart == -1 {
+					bodyStart = start
+				}
+			}
+		case html.EndTagToken:
+			switch tag {
+			case atom.Head:
+				if offsets[HeadEnd] == -1 {
+					offsets[HeadEnd] = start
+				}
+			case atom.Body:
+				offsets[BodyEnd] = start
+			case atom.Html:
+				htmlEnd = start
+			}
+		}
+	}
+
+	if offsets[HeadEnd] == -1 && offsets[HeadStart] != -1 {
+		offsets[HeadEnd] = bodyStart
+	}
+	if offsets[BodyEnd] == -1 && bodyStart != -1 {
+		offsets[BodyEnd] = htmlEnd
+	}
+
+	return offsets, nil
+}
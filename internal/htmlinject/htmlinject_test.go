@@ -0,0 +1,96 @@
+package htmlinject
+
+import "testing"
+
+func TestInject(t *testing.T) {
+	tests := []struct {
+		name     string
+		doc      string
+		snippets Snippets
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "head end",
+			doc:      "<html><head><title>DoL</title></head><body></body></html>",
+			snippets: Snippets{HeadEnd: []byte("<script></script>")},
+			want:     "<html><head><title>DoL</title><script></script></head><body></body></html>",
+		},
+		{
+			name: "all points",
+			doc:  "<html><head></head><body><p>hi</p></body></html>",
+			snippets: Snippets{
+				HeadStart: []byte("<a1>"),
+				HeadEnd:   []byte("<a2>"),
+				BodyEnd:   []byte("<a3>"),
+			},
+			want: "<html><head><a1><a2></head><body><p>hi</p><a3></body></html>",
+		},
+		{
+			name:     "uppercase tags",
+			doc:      "<HTML><HEAD><TITLE>DoL</TITLE></HEAD><BODY></BODY></HTML>",
+			snippets: Snippets{HeadEnd: []byte("<x>"), BodyEnd: []byte("<y>")},
+			want:     "<HTML><HEAD><TITLE>DoL</TITLE><x></HEAD><BODY><y></BODY></HTML>",
+		},
+		{
+			name:     "head end inside script",
+			doc:      `<html><head><script>document.write("</head>")</script></head><body></body></html>`,
+			snippets: Snippets{HeadEnd: []byte("<x>")},
+			want:     `<html><head><script>document.write("</head>")</script><x></head><body></body></html>`,
+		},
+		{
+			name:     "head end inside comment",
+			doc:      "<html><head><!-- </head> --></head><body></body></html>",
+			snippets: Snippets{HeadEnd: []byte("<x>")},
+			want:     "<html><head><!-- </head> --><x></head><body></body></html>",
+		},
+		{
+			name:     "missing head end",
+			doc:      "<html><head><title>DoL</title><body></body></html>",
+			snippets: Snippets{HeadEnd: []byte("<x>")},
+			want:     "<html><head><title>DoL</title><x><body></body></html>",
+		},
+		{
+			name:     "missing body end",
+			doc:      "<html><head></head><body><p>hi</p></html>",
+			snippets: Snippets{BodyEnd: []byte("<x>")},
+			want:     "<html><head></head><body><p>hi</p><x></html>",
+		},
+		{
+			name:     "missing head",
+			doc:      "<p>hi</p>",
+			snippets: Snippets{HeadEnd: []byte("<x>")},
+			wantErr:  true,
+		},
+		{
+			name:     "unused point may be missing",
+			doc:      "<html><head></head></html>",
+			snippets: Snippets{HeadEnd: []byte("<x>"), BodyEnd: nil},
+			want:     "<html><head><x></head></html>",
+		},
+		{
+			name:     "unknown point",
+			doc:      "<html><head></head><body></body></html>",
+			snippets: Snippets{pointCount: []byte("<x>")},
+			wantErr:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Inject([]byte(test.doc), test.snippets)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("got %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != test.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, test.want)
+			}
+		})
+	}
+}
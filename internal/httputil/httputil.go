@@ -3,6 +3,7 @@ package httputil
 import (
 	"bytes"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/hhsnopek/etag"
@@ -10,11 +11,48 @@ import (
 
 // BytesServer returns a http.Handler that serves the given bytes as a file.
 func BytesServer(mimeType string, b []byte) http.HandlerFunc {
-	etag := etag.Generate(b, false)
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", mimeType)
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("ETag", etag)
-		http.ServeContent(w, r, "index.html", time.Time{}, bytes.NewReader(b))
-	}
+	return NewBytesFile(mimeType, b).ServeHTTP
+}
+
+// BytesFile is a http.Handler that serves bytes as a file. The bytes can be
+// atomically replaced while they are being served.
+type BytesFile struct {
+	mimeType string
+	file     atomic.Pointer[bytesFile]
+}
+
+type bytesFile struct {
+	b    []byte
+	etag string
+}
+
+// NewBytesFile creates a new BytesFile that serves the given bytes.
+func NewBytesFile(mimeType string, b []byte) *BytesFile {
+	f := &BytesFile{mimeType: mimeType}
+	f.Store(b)
+	return f
+}
+
+// Store replaces the served bytes. The bytes and their ETag are swapped
+// together, so requests never see one without the other.
+func (f *BytesFile) Store(b []byte) {
+	f.file.Store(&bytesFile{
+		b:    b,
+		etag: etag.Generate(b, false),
+	})
+}
+
+// Bytes returns the currently served bytes. The returned slice must not be
+// modified.
+func (f *BytesFile) Bytes() []byte {
+	return f.file.Load().b
+}
+
+// ServeHTTP implements http.Handler.
+func (f *BytesFile) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	file := f.file.Load()
+	w.Header().Set("Content-Type", f.mimeType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("ETag", file.etag)
+	http.ServeContent(w, r, "index.html", time.Time{}, bytes.NewReader(file.b))
 }
@@ -0,0 +1,298 @@
+// Package lzstring implements the base64 variant of the LZString compression
+// format, which SugarCube uses for its saves.
+//
+// LZString works on UTF-16 code units, like JavaScript strings do, so strings
+// are converted to and from UTF-16 at the edges.
+package lzstring
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf16"
+)
+
+const base64Alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/="
+
+var base64Values = func() [256]int8 {
+	var values [256]int8
+	for i := range values {
+		values[i] = -1
+	}
+	for i := 0; i < len(base64Alphabet); i++ {
+		values[base64Alphabet[i]] = int8(i)
+	}
+	return values
+}()
+
+// ErrInvalid is returned when the input is not valid LZString data.
+var ErrInvalid = errors.New("invalid lzstring data")
+
+// CompressToBase64 compresses s the same way as LZString.compressToBase64.
+func CompressToBase64(s string) string {
+	var out strings.Builder
+	compress(utf16.Encode([]rune(s)), 6, func(v int) {
+		out.WriteByte(base64Alphabet[v])
+	})
+
+	for out.Len()%4 != 0 {
+		out.WriteByte('=')
+	}
+
+	return out.String()
+}
+
+// DecompressFromBase64 decompresses s the same way as
+// LZString.decompressFromBase64.
+func DecompressFromBase64(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+
+	values := make([]int, len(s))
+	for i := 0; i < len(s); i++ {
+		v := base64Values[s[i]]
+		if v < 0 {
+			return "", ErrInvalid
+		}
+		values[i] = int(v)
+	}
+
+	units, err := decompress(values, 32)
+	if err != nil {
+		return "", err
+	}
+
+	return string(utf16.Decode(units)), nil
+}
+
+// bitWriter writes values bit by bit into output characters of a fixed width.
+type bitWriter struct {
+	bitsPerChar int
+	emit        func(int)
+	val         int
+	position    int
+}
+
+func (w *bitWriter) writeBit(bit int) {
+	w.val = (w.val << 1) | bit
+	if w.position == w.bitsPerChar-1 {
+		w.position = 0
+		w.emit(w.val)
+		w.val = 0
+	} else {
+		w.position++
+	}
+}
+
+// writeBits writes the n lowest bits of value, least significant bit first.
+func (w *bitWriter) writeBits(n, value int) {
+	for i := 0; i < n; i++ {
+		w.writeBit(value & 1)
+		value >>= 1
+	}
+}
+
+// flush pads the last character with zeros and emits it.
+func (w *bitWriter) flush() {
+	for {
+		w.val <<= 1
+		if w.position == w.bitsPerChar-1 {
+			w.emit(w.val)
+			return
+		}
+		w.position++
+	}
+}
+
+func compress(input []uint16, bitsPerChar int, emit func(int)) {
+	dictionary := make(map[string]int)
+	toCreate := make(map[string]bool)
+
+	w := bitWriter{bitsPerChar: bitsPerChar, emit: emit}
+	enlargeIn := 2
+	dictSize := 3
+	numBits := 2
+
+	enlarge := func() {
+		enlargeIn--
+		if enlargeIn == 0 {
+			enlargeIn = 1 << numBits
+			numBits++
+		}
+	}
+
+	// writePhrase writes the code of the phrase, creating it in the decoder's
+	// dictionary first if this is the first time it is used.
+	writePhrase := func(phrase string) {
+		if toCreate[phrase] {
+			c := int(unitAt(phrase, 0))
+			if c < 256 {
+				w.writeBits(numBits, 0)
+				w.writeBits(8, c)
+			} else {
+				w.writeBits(numBits, 1)
+				w.writeBits(16, c)
+			}
+			enlarge()
+			delete(toCreate, phrase)
+		} else {
+			w.writeBits(numBits, dictionary[phrase])
+		}
+		enlarge()
+	}
+
+	// Phrases are keyed by their UTF-16 code units, two bytes each.
+	var phrase string
+	for _, unit := range input {
+		c := unitString(unit)
+		if _, ok := dictionary[c]; !ok {
+			dictionary[c] = dictSize
+			dictSize++
+			toCreate[c] = true
+		}
+
+		pc := phrase + c
+		if _, ok := dictionary[pc]; ok {
+			phrase = pc
+			continue
+		}
+
+		writePhrase(phrase)
+		dictionary[pc] = dictSize
+		dictSize++
+		phrase = c
+	}
+
+	if phrase != "" {
+		writePhrase(phrase)
+	}
+
+	// Mark the end of the stream.
+	w.writeBits(numBits, 2)
+	w.flush()
+}
+
+func unitString(unit uint16) string {
+	return string([]byte{byte(unit >> 8), byte(unit)})
+}
+
+func unitAt(s string, i int) uint16 {
+	return uint16(s[2*i])<<8 | uint16(s[2*i+1])
+}
+
+// bitReader reads values bit by bit from input characters.
+type bitReader struct {
+	input      []int
+	resetValue int
+	val        int
+	position   int
+	index      int
+}
+
+// readBits reads an n-bit value, least significant bit first. Like the
+// JavaScript implementation, reading past the end of the input reads zeros.
+func (r *bitReader) readBits(n int) int {
+	var bits int
+	for power := 1; power != 1<<n; power <<= 1 {
+		if r.val&r.position > 0 {
+			bits |= power
+		}
+		r.position >>= 1
+		if r.position == 0 {
+			r.position = r.resetValue
+			r.val = 0
+			if r.index < len(r.input) {
+				r.val = r.input[r.index]
+			}
+			r.index++
+		}
+	}
+	return bits
+}
+
+// exhausted returns true if the reader has read past the end of the input.
+func (r *bitReader) exhausted() bool {
+	return r.index > len(r.input)
+}
+
+func decompress(input []int, resetValue int) ([]uint16, error) {
+	r := bitReader{
+		input:      input,
+		resetValue: resetValue,
+		val:        input[0],
+		position:   resetValue,
+		index:      1,
+	}
+
+	// The first three codes are reserved for the control codes.
+	dictionary := [][]uint16{nil, nil, nil}
+	enlargeIn := 4
+	numBits := 3
+
+	readLiteral := func(code int) []uint16 {
+		bits := 8
+		if code == 1 {
+			bits = 16
+		}
+		return []uint16{uint16(r.readBits(bits))}
+	}
+
+	var w []uint16
+	switch code := r.readBits(2); code {
+	case 0, 1:
+		w = readLiteral(code)
+	case 2:
+		return nil, nil
+	default:
+		return nil, ErrInvalid
+	}
+
+	dictionary = append(dictionary, w)
+	result := append([]uint16(nil), w...)
+
+	for {
+		if r.exhausted() {
+			return nil, ErrInvalid
+		}
+
+		code := r.readBits(numBits)
+		switch code {
+		case 0, 1:
+			dictionary = append(dictionary, readLiteral(code))
+			code = len(dictionary) - 1
+			enlargeIn--
+		case 2:
+			return result, nil
+		}
+
+		if enlargeIn == 0 {
+			enlargeIn = 1 << numBits
+			numBits++
+		}
+
+		var entry []uint16
+		switch {
+		case code < len(dictionary):
+			entry = dictionary[code]
+		case code == len(dictionary):
+			entry = append(append([]uint16(nil), w...), w[0])
+		default:
+			return nil, ErrInvalid
+		}
+
+		result = append(result, entry...)
+
+		next := make([]uint16, len(w)+1)
+		copy(next, w)
+		next[len(w)] = entry[0]
+		dictionary = append(dictionary, next)
+		enlargeIn--
+
+		w = entry
+
+		if enlargeIn == 0 {
+			enlargeIn = 1 << numBits
+			numBits++
+		}
+	}
+}
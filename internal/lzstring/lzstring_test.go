@@ -0,0 +1,95 @@
+package lzstring
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// compressTests were compressed with LZString.compressToBase64.
+var compressTests = []struct {
+	name       string
+	plain      string
+	compressed string
+}{
+	{"empty", "", "Q==="},
+	{"single character", "a", "IZA="},
+	{"ascii", "Hello, world", "BIUwNmD2A0AEDukBOYAmQ==="},
+	{"repeated", strings.Repeat("a", 40), "IY18ZVkA"},
+	{"repeated words", "TOBEORNOTTOBEORTOBEORNOT", "CoeQQgoiBKByLFJGSpwUA==="},
+	{"unicode", "ünïcödé €", "D8Ow9wxgbwJglwAkDUEQ"},
+	{"surrogate pair", "😀 emoji", "rwbgA9gECmC2D2BWBLIA"},
+	{
+		"save",
+		`{"state":{"delta":[{"title":"Start","variables":{"money":100}}]},"id":"dol"}`,
+		"N4IgzgLghhCmIC5QBNYBtqINqggSwjXgRAGVoAnCEAGhADcoK8oAjIsRUAWwHsA7WAE9EARgAM4gL5SAulLp5kiEMl5oQUoA",
+	},
+}
+
+func TestCompressToBase64(t *testing.T) {
+	for _, test := range compressTests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := CompressToBase64(test.plain); got != test.compressed {
+				t.Errorf("got %q, want %q", got, test.compressed)
+			}
+		})
+	}
+}
+
+func TestDecompressFromBase64(t *testing.T) {
+	for _, test := range compressTests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := DecompressFromBase64(test.compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.plain {
+				t.Errorf("got %q, want %q", got, test.plain)
+			}
+		})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	// Long enough for the dictionary to grow past several code widths.
+	var long strings.Builder
+	for i := 0; i < 2000; i++ {
+		long.WriteString(`{"var":`)
+		long.WriteString(strings.Repeat("x", i%37))
+		long.WriteRune(rune(0x3b1 + i%20))
+		long.WriteString("},")
+	}
+
+	for _, s := range []string{
+		"",
+		"a",
+		"ab",
+		"aaaa",
+		"\x00\u00ff",
+		"日本語のテキスト",
+		"😀😁😂",
+		long.String(),
+	} {
+		compressed := CompressToBase64(s)
+		got, err := DecompressFromBase64(compressed)
+		if err != nil {
+			t.Errorf("decompressing %.20q: %v", s, err)
+			continue
+		}
+		if got != s {
+			t.Errorf("round trip of %.20q returned %.20q", s, got)
+		}
+	}
+}
+
+func TestDecompressInvalid(t *testing.T) {
+	for _, s := range []string{
+		"not base64!",
+		"A",
+		"////",
+	} {
+		if _, err := DecompressFromBase64(s); !errors.Is(err, ErrInvalid) {
+			t.Errorf("decompressing %q returned %v, want ErrInvalid", s, err)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+// Package retention decides which snapshots of a series are kept, such as
+// backups or the history of a save.
+package retention
+
+import (
+	"fmt"
+	"time"
+)
+
+// Rules describes which snapshots are kept. A snapshot is kept if any of the
+// rules keeps it.
+type Rules struct {
+	// Last is the number of most recent snapshots to keep.
+	Last int
+	// Hourly is the number of most recent hours to keep the last snapshot of.
+	Hourly int
+	// Daily is the number of most recent days to keep the last snapshot of.
+	Daily int
+	// Weekly is the number of most recent weeks to keep the last snapshot of.
+	Weekly int
+}
+
+// Kept returns whether each of the snapshots taken at the given times is kept
+// by the rules. Times must be sorted newest first. Hours, days and weeks are
+// counted in the location of each time.
+func (r Rules) Kept(times []time.Time) []bool {
+	keep := make([]bool, len(times))
+
+	for i := 0; i < len(times) && i < r.Last; i++ {
+		keep[i] = true
+	}
+
+	// keepPer keeps the newest snapshot of each of the n most recent periods.
+	keepPer := func(n int, period func(time.Time) string) {
+		seen := make(map[string]bool, n)
+		for i, t := range times {
+			if len(seen) >= n {
+				return
+			}
+			p := period(t)
+			if !seen[p] {
+				seen[p] = true
+				keep[i] = true
+			}
+		}
+	}
+
+	keepPer(r.Hourly, func(t time.Time) string {
+		return t.Format("2006-01-02T15")
+	})
+	keepPer(r.Daily, func(t time.Time) string {
+		return t.Format(time.DateOnly)
+	})
+	keepPer(r.Weekly, func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	})
+
+	return keep
+}
@@ -0,0 +1,80 @@
+package retention
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRulesKept(t *testing.T) {
+	at := func(s string) time.Time {
+		t.Helper()
+		tt, err := time.Parse(time.DateTime, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tt
+	}
+
+	// Newest first. 2024-01-08 is a Monday, so the last two times are in the
+	// week before the others.
+	times := []time.Time{
+		at("2024-01-09 12:30:00"),
+		at("2024-01-09 12:10:00"),
+		at("2024-01-09 11:00:00"),
+		at("2024-01-08 09:00:00"),
+		at("2024-01-07 23:00:00"),
+		at("2024-01-06 10:00:00"),
+	}
+
+	tests := []struct {
+		name  string
+		rules Rules
+		want  []bool
+	}{
+		{
+			name:  "none",
+			rules: Rules{},
+			want:  []bool{false, false, false, false, false, false},
+		},
+		{
+			name:  "last",
+			rules: Rules{Last: 2},
+			want:  []bool{true, true, false, false, false, false},
+		},
+		{
+			name:  "hourly",
+			rules: Rules{Hourly: 2},
+			want:  []bool{true, false, true, false, false, false},
+		},
+		{
+			name:  "daily",
+			rules: Rules{Daily: 3},
+			want:  []bool{true, false, false, true, true, false},
+		},
+		{
+			name:  "weekly",
+			rules: Rules{Weekly: 2},
+			want:  []bool{true, false, false, false, true, false},
+		},
+		{
+			name:  "combined",
+			rules: Rules{Last: 1, Hourly: 2, Weekly: 2},
+			want:  []bool{true, false, true, false, true, false},
+		},
+		{
+			name:  "more than there are",
+			rules: Rules{Last: 10, Daily: 10},
+			want:  []bool{true, true, true, true, true, true},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := test.rules.Kept(times)
+			if !slices.Equal(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+// Package sugarcube decodes SugarCube saves, as returned by
+// SugarCube.Save.serialize.
+package sugarcube
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"libdb.so/dol-server/internal/lzstring"
+)
+
+// Save is a decoded SugarCube save.
+type Save struct {
+	// ID is the ID of the story that the save belongs to.
+	ID string `json:"id"`
+	// Date is the date of the save in Unix milliseconds.
+	Date int64 `json:"date"`
+	// Title is the title of the save. It is usually the passage excerpt.
+	Title string `json:"title"`
+	// State is the story state of the save.
+	State State `json:"state"`
+	// Metadata is the metadata that was passed to Save.serialize.
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+
+	// raw is the JSON that the save was decoded from. Encode only changes
+	// the variables in it, so that nothing that is not decoded gets lost.
+	raw []byte
+}
+
+// State is the story state in a save.
+type State struct {
+	// History is the history of moments. The current moment is at Index.
+	History []Moment `json:"history"`
+	// Index is the index of the current moment in History.
+	Index int `json:"index"`
+	// Delta is the delta-encoded history. SugarCube does not use it for
+	// saves, so it is not decoded.
+	Delta json.RawMessage `json:"delta,omitempty"`
+}
+
+// Moment is a moment in the story history.
+type Moment struct {
+	// Title is the name of the passage of the moment.
+	Title string `json:"title"`
+	// Variables are the story variables of the moment. Values that SugarCube
+	// cannot represent in JSON, such as Maps, are left in SugarCube's revive
+	// format.
+	Variables map[string]json.RawMessage `json:"variables"`
+}
+
+// ErrDeltaEncoded is returned by Current if the history of the save is
+// delta-encoded.
+var ErrDeltaEncoded = errors.New("delta-encoded history is not supported")
+
+// Decode decodes a save as returned by SugarCube.Save.serialize.
+func Decode(data string) (*Save, error) {
+	j, err := lzstring.DecompressFromBase64(data)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing save: %w", err)
+	}
+
+	save := Save{raw: []byte(j)}
+	if err := json.Unmarshal(save.raw, &save); err != nil {
+		return nil, fmt.Errorf("decoding save: %w", err)
+	}
+
+	return &save, nil
+}
+
+// Encode encodes the save the same way as SugarCube.Save.serialize. Only the
+// variables of the moments are encoded from s. Everything else is encoded as
+// it was decoded.
+func (s *Save) Encode() (string, error) {
+	var save map[string]json.RawMessage
+	if err := json.Unmarshal(s.raw, &save); err != nil {
+		return "", fmt.Errorf("decoding save: %w", err)
+	}
+
+	var state map[string]json.RawMessage
+	if err := json.Unmarshal(save["state"], &state); err != nil {
+		return "", fmt.Errorf("decoding state: %w", err)
+	}
+
+	var history []map[string]json.RawMessage
+	if err := json.Unmarshal(state["history"], &history); err != nil {
+		return "", fmt.Errorf("decoding history: %w", err)
+	}
+
+	if len(history) != len(s.State.History) {
+		return "", fmt.Errorf("history has %d moments, expected %d", len(history), len(s.State.History))
+	}
+
+	var err error
+	for i, moment := range s.State.History {
+		if history[i]["variables"], err = marshal(moment.Variables); err != nil {
+			return "", fmt.Errorf("encoding variables: %w", err)
+		}
+	}
+
+	if state["history"], err = marshal(history); err != nil {
+		return "", fmt.Errorf("encoding history: %w", err)
+	}
+	if save["state"], err = marshal(state); err != nil {
+		return "", fmt.Errorf("encoding state: %w", err)
+	}
+
+	j, err := marshal(save)
+	if err != nil {
+		return "", fmt.Errorf("encoding save: %w", err)
+	}
+
+	return lzstring.CompressToBase64(string(j)), nil
+}
+
+// marshal marshals v without escaping HTML characters, like JSON.stringify.
+func marshal(v any) (json.RawMessage, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// Current returns the current moment of the save.
+func (s *Save) Current() (*Moment, error) {
+	if s.State.History == nil && s.State.Delta != nil {
+		return nil, ErrDeltaEncoded
+	}
+	if s.State.Index < 0 || s.State.Index >= len(s.State.History) {
+		return nil, fmt.Errorf("history index %d out of range", s.State.Index)
+	}
+	return &s.State.History[s.State.Index], nil
+}
+
+// Variable decodes the story variable with the given name into v. It returns
+// false if the variable is not set or cannot be decoded into v.
+func (m *Moment) Variable(name string, v any) bool {
+	raw, ok := m.Variables[name]
+	if !ok {
+		return false
+	}
+	return json.Unmarshal(raw, v) == nil
+}
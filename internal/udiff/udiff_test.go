@@ -0,0 +1,61 @@
+package udiff
+
+import "testing"
+
+func TestUnified(t *testing.T) {
+	tests := []struct {
+		name    string
+		a, b    string
+		context int
+		want    string
+	}{
+		{
+			name: "equal",
+			a:    "a\nb\n",
+			b:    "a\nb\n",
+			want: "",
+		},
+		{
+			name:    "modified line",
+			a:       "a\nb\nc\nd\ne\n",
+			b:       "a\nb\nC\nd\ne\n",
+			context: 1,
+			want: "--- old\n+++ new\n" +
+				"@@ -2,3 +2,3 @@\n b\n-c\n+C\n d\n",
+		},
+		{
+			name:    "separate hunks",
+			a:       "1\n2\n3\n4\n5\n6\n7\n",
+			b:       "0\n2\n3\n4\n5\n6\n8\n",
+			context: 1,
+			want: "--- old\n+++ new\n" +
+				"@@ -1,2 +1,2 @@\n-1\n+0\n 2\n" +
+				"@@ -6,2 +6,2 @@\n 6\n-7\n+8\n",
+		},
+		{
+			name:    "added to empty",
+			a:       "",
+			b:       "a\n",
+			context: 3,
+			want: "--- old\n+++ new\n" +
+				"@@ -0,0 +1 @@\n+a\n",
+		},
+		{
+			name:    "negative context",
+			a:       "a\nb\nc\n",
+			b:       "a\nB\nc\n",
+			context: -1,
+			want: "--- old\n+++ new\n" +
+				"@@ -2 +2 @@\n-b\n+B\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := Unified("old", "new", test.a, test.b, test.context)
+			if got != test.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, test.want)
+			}
+		})
+	}
+}
@@ -10,15 +10,19 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/skratchdot/open-golang/open"
 	"github.com/spf13/pflag"
-	"libdb.so/dol-server/extension"
+	"libdb.so/dol-server/internal/backup"
 	"libdb.so/hserve"
 
 	_ "libdb.so/dol-server/extension/autosync"
 	_ "libdb.so/dol-server/extension/extracss"
+	_ "libdb.so/dol-server/extension/mods"
+	_ "libdb.so/dol-server/extension/passages"
 )
 
 var (
@@ -33,6 +37,9 @@ func init() {
 	pflag.StringVarP(&config, "config", "c", config, "path to config file")
 	pflag.BoolVarP(&verbose, "verbose", "v", verbose, "enable verbose logging")
 	pflag.BoolVar(&openBrowser, "open-browser", openBrowser, "open browser on startup")
+	pflag.Usage = usage
+	// Stop at the command name so that commands can have their own flags.
+	pflag.CommandLine.SetInterspersed(false)
 	pflag.Parse()
 
 	logLevel := slog.LevelInfo
@@ -48,43 +55,117 @@ func init() {
 }
 
 type Config struct {
-	GamePath   string                     `json:"game_path"`
+	GamePath   GamePaths                  `json:"game_path"`
 	Extensions map[string]json.RawMessage `json:"extensions,omitempty"`
+	// Backup enables scheduled backups of the data of all extensions.
+	Backup *backup.Config `json:"backup,omitempty"`
+}
+
+// GamePaths maps game names to the paths of their game directories. In the
+// config file, it is either a single path string or an object of named paths.
+// A single path is stored under the empty name and is served at the root.
+type GamePaths map[string]string
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (p *GamePaths) UnmarshalJSON(b []byte) error {
+	var path string
+	if err := json.Unmarshal(b, &path); err == nil {
+		*p = GamePaths{"": path}
+		return nil
+	}
+
+	var paths map[string]string
+	if err := json.Unmarshal(b, &paths); err != nil {
+		return fmt.Errorf("game_path must be a string or an object of strings: %w", err)
+	}
+
+	for name := range paths {
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\?#%") {
+			return fmt.Errorf("invalid game name %q", name)
+		}
+	}
+
+	*p = paths
+	return nil
+}
+
+// IsSingle returns true if only a single unnamed game is configured.
+func (p GamePaths) IsSingle() bool {
+	_, ok := p[""]
+	return ok && len(p) == 1
 }
 
 func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
 
-	if err := start(ctx); err != nil {
+	if pflag.NArg() == 0 {
+		if err := start(ctx); err != nil {
+			log.Fatalln("error occured", err)
+		}
+		return
+	}
+
+	cmd, ok := commands[pflag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", pflag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	if err := cmd.run(ctx, pflag.Args()[1:]); err != nil {
 		log.Fatalln("error occured", err)
 	}
 }
 
-func start(ctx context.Context) error {
-	cfgData, err := os.ReadFile(config)
-	if err != nil {
-		return fmt.Errorf("reading config file: %w", err)
+// command is a dol-server subcommand.
+type command struct {
+	usage string
+	run   func(ctx context.Context, args []string) error
+}
+
+// commands are the subcommands of dol-server. Without a command, dol-server
+// starts the server.
+var commands = map[string]command{
+	"backup":    {"create|list|restore [flags]", backupCommand},
+	"diff-game": {"<old> <new>", diffGame},
+	"saves":     {"export|import|rotate-key [flags]", saves},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] [command]\n\n", os.Args[0])
+	fmt.Fprintln(os.Stderr, "Commands:")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
 	}
+	sort.Strings(names)
 
-	var cfg Config
-	if err := json.Unmarshal(cfgData, &cfg); err != nil {
-		return fmt.Errorf("unmarshaling config file: %w", err)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s %s\n", name, commands[name].usage)
 	}
 
-	extensions, err := extension.NewExtensionsManager(cfg.Extensions)
+	fmt.Fprintln(os.Stderr, "\nFlags:")
+	pflag.PrintDefaults()
+}
+
+func start(ctx context.Context) error {
+	cfg, err := readConfig(config)
 	if err != nil {
-		return fmt.Errorf("creating extensions manager: %w", err)
+		return err
 	}
 
-	dol, err := newDoLServer(cfg.GamePath, extensions)
+	dol, err := newDoLInstance(ctx, cfg, nil)
 	if err != nil {
-		return fmt.Errorf("creating DoL server: %w", err)
+		return err
 	}
 
-	if err := extensions.Start(ctx); err != nil {
-		return fmt.Errorf("starting extensions: %w", err)
-	}
+	handler := &dolHandler{}
+	handler.swap(dol)
+	defer handler.close()
+
+	go reloadOnSIGHUP(ctx, handler)
 
 	// Convert address to URL
 	url, err := url.Parse("http://" + listenAddr)
@@ -106,7 +187,32 @@ func start(ctx context.Context) error {
 	}
 
 	log.Println("listening on", listenAddr)
-	return hserve.ListenAndServe(ctx, listenAddr, dol)
+	return hserve.ListenAndServe(ctx, listenAddr, handler)
+}
+
+// readConfig reads and validates the config file at the given path.
+func readConfig(path string) (Config, error) {
+	cfgData, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("reading config file: %w", err)
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(cfgData, &cfg); err != nil {
+		return Config{}, fmt.Errorf("unmarshaling config file: %w", err)
+	}
+
+	if len(cfg.GamePath) == 0 {
+		return Config{}, fmt.Errorf("no game_path in config file")
+	}
+
+	if cfg.Backup != nil {
+		if err := cfg.Backup.Validate(); err != nil {
+			return Config{}, fmt.Errorf("backup: %w", err)
+		}
+	}
+
+	return cfg, nil
 }
 
 func waitAndOpenURL(ctx context.Context, url string) error {
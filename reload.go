@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"libdb.so/dol-server/extension"
+	"libdb.so/dol-server/internal/backup"
+)
+
+// instanceDrainTimeout is how long an old instance waits for its in-flight
+// requests to finish before its extensions are stopped anyway. Event streams
+// stay open for as long as the tab does, so they cannot be waited on forever.
+const instanceDrainTimeout = 30 * time.Second
+
+// dolInstance is the server built from a single version of the config. A new
+// instance is built every time the config is reloaded.
+type dolInstance struct {
+	http.Handler
+	extensions *extension.ExtensionsManager
+	cancel     context.CancelFunc
+	// backupDone is closed once scheduled backups have stopped. It is nil if
+	// backups are not enabled.
+	backupDone chan struct{}
+
+	mu       sync.Mutex
+	requests sync.WaitGroup
+	draining bool
+}
+
+// newDoLInstance creates the extensions and the router described by cfg and
+// starts the extensions. If prev is not nil, the extensions of prev whose
+// config did not change are reused instead of being created again. The
+// instance lives until ctx is done or until stop is called.
+func newDoLInstance(ctx context.Context, cfg Config, prev *dolInstance) (*dolInstance, error) {
+	var prevExtensions *extension.ExtensionsManager
+	var extensions *extension.ExtensionsManager
+	var err error
+	if prev != nil {
+		prevExtensions = prev.extensions
+		extensions, err = prevExtensions.Reload(cfg.Extensions)
+	} else {
+		extensions, err = extension.NewExtensionsManager(cfg.Extensions)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("creating extensions manager: %w", err)
+	}
+
+	if cfg.Backup != nil {
+		if err := cfg.Backup.ValidateSources(backupSources(extensions)); err != nil {
+			extensions.StopExcept(prevExtensions)
+			return nil, fmt.Errorf("backup: %w", err)
+		}
+	}
+
+	instanceCtx, cancel := context.WithCancel(ctx)
+
+	dol, err := newDoLServer(instanceCtx, cfg.GamePath, extensions)
+	if err != nil {
+		cancel()
+		extensions.StopExcept(prevExtensions)
+		return nil, fmt.Errorf("creating DoL server: %w", err)
+	}
+
+	// Extensions can outlive the instance if the next config keeps them, so
+	// they are started with the parent context.
+	if err := extensions.Start(ctx); err != nil {
+		cancel()
+		extensions.StopExcept(prevExtensions)
+		return nil, fmt.Errorf("starting extensions: %w", err)
+	}
+
+	instance := &dolInstance{
+		Handler:    dol,
+		extensions: extensions,
+		cancel:     cancel,
+	}
+
+	if cfg.Backup != nil {
+		sources := backupSources(extensions)
+		instance.backupDone = make(chan struct{})
+		go func() {
+			defer close(instance.backupDone)
+			backup.Run(instanceCtx, *cfg.Backup, sources)
+		}()
+	}
+
+	return instance, nil
+}
+
+// acquire marks a request as being served by the instance. It returns false if
+// the instance is already being stopped, in which case the request must be
+// served by the current instance instead. Each successful acquire must be
+// followed by a release.
+func (i *dolInstance) acquire() bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.draining {
+		return false
+	}
+	i.requests.Add(1)
+	return true
+}
+
+// release marks a request acquired with acquire as done.
+func (i *dolInstance) release() {
+	i.requests.Done()
+}
+
+// drain waits until the requests being served by the instance are done, or
+// until instanceDrainTimeout has passed. No new requests are acquired after
+// drain is called.
+func (i *dolInstance) drain() {
+	i.mu.Lock()
+	i.draining = true
+	i.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		i.requests.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(instanceDrainTimeout):
+		slog.Warn(
+			"requests on the old config are still running, stopping its extensions anyway",
+			"timeout", instanceDrainTimeout)
+	}
+}
+
+// stop stops the instance's background workers, waits for its in-flight
+// requests, then stops the extensions that next does not use. next may be nil,
+// in which case all extensions are stopped.
+func (i *dolInstance) stop(next *dolInstance) {
+	i.cancel()
+	if i.backupDone != nil {
+		// A backup that is being made is cancelled, and must stop reading
+		// the extensions' data before they are stopped.
+		<-i.backupDone
+	}
+
+	i.drain()
+
+	var keep *extension.ExtensionsManager
+	if next != nil {
+		keep = next.extensions
+	}
+
+	if err := i.extensions.StopExcept(keep); err != nil {
+		slog.Error(
+			"failed to stop extensions",
+			"error", err)
+	}
+}
+
+// dolHandler serves the current dolInstance. The instance can be swapped while
+// requests are being served, so reloading never drops the listener or any
+// in-flight connections.
+type dolHandler struct {
+	current  atomic.Pointer[dolInstance]
+	stopping sync.WaitGroup
+}
+
+// swap replaces the current instance with the given one and stops the old
+// instance in the background. Requests that are already being served by the
+// old instance finish on the old router before the old instance's extensions
+// are stopped, which can take up to instanceDrainTimeout.
+func (h *dolHandler) swap(instance *dolInstance) {
+	if old := h.current.Swap(instance); old != nil {
+		h.stopping.Add(1)
+		go func() {
+			defer h.stopping.Done()
+			old.stop(instance)
+		}()
+	}
+}
+
+// close stops the current instance and waits until every old instance has
+// been stopped.
+func (h *dolHandler) close() {
+	h.swap(nil)
+	h.stopping.Wait()
+}
+
+// ServeHTTP implements http.Handler.
+func (h *dolHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for {
+		instance := h.current.Load()
+		if instance == nil {
+			http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+
+		// The instance might have been swapped out after it was loaded, in
+		// which case the new one is loaded again.
+		if !instance.acquire() {
+			continue
+		}
+		defer instance.release()
+
+		instance.ServeHTTP(w, r)
+		return
+	}
+}
+
+// reloadOnSIGHUP reloads the config file every time SIGHUP is received until
+// ctx is done. If the new config is invalid, the current instance is kept.
+func reloadOnSIGHUP(ctx context.Context, h *dolHandler) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sighup:
+		}
+
+		slog.Info(
+			"received SIGHUP, reloading config",
+			"config", config)
+
+		cfg, err := readConfig(config)
+		if err != nil {
+			slog.Error(
+				"failed to reload config, keeping the current one",
+				"error", err)
+			continue
+		}
+
+		instance, err := newDoLInstance(ctx, cfg, h.current.Load())
+		if err != nil {
+			slog.Error(
+				"failed to apply reloaded config, keeping the current one",
+				"error", err)
+			continue
+		}
+
+		h.swap(instance)
+		slog.Info("config reloaded")
+	}
+}
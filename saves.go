@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"libdb.so/dol-server/extension/autosync"
+)
+
+// saves implements the saves command. It exports and imports the saves of the
+// autosync extension as save files that the game can load, without going
+// through the server, and rotates the key that they are encrypted with.
+func saves(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: saves export|import|rotate-key [flags]")
+	}
+
+	switch args[0] {
+	case "export":
+		return exportSave(ctx, args[1:])
+	case "import":
+		return importSave(ctx, args[1:])
+	case "rotate-key":
+		return rotateSaveKey(ctx, args[1:])
+	default:
+		return fmt.Errorf("unknown saves command %q", args[0])
+	}
+}
+
+// saveRefFlags adds the flags that select a save to flags.
+func saveRefFlags(flags *pflag.FlagSet) *autosync.SaveRef {
+	var ref autosync.SaveRef
+	flags.StringVar(&ref.Profile, "profile", "", "profile of the save, or the shared profile if empty")
+	flags.StringVar(&ref.Game, "game", "", "name of the game of the save if game_path names several games")
+	flags.StringVar(&ref.Slot, "slot", autosync.AutosaveSlot, "slot of the save")
+	return &ref
+}
+
+// openSaves opens the autosync saves of the config file and checks that the
+// save's game is in the config.
+func openSaves(ref *autosync.SaveRef) (*autosync.Saves, error) {
+	cfg, err := readConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case cfg.GamePath.IsSingle():
+		if ref.Game != "" {
+			return nil, fmt.Errorf("--game is not supported with a single game_path")
+		}
+	case ref.Game == "":
+		return nil, fmt.Errorf("--game is required, one of: %s", strings.Join(gameNames(cfg.GamePath), ", "))
+	default:
+		if _, ok := cfg.GamePath[ref.Game]; !ok {
+			return nil, fmt.Errorf("unknown game %q, expected one of: %s", ref.Game, strings.Join(gameNames(cfg.GamePath), ", "))
+		}
+	}
+
+	saves, err := autosync.OpenSaves(cfg.Extensions[autosync.Extension.ID])
+	if err != nil {
+		return nil, fmt.Errorf("opening autosync saves: %w", err)
+	}
+
+	return saves, nil
+}
+
+func gameNames(paths GamePaths) []string {
+	names := make([]string, 0, len(paths))
+	for name := range paths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func exportSave(ctx context.Context, args []string) error {
+	flags := pflag.NewFlagSet("saves export", pflag.ContinueOnError)
+	ref := saveRefFlags(flags)
+	historyID := flags.String("history", "", "ID of the history entry to export instead of the current save")
+	output := flags.StringP("output", "o", "", "file to write the save to, or - for stdout (default: the name the game would use)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: saves export [flags]")
+	}
+
+	saves, err := openSaves(ref)
+	if err != nil {
+		return err
+	}
+	defer saves.Close()
+
+	name, file, err := saves.Export(ctx, *ref, *historyID)
+	if err != nil {
+		return fmt.Errorf("exporting save: %w", err)
+	}
+
+	if *output == "-" {
+		_, err := os.Stdout.Write(file)
+		return err
+	}
+
+	if *output == "" {
+		*output = name
+	}
+
+	if err := os.WriteFile(*output, file, 0o644); err != nil {
+		return fmt.Errorf("writing save file: %w", err)
+	}
+
+	fmt.Fprintln(os.Stderr, "exported save to", *output)
+	return nil
+}
+
+func importSave(ctx context.Context, args []string) error {
+	flags := pflag.NewFlagSet("saves import", pflag.ContinueOnError)
+	ref := saveRefFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: saves import [flags] <file|->")
+	}
+
+	var file []byte
+	var err error
+	if path := flags.Arg(0); path == "-" {
+		file, err = io.ReadAll(os.Stdin)
+	} else {
+		file, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return fmt.Errorf("reading save file: %w", err)
+	}
+
+	saves, err := openSaves(ref)
+	if err != nil {
+		return err
+	}
+	defer saves.Close()
+
+	entry, err := saves.Import(ctx, *ref, file)
+	if err != nil {
+		return fmt.Errorf("importing save: %w", err)
+	}
+
+	fmt.Fprintln(os.Stderr, "imported save as history entry", entry.ID)
+	return nil
+}
+
+func rotateSaveKey(ctx context.Context, args []string) error {
+	flags := pflag.NewFlagSet("saves rotate-key", pflag.ContinueOnError)
+	keyFile := flags.String("new-key-file", "", "key file to derive the new key from")
+	passphraseFile := flags.String("new-passphrase-file", "", "file with the passphrase to derive the new key from, or - for stdin")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 || (*keyFile == "") == (*passphraseFile == "") {
+		return fmt.Errorf("usage: saves rotate-key --new-key-file <file> | --new-passphrase-file <file|->")
+	}
+
+	newKey := autosync.EncryptionConfig{KeyFile: *keyFile}
+	if *passphraseFile != "" {
+		var b []byte
+		var err error
+		if *passphraseFile == "-" {
+			b, err = io.ReadAll(os.Stdin)
+		} else {
+			b, err = os.ReadFile(*passphraseFile)
+		}
+		if err != nil {
+			return fmt.Errorf("reading passphrase: %w", err)
+		}
+		newKey.Passphrase = strings.TrimRight(string(b), "\r\n")
+	}
+
+	cfg, err := readConfig(config)
+	if err != nil {
+		return err
+	}
+
+	saves, err := autosync.OpenSaves(cfg.Extensions[autosync.Extension.ID])
+	if err != nil {
+		return fmt.Errorf("opening autosync saves: %w", err)
+	}
+	defer saves.Close()
+
+	n, err := saves.RotateKey(ctx, newKey)
+	if err != nil {
+		return fmt.Errorf("rotating key after encrypting %d files: %w", n, err)
+	}
+
+	fmt.Fprintf(os.Stderr, "encrypted %d files with the new key\n", n)
+	fmt.Fprintln(os.Stderr, "change the encryption of the autosync config to the new key before starting the server")
+	return nil
+}
@@ -0,0 +1,340 @@
+// Package storydata parses and rewrites the Twine 2 story data embedded in the
+// Degrees of Lewdity HTML file. The story data is the <tw-storydata> element,
+// which contains every passage of the game as a <tw-passagedata> element.
+package storydata
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	xhtml "golang.org/x/net/html"
+)
+
+// Passage is a single passage in the story.
+type Passage struct {
+	// PID is the passage ID. It is assigned automatically to new passages.
+	PID string
+	// Name is the unique name of the passage.
+	Name string
+	// Tags are the tags of the passage.
+	Tags []string
+	// Position and Size describe where the passage is placed in the Twine
+	// editor. They are kept as is.
+	Position string
+	Size     string
+	// Text is the unescaped passage source.
+	Text string
+}
+
+func (p *Passage) equal(other *Passage) bool {
+	return p.PID == other.PID &&
+		p.Name == other.Name &&
+		p.Position == other.Position &&
+		p.Size == other.Size &&
+		p.Text == other.Text &&
+		strings.Join(p.Tags, " ") == strings.Join(other.Tags, " ")
+}
+
+// Story is the story data of an HTML document. Passages can be added, replaced
+// and removed, and the document is written back out with Bytes. Everything
+// else in the document is kept as is.
+type Story struct {
+	// Name is the name of the story.
+	Name string
+	// Format and FormatVersion describe the story format, which is SugarCube
+	// for DoL.
+	Format        string
+	FormatVersion string
+
+	doc      []byte
+	segments []segment
+	passages []*Passage
+	byName   map[string]*Passage
+	maxPID   int
+}
+
+// segment is a part of the story data element. It is either raw bytes that
+// are written back as is or a parsed passage.
+type segment struct {
+	raw     []byte
+	passage *passageSegment
+}
+
+type passageSegment struct {
+	raw  []byte
+	orig Passage
+	live *Passage
+}
+
+// ErrNoStoryData is returned by Parse if the document does not contain any
+// story data.
+var ErrNoStoryData = errors.New("no <tw-storydata> element found")
+
+// Parse parses the story data in the given HTML document. The document must
+// not be modified afterwards.
+func Parse(doc []byte) (*Story, error) {
+	s := &Story{
+		doc:    doc,
+		byName: make(map[string]*Passage),
+	}
+
+	z := xhtml.NewTokenizer(bytes.NewReader(doc))
+	var offset int
+
+	// storyStart and storyEnd are the offsets of the contents of the story
+	// data element.
+	storyStart := -1
+	storyEnd := -1
+	// rawStart is the start of the raw bytes since the last passage.
+	rawStart := -1
+
+	var current *passageSegment
+	var currentStart int
+	var text strings.Builder
+
+	for storyEnd == -1 {
+		tt := z.Next()
+		if tt == xhtml.ErrorToken {
+			if err := z.Err(); !errors.Is(err, io.EOF) {
+				return nil, fmt.Errorf("tokenizing HTML: %w", err)
+			}
+			break
+		}
+
+		start := offset
+		offset += len(z.Raw())
+
+		if storyStart == -1 {
+			if tt == xhtml.StartTagToken && isTag(z, "tw-storydata") {
+				attrs := tagAttrs(z)
+				s.Name = attrs["name"]
+				s.Format = attrs["format"]
+				s.FormatVersion = attrs["format-version"]
+				storyStart = offset
+				rawStart = offset
+			}
+			continue
+		}
+
+		switch {
+		case current != nil && tt == xhtml.TextToken:
+			text.Write(z.Text())
+
+		case current != nil && tt == xhtml.EndTagToken && isTag(z, "tw-passagedata"):
+			current.orig.Text = text.String()
+			current.raw = doc[currentStart:offset]
+			p := current.orig
+			p.Tags = append([]string(nil), p.Tags...)
+			current.live = &p
+			if err := s.add(current.live); err != nil {
+				return nil, err
+			}
+			s.segments = append(s.segments, segment{passage: current})
+			current = nil
+			rawStart = offset
+
+		case current != nil:
+			return nil, fmt.Errorf("unexpected markup in passage %q", current.orig.Name)
+
+		case tt == xhtml.StartTagToken && isTag(z, "tw-passagedata"):
+			if rawStart < start {
+				s.segments = append(s.segments, segment{raw: doc[rawStart:start]})
+			}
+
+			attrs := tagAttrs(z)
+			current = &passageSegment{
+				orig: Passage{
+					PID:      attrs["pid"],
+					Name:     attrs["name"],
+					Tags:     strings.Fields(attrs["tags"]),
+					Position: attrs["position"],
+					Size:     attrs["size"],
+				},
+			}
+			currentStart = start
+			text.Reset()
+
+		case tt == xhtml.EndTagToken && isTag(z, "tw-storydata"):
+			storyEnd = start
+		}
+	}
+
+	if storyStart == -1 {
+		return nil, ErrNoStoryData
+	}
+	if storyEnd == -1 {
+		return nil, fmt.Errorf("unterminated <tw-storydata> element")
+	}
+
+	if rawStart < storyEnd {
+		s.segments = append(s.segments, segment{raw: doc[rawStart:storyEnd]})
+	}
+
+	// Store the parts of the document outside the story data as raw segments
+	// as well, so that writing the document back is a single loop.
+	s.segments = append([]segment{{raw: doc[:storyStart]}}, s.segments...)
+	s.segments = append(s.segments, segment{raw: doc[storyEnd:]})
+
+	return s, nil
+}
+
+func isTag(z *xhtml.Tokenizer, name string) bool {
+	tagName, _ := z.TagName()
+	return string(tagName) == name
+}
+
+func tagAttrs(z *xhtml.Tokenizer) map[string]string {
+	attrs := make(map[string]string)
+	for {
+		k, v, more := z.TagAttr()
+		if len(k) > 0 {
+			attrs[string(k)] = string(v)
+		}
+		if !more {
+			return attrs
+		}
+	}
+}
+
+func (s *Story) add(p *Passage) error {
+	if _, ok := s.byName[p.Name]; ok {
+		return fmt.Errorf("duplicate passage %q", p.Name)
+	}
+	if pid, err := strconv.Atoi(p.PID); err == nil && pid > s.maxPID {
+		s.maxPID = pid
+	}
+	s.passages = append(s.passages, p)
+	s.byName[p.Name] = p
+	return nil
+}
+
+// Passages returns all passages in the story, in order. The passages may be
+// modified in place, except for their names.
+func (s *Story) Passages() []*Passage {
+	return s.passages
+}
+
+// Passage returns the passage with the given name, or nil if there is none.
+func (s *Story) Passage(name string) *Passage {
+	return s.byName[name]
+}
+
+// SetPassage adds the passage to the story, or replaces the passage with the
+// same name. A replaced passage keeps its position in the story, and it keeps
+// its PID unless p has one.
+func (s *Story) SetPassage(p Passage) {
+	if old, ok := s.byName[p.Name]; ok {
+		if p.PID == "" {
+			p.PID = old.PID
+		}
+		*old = p
+		return
+	}
+
+	if p.PID == "" {
+		s.maxPID++
+		p.PID = strconv.Itoa(s.maxPID)
+	}
+
+	s.add(&p)
+}
+
+// RemovePassage removes the passage with the given name. It returns false if
+// there is no such passage.
+func (s *Story) RemovePassage(name string) bool {
+	p, ok := s.byName[name]
+	if !ok {
+		return false
+	}
+
+	delete(s.byName, name)
+	for i, passage := range s.passages {
+		if passage == p {
+			s.passages = append(s.passages[:i], s.passages[i+1:]...)
+			break
+		}
+	}
+
+	return true
+}
+
+// PatchPassage replaces all matches of re in the text of the named passage
+// with repl, which may refer to submatches as in regexp.Regexp.ReplaceAll. It
+// returns an error if the passage does not exist or if re does not match, so
+// that patches that no longer apply to a new game build are noticed.
+func (s *Story) PatchPassage(name string, re *regexp.Regexp, repl string) error {
+	p, ok := s.byName[name]
+	if !ok {
+		return fmt.Errorf("passage %q not found", name)
+	}
+	if !re.MatchString(p.Text) {
+		return fmt.Errorf("pattern %q does not match passage %q", re, name)
+	}
+	p.Text = re.ReplaceAllString(p.Text, repl)
+	return nil
+}
+
+// Bytes returns the HTML document with the story data written back into it.
+// Passages that were not changed are written exactly as they were parsed.
+func (s *Story) Bytes() []byte {
+	live := make(map[*Passage]bool, len(s.passages))
+	for _, p := range s.passages {
+		live[p] = true
+	}
+
+	var out bytes.Buffer
+	out.Grow(len(s.doc))
+
+	// New passages are written right after the last parsed passage, or at the
+	// end of the story data if there were none.
+	last := len(s.segments) - 2
+	for i, seg := range s.segments {
+		if seg.passage != nil {
+			last = i
+		}
+	}
+
+	for i, seg := range s.segments {
+		switch {
+		case seg.passage == nil:
+			out.Write(seg.raw)
+		case !live[seg.passage.live]:
+			// Removed.
+		case seg.passage.live.equal(&seg.passage.orig):
+			out.Write(seg.passage.raw)
+		default:
+			writePassage(&out, seg.passage.live)
+		}
+
+		if seg.passage != nil {
+			delete(live, seg.passage.live)
+		}
+
+		if i == last {
+			for _, p := range s.passages {
+				if live[p] {
+					writePassage(&out, p)
+				}
+			}
+		}
+	}
+
+	return out.Bytes()
+}
+
+func writePassage(out *bytes.Buffer, p *Passage) {
+	fmt.Fprintf(out,
+		`<tw-passagedata pid="%s" name="%s" tags="%s" position="%s" size="%s">%s</tw-passagedata>`,
+		html.EscapeString(p.PID),
+		html.EscapeString(p.Name),
+		html.EscapeString(strings.Join(p.Tags, " ")),
+		html.EscapeString(p.Position),
+		html.EscapeString(p.Size),
+		html.EscapeString(p.Text))
+}
@@ -0,0 +1,234 @@
+package storydata
+
+import (
+	"errors"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const (
+	testStartPassage  = `<tw-passagedata pid="1" name="Start" tags="nobr widget" position="100,100" size="100,100">You are in &quot;town&quot; &amp; it&#39;s &lt;b&gt;late&lt;/b&gt;.</tw-passagedata>`
+	testForestPassage = `<tw-passagedata pid="7" name="Forest" tags="" position="200,100" size="100,100">[[Start]]</tw-passagedata>`
+)
+
+// testDoc is a story in the shape that Twine publishes it. The script mentions
+// a passage element, which must not be mistaken for a passage.
+const testDoc = `<!DOCTYPE html>
+<html><head><title>DoL</title></head><body>
+<tw-storydata name="Degrees of Lewdity" startnode="1" format="SugarCube" format-version="2.36.1" hidden>` +
+	`<style role="stylesheet" id="twine-user-stylesheet" type="text/twine-css">body { color: red; }</style>` +
+	`<script role="script" id="twine-user-script" type="text/twine-javascript">var s = "<tw-passagedata name='fake'>";</script>
+` + testStartPassage + `
+` + testForestPassage + `
+</tw-storydata>
+<script>after</script>
+</body></html>
+`
+
+func TestParse(t *testing.T) {
+	s, err := Parse([]byte(testDoc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Name != "Degrees of Lewdity" || s.Format != "SugarCube" || s.FormatVersion != "2.36.1" {
+		t.Errorf("story is %q in %q %q", s.Name, s.Format, s.FormatVersion)
+	}
+
+	var names []string
+	for _, p := range s.Passages() {
+		names = append(names, p.Name)
+	}
+	if !slices.Equal(names, []string{"Start", "Forest"}) {
+		t.Fatalf("passages are %q", names)
+	}
+
+	start := s.Passage("Start")
+	want := Passage{
+		PID:      "1",
+		Name:     "Start",
+		Tags:     []string{"nobr", "widget"},
+		Position: "100,100",
+		Size:     "100,100",
+		Text:     `You are in "town" & it's <b>late</b>.`,
+	}
+	if !start.equal(&want) {
+		t.Errorf("Start is %+v, want %+v", start, want)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		want error
+	}{
+		{
+			name: "no story data",
+			doc:  "<html><body></body></html>",
+			want: ErrNoStoryData,
+		},
+		{
+			name: "unterminated",
+			doc:  "<tw-storydata>" + testStartPassage,
+		},
+		{
+			name: "duplicate passage",
+			doc:  "<tw-storydata>" + testStartPassage + testStartPassage + "</tw-storydata>",
+		},
+		{
+			name: "markup in passage",
+			doc:  `<tw-storydata><tw-passagedata name="Start"><b>hi</b></tw-passagedata></tw-storydata>`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Parse([]byte(test.doc))
+			if err == nil {
+				t.Fatal("no error")
+			}
+			if test.want != nil && !errors.Is(err, test.want) {
+				t.Errorf("got %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestBytes(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(t *testing.T, s *Story)
+		want string
+	}{
+		{
+			name: "unchanged",
+			edit: func(t *testing.T, s *Story) {},
+			want: testDoc,
+		},
+		{
+			name: "set to the same passage",
+			edit: func(t *testing.T, s *Story) {
+				s.SetPassage(*s.Passage("Forest"))
+			},
+			want: testDoc,
+		},
+		{
+			name: "add",
+			edit: func(t *testing.T, s *Story) {
+				s.SetPassage(Passage{
+					Name: "Lake",
+					Tags: []string{"water"},
+					Text: `a < b & "c"`,
+				})
+				if pid := s.Passage("Lake").PID; pid != "8" {
+					t.Errorf("new passage has PID %q, want 8", pid)
+				}
+			},
+			want: strings.Replace(testDoc, testForestPassage, testForestPassage+
+				`<tw-passagedata pid="8" name="Lake" tags="water" position="" size="">a &lt; b &amp; &#34;c&#34;</tw-passagedata>`, 1),
+		},
+		{
+			name: "replace",
+			edit: func(t *testing.T, s *Story) {
+				s.SetPassage(Passage{Name: "Start", Text: "new"})
+			},
+			want: strings.Replace(testDoc, testStartPassage,
+				`<tw-passagedata pid="1" name="Start" tags="" position="" size="">new</tw-passagedata>`, 1),
+		},
+		{
+			name: "modify in place",
+			edit: func(t *testing.T, s *Story) {
+				s.Passage("Forest").Tags = []string{"dark"}
+			},
+			want: strings.Replace(testDoc, testForestPassage,
+				`<tw-passagedata pid="7" name="Forest" tags="dark" position="200,100" size="100,100">[[Start]]</tw-passagedata>`, 1),
+		},
+		{
+			name: "patch",
+			edit: func(t *testing.T, s *Story) {
+				if err := s.PatchPassage("Forest", regexp.MustCompile(`\[\[(\w+)\]\]`), "[[Back|$1]]"); err != nil {
+					t.Fatal(err)
+				}
+				if err := s.PatchPassage("Forest", regexp.MustCompile(`nowhere`), ""); err == nil {
+					t.Error("patch that does not match did not fail")
+				}
+			},
+			want: strings.Replace(testDoc, testForestPassage,
+				`<tw-passagedata pid="7" name="Forest" tags="" position="200,100" size="100,100">[[Back|Start]]</tw-passagedata>`, 1),
+		},
+		{
+			name: "remove",
+			edit: func(t *testing.T, s *Story) {
+				if !s.RemovePassage("Start") {
+					t.Error("Start was not removed")
+				}
+				if s.RemovePassage("Nowhere") {
+					t.Error("missing passage was removed")
+				}
+			},
+			want: strings.Replace(testDoc, testStartPassage, "", 1),
+		},
+		{
+			name: "remove and add again",
+			edit: func(t *testing.T, s *Story) {
+				s.RemovePassage("Start")
+				s.SetPassage(Passage{Name: "Start", Text: "again"})
+			},
+			want: strings.Replace(
+				strings.Replace(testDoc, testStartPassage, "", 1),
+				testForestPassage,
+				testForestPassage+`<tw-passagedata pid="8" name="Start" tags="" position="" size="">again</tw-passagedata>`, 1),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := Parse([]byte(testDoc))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			test.edit(t, s)
+
+			got := string(s.Bytes())
+			if got != test.want {
+				t.Fatalf("got:\n%s\nwant:\n%s", got, test.want)
+			}
+
+			// The written document must parse back to the same passages.
+			again, err := Parse([]byte(got))
+			if err != nil {
+				t.Fatal("parsing written document:", err)
+			}
+			if len(again.Passages()) != len(s.Passages()) {
+				t.Fatalf("written document has %d passages, want %d", len(again.Passages()), len(s.Passages()))
+			}
+			for i, p := range s.Passages() {
+				if !again.Passages()[i].equal(p) {
+					t.Errorf("passage %d is %+v after writing, want %+v", i, again.Passages()[i], p)
+				}
+			}
+		})
+	}
+}
+
+func TestBytesEmptyStory(t *testing.T) {
+	const doc = `<html><body><tw-storydata name="Empty"></tw-storydata></body></html>`
+
+	s, err := Parse([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.SetPassage(Passage{Name: "Start", Text: "hi"})
+
+	want := `<html><body><tw-storydata name="Empty">` +
+		`<tw-passagedata pid="1" name="Start" tags="" position="" size="">hi</tw-passagedata>` +
+		`</tw-storydata></body></html>`
+	if got := string(s.Bytes()); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,126 @@
+package storydata
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ParseTwee parses passages written in the Twee 3 format:
+//
+//	:: Passage Name [tag1 tag2] {"position":"100,100","size":"100,100"}
+//	Passage text...
+//
+// The tags and the metadata are optional. Passage text is trimmed of trailing
+// whitespace, and text lines that start with an escaped "\::" are unescaped.
+func ParseTwee(src []byte) ([]Passage, error) {
+	var passages []Passage
+	var current *Passage
+	var text strings.Builder
+
+	flush := func() {
+		if current != nil {
+			current.Text = strings.TrimRight(text.String(), " \t\r\n")
+			passages = append(passages, *current)
+		}
+		text.Reset()
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(src))
+	scanner.Buffer(nil, len(src)+1)
+
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+
+		if strings.HasPrefix(line, "::") {
+			flush()
+
+			p, err := parseTweeHeader(line[2:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			current = &p
+			continue
+		}
+
+		if current == nil {
+			if strings.TrimSpace(line) != "" {
+				return nil, fmt.Errorf("line %d: text outside of a passage", lineNo)
+			}
+			continue
+		}
+
+		if strings.HasPrefix(line, `\::`) {
+			line = line[1:]
+		}
+
+		text.WriteString(line)
+		text.WriteByte('\n')
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	flush()
+	return passages, nil
+}
+
+// parseTweeHeader parses the part of a passage header after the "::".
+func parseTweeHeader(header string) (Passage, error) {
+	header = strings.TrimSpace(header)
+
+	var p Passage
+	var name strings.Builder
+
+	i := 0
+	for ; i < len(header); i++ {
+		c := header[i]
+		if c == '\\' && i+1 < len(header) {
+			i++
+			name.WriteByte(header[i])
+			continue
+		}
+		if c == '[' || c == '{' {
+			break
+		}
+		name.WriteByte(c)
+	}
+
+	p.Name = strings.TrimSpace(name.String())
+	if p.Name == "" {
+		return p, fmt.Errorf("passage has no name")
+	}
+
+	rest := strings.TrimSpace(header[i:])
+
+	if strings.HasPrefix(rest, "[") {
+		end := strings.IndexByte(rest, ']')
+		if end == -1 {
+			return p, fmt.Errorf("passage %q has unterminated tags", p.Name)
+		}
+		p.Tags = strings.Fields(rest[1:end])
+		rest = strings.TrimSpace(rest[end+1:])
+	}
+
+	if strings.HasPrefix(rest, "{") {
+		var metadata struct {
+			Position string `json:"position"`
+			Size     string `json:"size"`
+		}
+		if err := json.Unmarshal([]byte(rest), &metadata); err != nil {
+			return p, fmt.Errorf("passage %q has invalid metadata: %w", p.Name, err)
+		}
+		p.Position = metadata.Position
+		p.Size = metadata.Size
+		rest = ""
+	}
+
+	if rest != "" {
+		return p, fmt.Errorf("passage %q has unexpected %q in its header", p.Name, rest)
+	}
+
+	return p, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// gameReloadDelay is how long to wait after the last change to the game
+// directory before reloading the game. Copying a new release into place
+// produces a burst of events, and the HTML file alone is tens of megabytes.
+const gameReloadDelay = time.Second
+
+// watch watches the game directory and reloads the game whenever its HTML file
+// is added, replaced or removed. It blocks until ctx is done.
+//
+// The parent directory is also watched, so that replacing the whole game
+// directory or the game's zip archive is picked up as well.
+func (g *dolGame) watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	gamePath := filepath.Clean(g.path)
+
+	isArchive := isGameArchive(gamePath)
+	if isArchive {
+		// Archives are usually replaced rather than written to, so only the
+		// parent directory can reliably tell us about changes.
+		if err := watcher.Add(filepath.Dir(gamePath)); err != nil {
+			return fmt.Errorf("failed to watch directory of game archive: %w", err)
+		}
+	} else {
+		if err := watcher.Add(gamePath); err != nil {
+			return fmt.Errorf("failed to watch game directory: %w", err)
+		}
+		if err := watcher.Add(filepath.Dir(gamePath)); err != nil {
+			slog.Warn(
+				"failed to watch parent of game directory, replacing the game directory will not be detected",
+				"game", g.name,
+				"path", gamePath,
+				"error", err)
+		}
+	}
+
+	reload := time.NewTimer(0)
+	if !reload.Stop() {
+		<-reload.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			reload.Stop()
+			return nil
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			slog.Warn(
+				"error watching Degrees of Lewdity directory",
+				"game", g.name,
+				"path", gamePath,
+				"error", err)
+
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+
+			switch {
+			case ev.Name == gamePath && isArchive:
+				if ev.Op == fsnotify.Chmod {
+					continue
+				}
+			case ev.Name == gamePath:
+				if !ev.Has(fsnotify.Create) {
+					continue
+				}
+				// The game directory was replaced. The old watch is gone
+				// along with the old directory, so watch the new one.
+				if err := watcher.Add(gamePath); err != nil {
+					slog.Warn(
+						"failed to watch replaced game directory",
+						"game", g.name,
+						"path", gamePath,
+						"error", err)
+				}
+			case filepath.Dir(ev.Name) == gamePath && filepath.Ext(ev.Name) == ".html":
+				if ev.Op == fsnotify.Chmod {
+					continue
+				}
+			default:
+				continue
+			}
+
+			slog.Debug(
+				"Degrees of Lewdity directory changed",
+				"game", g.name,
+				"event", ev.String())
+
+			reload.Reset(gameReloadDelay)
+
+		case <-reload.C:
+			if err := g.load(ctx); err != nil {
+				slog.Error(
+					"failed to reload Degrees of Lewdity, keeping the old build",
+					"game", g.name,
+					"path", gamePath,
+					"error", err)
+			}
+		}
+	}
+}